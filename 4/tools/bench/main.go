@@ -0,0 +1,536 @@
+// bench replays the credentials made by gendummy against the webapp and checks
+// /login, /mypage and /report for correctness while measuring latency.
+//
+//	bench -target unix:/tmp/isucon_go.sock -users-tsv dummy_users.tsv -used-users-tsv dummy_users_used.tsv
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	target            = flag.String("target", "http://127.0.0.1", "http://host:port or unix:/path/to.sock")
+	usersTSV          = flag.String("users-tsv", "dummy_users.tsv", "users TSV from gendummy users")
+	usedUsersTSV      = flag.String("used-users-tsv", "dummy_users_used.tsv", "users already in login_log; they are skipped")
+	expectedReport    = flag.String("expected-report", "", "expected /report JSON from gendummy log")
+	workers           = flag.Int("workers", 10, "concurrent workers")
+	duration          = flag.Duration("duration", 60*time.Second, "benchmark duration")
+	timeTolerance     = flag.Duration("time-tolerance", 3*time.Second, "allowed skew of the last login time on /mypage")
+	userLockThreshold = flag.Int("user-lock-threshold", 3, "same as ISU4_USER_LOCK_THRESHOLD")
+	ipBanThreshold    = flag.Int("ip-ban-threshold", 10, "same as ISU4_IP_BAN_THRESHOLD")
+)
+
+var (
+	lastLoginAtRe = regexp.MustCompile(`<dd id="last-logined-at">([^<]*)</dd>`)
+	lastLoginIPRe = regexp.MustCompile(`<dd id="last-logined-ip">([^<]*)</dd>`)
+)
+
+type user struct {
+	ID    int
+	Login string
+	Pass  string
+}
+
+func main() {
+	flag.Parse()
+
+	users, err := readUsers(*usersTSV, *usedUsersTSV)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rand.Shuffle(len(users), func(i, j int) { users[i], users[j] = users[j], users[i] })
+
+	b := &bench{
+		baseURL:   "http://localhost",
+		transport: &http.Transport{MaxIdleConnsPerHost: *workers},
+		users:     make(chan *user, len(users)),
+		stats:     make(map[string][]time.Duration),
+		errors:    make(map[string]int),
+	}
+	if strings.HasPrefix(*target, "unix:") {
+		sock := strings.TrimPrefix(*target, "unix:")
+		b.transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		}
+	} else {
+		b.baseURL = strings.TrimRight(*target, "/")
+	}
+	for _, u := range users {
+		b.users <- u
+	}
+	close(b.users)
+
+	log.Printf("start: %d workers, %s, %d fresh users", *workers, *duration, len(users))
+
+	deadline := time.Now().Add(*duration)
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				if !b.runScenario() {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	b.checkReport()
+	b.printResult()
+}
+
+type bench struct {
+	baseURL   string
+	transport *http.Transport
+	users     chan *user
+	nextIP    uint32
+	nouser    uint32
+
+	mu          sync.Mutex
+	success     int
+	stats       map[string][]time.Duration
+	errors      map[string]int
+	bannedIPs   []string
+	lockedUsers []string
+}
+
+func (b *bench) runScenario() bool {
+	u, ok := <-b.users
+	if !ok {
+		return false
+	}
+
+	switch rand.Intn(5) {
+	case 0:
+		b.lockScenario(u, rand.Intn(2) == 0)
+	case 1:
+		b.banScenario(u, rand.Intn(2) == 0)
+	default:
+		b.loginScenario(u)
+	}
+	return true
+}
+
+// ip returns an address no other request has used yet.
+func (b *bench) ip() string {
+	n := atomic.AddUint32(&b.nextIP, 1)
+	return fmt.Sprintf("10.%d.%d.%d", (n>>16)&0xff, (n>>8)&0xff, n&0xff)
+}
+
+func (b *bench) violation(format string, args ...interface{}) {
+	b.mu.Lock()
+	b.errors[fmt.Sprintf(format, args...)]++
+	b.mu.Unlock()
+}
+
+// loginScenario logs in twice and checks /mypage shows the previous login each time.
+func (b *bench) loginScenario(u *user) {
+	first, firstAt := b.ip(), time.Now()
+	s := b.newSession()
+	if !s.login(u, first, "") {
+		return
+	}
+	if !s.mypage(u, first, firstAt) {
+		return
+	}
+
+	second := b.ip()
+	s = b.newSession()
+	if !s.login(u, second, "") {
+		return
+	}
+	s.mypage(u, first, firstAt)
+}
+
+// lockScenario fails the password up to the lock threshold; reaching it
+// must lock the user, stopping one short must not.
+func (b *bench) lockScenario(u *user, reach bool) {
+	fails := *userLockThreshold
+	if !reach {
+		fails--
+	}
+
+	wrong := &user{ID: u.ID, Login: u.Login, Pass: u.Pass + "-wrong"}
+	for i := 0; i < fails; i++ {
+		if !b.newSession().login(wrong, b.ip(), "wrong") {
+			return
+		}
+	}
+
+	ip, at := b.ip(), time.Now()
+	if reach {
+		if b.newSession().login(u, ip, "locked") {
+			b.mu.Lock()
+			b.lockedUsers = append(b.lockedUsers, u.Login)
+			b.mu.Unlock()
+		}
+		return
+	}
+
+	s := b.newSession()
+	if s.login(u, ip, "") {
+		s.mypage(u, ip, at)
+	}
+}
+
+// banScenario fails from one IP with unknown logins up to the ban threshold;
+// reaching it must ban the IP even for a correct password.
+func (b *bench) banScenario(u *user, reach bool) {
+	fails := *ipBanThreshold
+	if !reach {
+		fails--
+	}
+
+	ip := b.ip()
+	for i := 0; i < fails; i++ {
+		n := atomic.AddUint32(&b.nouser, 1)
+		nouser := &user{Login: fmt.Sprintf("bench_nouser_%d", n), Pass: "x"}
+		if !b.newSession().login(nouser, ip, "wrong") {
+			return
+		}
+	}
+
+	at := time.Now()
+	if reach {
+		if b.newSession().login(u, ip, "banned") {
+			b.mu.Lock()
+			b.bannedIPs = append(b.bannedIPs, ip)
+			b.mu.Unlock()
+		}
+		return
+	}
+
+	s := b.newSession()
+	if s.login(u, ip, "") {
+		s.mypage(u, ip, at)
+	}
+}
+
+type session struct {
+	b      *bench
+	client *http.Client
+}
+
+func (b *bench) newSession() *session {
+	jar, _ := cookiejar.New(nil)
+	return &session{
+		b: b,
+		client: &http.Client{
+			Transport: b.transport,
+			Jar:       jar,
+			Timeout:   10 * time.Second,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func (s *session) do(label string, req *http.Request) (*http.Response, string, bool) {
+	start := time.Now()
+	res, err := s.client.Do(req)
+	if err != nil {
+		s.b.violation("%s: request failed: %v", label, err)
+		return nil, "", false
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	elapsed := time.Since(start)
+	if err != nil {
+		s.b.violation("%s: reading body failed: %v", label, err)
+		return nil, "", false
+	}
+
+	s.b.mu.Lock()
+	s.b.stats[label] = append(s.b.stats[label], elapsed)
+	s.b.mu.Unlock()
+	return res, string(body), true
+}
+
+func (s *session) ok() {
+	s.b.mu.Lock()
+	s.b.success++
+	s.b.mu.Unlock()
+}
+
+// login posts the credentials from ip. notice is the expected notice cookie,
+// or "" when the login must succeed.
+func (s *session) login(u *user, ip, notice string) bool {
+	form := url.Values{"login": {u.Login}, "password": {u.Pass}}
+	req, _ := http.NewRequest("POST", s.b.baseURL+"/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Forwarded-For", ip)
+
+	res, _, ok := s.do("POST /login", req)
+	if !ok {
+		return false
+	}
+	if res.StatusCode != http.StatusFound {
+		s.b.violation("POST /login: status %d, want %d", res.StatusCode, http.StatusFound)
+		return false
+	}
+
+	want := "/mypage"
+	if notice != "" {
+		want = "/"
+	}
+	if loc := res.Header.Get("Location"); loc != want && !strings.HasSuffix(loc, want) {
+		s.b.violation("POST /login (%s): redirected to %q, want %q", expectation(notice), loc, want)
+		return false
+	}
+
+	got := ""
+	for _, c := range res.Cookies() {
+		if c.Name == "notice" {
+			got = c.Value
+		}
+	}
+	if got != notice {
+		s.b.violation("POST /login (%s): notice %q", expectation(notice), got)
+		return false
+	}
+
+	s.ok()
+	return true
+}
+
+func expectation(notice string) string {
+	if notice == "" {
+		return "success"
+	}
+	return notice
+}
+
+// mypage checks the last login shown is wantIP at about wantAt.
+func (s *session) mypage(u *user, wantIP string, wantAt time.Time) bool {
+	req, _ := http.NewRequest("GET", s.b.baseURL+"/mypage", nil)
+	res, body, ok := s.do("GET /mypage", req)
+	if !ok {
+		return false
+	}
+	if res.StatusCode != http.StatusOK {
+		s.b.violation("GET /mypage: status %d, want %d", res.StatusCode, http.StatusOK)
+		return false
+	}
+
+	if m := lastLoginIPRe.FindStringSubmatch(body); m == nil || m[1] != wantIP {
+		s.b.violation("GET /mypage: wrong last login IP")
+		return false
+	}
+
+	m := lastLoginAtRe.FindStringSubmatch(body)
+	if m == nil {
+		s.b.violation("GET /mypage: last login time not found")
+		return false
+	}
+	at, err := time.ParseInLocation("2006-01-02 15:04:05", m[1], time.Local)
+	if err != nil {
+		s.b.violation("GET /mypage: malformed last login time")
+		return false
+	}
+	if d := at.Sub(wantAt.Truncate(time.Second)); d < -*timeTolerance || *timeTolerance < d {
+		s.b.violation("GET /mypage: wrong last login time")
+		return false
+	}
+
+	s.ok()
+	return true
+}
+
+// checkReport checks /report lists exactly the bans and locks this run
+// caused plus those in -expected-report. Without -expected-report the
+// login_log must start out with no bans or locks.
+func (b *bench) checkReport() {
+	req, _ := http.NewRequest("GET", b.baseURL+"/report", nil)
+	res, body, ok := b.newSession().do("GET /report", req)
+	if !ok {
+		return
+	}
+	if res.StatusCode != http.StatusOK {
+		b.violation("GET /report: status %d, want %d", res.StatusCode, http.StatusOK)
+		return
+	}
+
+	var got map[string][]string
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		b.violation("GET /report: invalid JSON: %v", err)
+		return
+	}
+
+	want := map[string][]string{
+		"banned_ips":   b.bannedIPs,
+		"locked_users": b.lockedUsers,
+	}
+	if *expectedReport != "" {
+		f, err := os.Open(*expectedReport)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var expected map[string][]string
+		if err := json.NewDecoder(f).Decode(&expected); err != nil {
+			log.Fatal(err)
+		}
+		f.Close()
+		for k, v := range expected {
+			want[k] = append(want[k], v...)
+		}
+	}
+
+	for _, key := range []string{"banned_ips", "locked_users"} {
+		missing, extra := diffStrings(got[key], want[key])
+		if len(missing) > 0 || len(extra) > 0 {
+			b.violation("GET /report: %s: got %d, want %d; missing %v, unexpected %v",
+				key, len(got[key]), len(want[key]), abbrev(missing), abbrev(extra))
+		}
+	}
+}
+
+// diffStrings returns the values of want not in got, and of got not in want,
+// each sorted.
+func diffStrings(got, want []string) (missing, extra []string) {
+	in := func(l []string) map[string]bool {
+		m := make(map[string]bool, len(l))
+		for _, v := range l {
+			m[v] = true
+		}
+		return m
+	}
+	gotSet, wantSet := in(got), in(want)
+	for v := range wantSet {
+		if !gotSet[v] {
+			missing = append(missing, v)
+		}
+	}
+	for v := range gotSet {
+		if !wantSet[v] {
+			extra = append(extra, v)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+	return missing, extra
+}
+
+// abbrev keeps violation messages short when a whole list is off.
+func abbrev(l []string) string {
+	const max = 10
+	if len(l) <= max {
+		return "[" + strings.Join(l, " ") + "]"
+	}
+	return fmt.Sprintf("[%s ... and %d more]", strings.Join(l[:max], " "), len(l)-max)
+}
+
+func (b *bench) printResult() {
+	violations := 0
+	for _, n := range b.errors {
+		violations += n
+	}
+
+	score := b.success - 20*violations
+	if score < 0 {
+		score = 0
+	}
+
+	fmt.Printf("score: %d (success: %d, violations: %d)\n", score, b.success, violations)
+	fmt.Printf("locked users: %d, banned IPs: %d\n", len(b.lockedUsers), len(b.bannedIPs))
+	fmt.Println()
+
+	labels := make([]string, 0, len(b.stats))
+	for label := range b.stats {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	fmt.Printf("%-14s %8s %10s %10s %10s %10s\n", "request", "count", "p50", "p90", "p99", "max")
+	for _, label := range labels {
+		ds := b.stats[label]
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+		fmt.Printf("%-14s %8d %10s %10s %10s %10s\n", label, len(ds),
+			percentile(ds, 50), percentile(ds, 90), percentile(ds, 99), percentile(ds, 100))
+	}
+
+	if violations == 0 {
+		return
+	}
+	fmt.Println()
+	fmt.Println("violations:")
+	msgs := make([]string, 0, len(b.errors))
+	for msg := range b.errors {
+		msgs = append(msgs, msg)
+	}
+	sort.Strings(msgs)
+	for _, msg := range msgs {
+		fmt.Printf("  %5d  %s\n", b.errors[msg], msg)
+	}
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i].Truncate(time.Microsecond)
+}
+
+func readUsers(path, usedPath string) ([]*user, error) {
+	used := make(map[int]bool)
+	if f, err := os.Open(usedPath); err == nil {
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			if id, err := strconv.Atoi(strings.SplitN(s.Text(), "\t", 2)[0]); err == nil {
+				used[id] = true
+			}
+		}
+		f.Close()
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make([]*user, 0)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		cols := strings.Split(s.Text(), "\t")
+		if len(cols) < 3 {
+			return nil, fmt.Errorf("%s: malformed line: %q", path, s.Text())
+		}
+		id, err := strconv.Atoi(cols[0])
+		if err != nil {
+			return nil, err
+		}
+		if used[id] {
+			continue
+		}
+		users = append(users, &user{ID: id, Login: cols[1], Pass: cols[2]})
+	}
+
+	return users, s.Err()
+}
@@ -0,0 +1,490 @@
+// gendummy is a Go port of sql/generate_users.rb and sql/generate_dummy_log.rb.
+//
+//	gendummy users -count 200000
+//	gendummy log -black-count 5000 -banned-count 500 -logs-count 30000
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "users":
+		generateUsers(os.Args[2:])
+	case "log":
+		generateLog(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: gendummy users|log [options]")
+	os.Exit(2)
+}
+
+type user struct {
+	ID    int
+	Login string
+	Pass  string
+	Salt  string
+	Hash  string
+	Fails int
+}
+
+// calcPassHash is the same salting as webapp/util.go.
+func calcPassHash(password, hash string) string {
+	h := sha256.New()
+	io.WriteString(h, password)
+	io.WriteString(h, ":")
+	io.WriteString(h, hash)
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func generateUsers(args []string) {
+	fs := flag.NewFlagSet("users", flag.ExitOnError)
+	count := fs.Int("count", 20, "number of users")
+	outSQL := fs.String("output-sql", "dummy_users.sql", "output SQL")
+	outTSV := fs.String("output-tsv", "dummy_users.tsv", "output TSV")
+	seed := fs.Int64("seed", time.Now().UnixNano(), "random seed")
+	fs.Parse(args)
+
+	rnd := rand.New(rand.NewSource(*seed))
+
+	sqlFile, sqlw := create(*outSQL)
+	defer sqlFile.Close()
+	tsvFile, tsvw := create(*outTSV)
+	defer tsvFile.Close()
+
+	fmt.Fprintln(sqlw, "INSERT INTO `users` (`id`, `login`, `password_hash`, `salt`) VALUES")
+
+	usernames := make(map[string]bool, *count)
+	for i := 1; i <= *count; i++ {
+		var u user
+		u.ID = i
+		if i < 10 {
+			u.Login = fmt.Sprintf("isucon%d", i)
+			u.Pass = fmt.Sprintf("isuconpass%d", i)
+			u.Salt = fmt.Sprintf("salt%d", i)
+		} else {
+			u.Login = fakeUserName(rnd)
+			for usernames[u.Login] {
+				u.Login = succ(u.Login)
+			}
+			u.Pass = fakePassword(rnd)
+			u.Salt = fakePassword(rnd)
+		}
+		usernames[u.Login] = true
+		u.Hash = calcPassHash(u.Pass, u.Salt)
+
+		if i > 1 {
+			fmt.Fprint(sqlw, ",")
+		}
+		fmt.Fprintf(sqlw, "(%d, '%s', '%s', '%s')\n", u.ID, u.Login, u.Hash, u.Salt)
+		fmt.Fprintf(tsvw, "%d\t%s\t%s\t%s\t%s\n", u.ID, u.Login, u.Pass, u.Salt, u.Hash)
+	}
+
+	flush(sqlw, tsvw)
+}
+
+type loginLog struct {
+	CreatedAt time.Time
+	UserID    int
+	Login     string
+	IP        string
+	Succeeded bool
+	Comment   string
+}
+
+type logGenerator struct {
+	rnd    *rand.Rand
+	nextIP [4]int
+	next   time.Time
+
+	userFails map[int]int
+	ipFails   map[string]int
+	logs      []loginLog
+}
+
+// ip returns a fresh address, walking 127.200.1.1 upwards like get_ip.
+func (g *logGenerator) ip() string {
+	ip := g.nextIP
+
+	g.nextIP[3]++
+	for i := 3; i > 0; i-- {
+		if g.nextIP[i] > 253 {
+			g.nextIP[i-1]++
+			g.nextIP[i] = 1
+		}
+	}
+	if ip[0] > 127 {
+		log.Fatal("ran out of IP addresses")
+	}
+
+	return fmt.Sprintf("%d.%d.%d.%d", ip[0], ip[1], ip[2], ip[3])
+}
+
+func (g *logGenerator) safeIP() string {
+	return fmt.Sprintf("127.250.0.%d", g.rnd.Intn(254)+1)
+}
+
+func (g *logGenerator) attempt(u *user, login, ip string, succeeded bool, comment string) {
+	l := loginLog{
+		CreatedAt: g.next,
+		Login:     login,
+		IP:        ip,
+		Succeeded: succeeded,
+		Comment:   comment,
+	}
+	g.next = g.next.Add(time.Duration(g.rnd.Intn(5)+1) * time.Second)
+
+	if u != nil {
+		l.UserID = u.ID
+		if succeeded {
+			u.Fails = 0
+		} else {
+			u.Fails++
+		}
+		g.userFails[u.ID] = u.Fails
+	}
+	if succeeded {
+		g.ipFails[ip] = 0
+	} else {
+		g.ipFails[ip]++
+	}
+
+	g.logs = append(g.logs, l)
+}
+
+func generateLog(args []string) {
+	fs := flag.NewFlagSet("log", flag.ExitOnError)
+	maxBlackCount := fs.Int("black-count", 5000, "max number of locked users")
+	bannedCount := fs.Int("banned-count", 0, "number of banned IPs")
+	logsCount := fs.Int("logs-count", 30000, "max number of logs")
+	reservedUsers := fs.Int("reserve-users", -1, "users kept out of the log (default: half of users)")
+	usersTSV := fs.String("users-tsv", "dummy_users.tsv", "input users TSV")
+	usedUsersTSV := fs.String("report-used-users-tsv", "dummy_users_used.tsv", "output used users TSV")
+	out := fs.String("output", "dummy_log.sql", "output file")
+	format := fs.String("format", "sql", "output format: sql or tsv")
+	report := fs.String("report", "expected_report.json", "output expected /report JSON")
+	userLockThreshold := fs.Int("user-lock-threshold", 3, "same as ISU4_USER_LOCK_THRESHOLD")
+	ipBanThreshold := fs.Int("ip-ban-threshold", 10, "same as ISU4_IP_BAN_THRESHOLD")
+	seed := fs.Int64("seed", time.Now().UnixNano(), "random seed")
+	fs.Parse(args)
+
+	if *format != "sql" && *format != "tsv" {
+		log.Fatalf("unknown format: %s", *format)
+	}
+
+	users, err := readUsers(*usersTSV)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *reservedUsers < 0 {
+		*reservedUsers = len(users) / 2
+	}
+	if *reservedUsers > len(users) {
+		*reservedUsers = len(users)
+	}
+
+	fmt.Printf("users: %s\n", *usersTSV)
+	fmt.Printf("output %s: %s\n", strings.ToUpper(*format), *out)
+	fmt.Printf("output black users TSV: %s\n", *usedUsersTSV)
+	fmt.Println()
+	fmt.Printf("Reserve %d users, max %d logs, allows generating %d locked users and %d banned IPs\n",
+		*reservedUsers, *logsCount, *maxBlackCount, *bannedCount)
+
+	users = users[*reservedUsers:]
+
+	g := &logGenerator{
+		rnd:       rand.New(rand.NewSource(*seed)),
+		nextIP:    [4]int{127, 200, 1, 1},
+		next:      time.Date(2014, 2, 22, 0, 0, 0, 0, time.Local),
+		userFails: make(map[int]int),
+		ipFails:   make(map[string]int),
+	}
+
+	blackCount := 0
+	used := make([]*user, 0)
+	usedIDs := make(map[int]bool)
+	for i := 0; i < *logsCount && len(users) > 0; i++ {
+		idx := g.rnd.Intn(len(users))
+		u := users[idx]
+
+		succeeded := true
+		if blackCount < *maxBlackCount {
+			succeeded = g.rnd.Intn(10) >= 6
+		}
+
+		ip := g.safeIP()
+		if !succeeded {
+			ip = g.ip()
+		}
+		g.attempt(u, u.Login, ip, succeeded, "")
+
+		if !usedIDs[u.ID] {
+			usedIDs[u.ID] = true
+			used = append(used, u)
+		}
+		if *userLockThreshold <= u.Fails {
+			blackCount++
+			users = append(users[:idx], users[idx+1:]...)
+		}
+	}
+
+	// Banned IPs only try logins that do not exist, so they never lock a user.
+	for i := 0; i < *bannedCount; i++ {
+		ip := g.ip()
+		for j := 0; j < *ipBanThreshold; j++ {
+			g.attempt(nil, fmt.Sprintf("nouser_%d_%d", i, j), ip, false, "banned")
+		}
+	}
+
+	backup(*usedUsersTSV)
+	backup(*out)
+
+	usedFile, usedw := create(*usedUsersTSV)
+	for _, u := range used {
+		fmt.Fprintf(usedw, "%d\t%s\t%d\n", u.ID, u.Login, u.Fails)
+	}
+	flush(usedw)
+	usedFile.Close()
+
+	outFile, outw := create(*out)
+	if *format == "sql" {
+		writeLogSQL(outw, g.logs, *reservedUsers, *logsCount, blackCount, len(used))
+	} else {
+		writeLogTSV(outw, g.logs)
+	}
+	flush(outw)
+	outFile.Close()
+
+	bannedIPs := make([]string, 0)
+	for ip, fails := range g.ipFails {
+		if *ipBanThreshold <= fails {
+			bannedIPs = append(bannedIPs, ip)
+		}
+	}
+	lockedUsers := make([]string, 0)
+	for _, u := range used {
+		if *userLockThreshold <= g.userFails[u.ID] {
+			lockedUsers = append(lockedUsers, u.Login)
+		}
+	}
+	sort.Strings(bannedIPs)
+	sort.Strings(lockedUsers)
+
+	reportFile, reportw := create(*report)
+	enc := json.NewEncoder(reportw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(map[string][]string{
+		"banned_ips":   bannedIPs,
+		"locked_users": lockedUsers,
+	}); err != nil {
+		log.Fatal(err)
+	}
+	flush(reportw)
+	reportFile.Close()
+
+	fmt.Println("===")
+	fmt.Printf("Reserve %d users, max %d logs\n", *reservedUsers, *logsCount)
+	fmt.Printf("Result: %d users is locked, %d IPs is banned, %d users is used, and %d logs consumed\n",
+		len(lockedUsers), len(bannedIPs), len(used), len(g.logs))
+}
+
+func writeLogSQL(w *bufio.Writer, logs []loginLog, reserved, max, black, used int) {
+	fmt.Fprintf(w, "-- Reserve %d users, max %d logs\n", reserved, max)
+	fmt.Fprintf(w, "-- Result: %d users is locked, %d users is used, and %d logs consumed\n", black, used, len(logs))
+
+	for _, l := range logs {
+		status := "FAIL"
+		if l.Succeeded {
+			status = "SUCCESS"
+		}
+		fmt.Fprintf(w, "-- %s\t%d\t%s\t%s\t%s\n", status, l.UserID, l.Login, l.IP, l.Comment)
+	}
+	fmt.Fprintln(w)
+
+	for i := 0; i < len(logs); i += 10000 {
+		end := i + 10000
+		if end > len(logs) {
+			end = len(logs)
+		}
+
+		fmt.Fprint(w, "INSERT INTO `login_log` (`created_at`, `user_id`, `login`, `ip`, `succeeded`) VALUES ")
+		for j, l := range logs[i:end] {
+			if j > 0 {
+				fmt.Fprint(w, ",")
+			}
+			userID := "NULL"
+			if l.UserID != 0 {
+				userID = strconv.Itoa(l.UserID)
+			}
+			fmt.Fprintf(w, "('%s', %s, '%s', '%s', %d)",
+				l.CreatedAt.Format("2006-01-02 15:04:05"), userID, l.Login, l.IP, boolToInt(l.Succeeded))
+		}
+		fmt.Fprintln(w, ";")
+	}
+}
+
+// writeLogTSV writes rows for LOAD DATA INFILE ... (created_at, user_id, login, ip, succeeded).
+func writeLogTSV(w *bufio.Writer, logs []loginLog) {
+	for _, l := range logs {
+		userID := `\N`
+		if l.UserID != 0 {
+			userID = strconv.Itoa(l.UserID)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n",
+			l.CreatedAt.Format("2006-01-02 15:04:05"), userID, l.Login, l.IP, boolToInt(l.Succeeded))
+	}
+}
+
+func readUsers(path string) ([]*user, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make([]*user, 0)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		cols := strings.Split(s.Text(), "\t")
+		if len(cols) < 5 {
+			return nil, fmt.Errorf("%s: malformed line: %q", path, s.Text())
+		}
+		id, err := strconv.Atoi(cols[0])
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, &user{ID: id, Login: cols[1], Pass: cols[2], Salt: cols[3], Hash: cols[4]})
+	}
+
+	return users, s.Err()
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func create(path string) (*os.File, *bufio.Writer) {
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return f, bufio.NewWriter(f)
+}
+
+func flush(ws ...*bufio.Writer) {
+	for _, w := range ws {
+		if err := w.Flush(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func backup(path string) {
+	if _, err := os.Stat(path); err == nil {
+		if err := os.Rename(path, path+".old"); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+var (
+	firstNames = []string{
+		"james", "mary", "john", "patricia", "robert", "jennifer", "michael", "linda", "william", "elizabeth",
+		"david", "barbara", "richard", "susan", "joseph", "jessica", "thomas", "sarah", "charles", "karen",
+		"geovany", "shanna", "marilyn", "augustus", "emmy", "kenji", "yuki", "haruka", "taro", "hanako",
+	}
+	lastNames = []string{
+		"smith", "johnson", "williams", "brown", "jones", "miller", "davis", "garcia", "rodriguez", "wilson",
+		"mueller", "armstrong", "schmidt", "lang", "kuhn", "sato", "suzuki", "takahashi", "tanaka", "watanabe",
+	}
+)
+
+// fakeUserName mimics Faker::Internet.user_name.
+func fakeUserName(rnd *rand.Rand) string {
+	first := firstNames[rnd.Intn(len(firstNames))]
+	last := lastNames[rnd.Intn(len(lastNames))]
+
+	switch rnd.Intn(3) {
+	case 0:
+		return first
+	case 1:
+		return first + []string{".", "_"}[rnd.Intn(2)] + last
+	default:
+		return first + strconv.Itoa(rnd.Intn(100))
+	}
+}
+
+const passwordChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// fakePassword mimics Faker::Internet.password.
+func fakePassword(rnd *rand.Rand) string {
+	b := make([]byte, 8+rnd.Intn(9))
+	for i := range b {
+		b[i] = passwordChars[rnd.Intn(len(passwordChars))]
+	}
+	return string(b)
+}
+
+// succ mimics Ruby's String#succ: the rightmost alphanumeric is incremented
+// and carries into the alphanumerics to its left.
+func succ(s string) string {
+	b := []byte(s)
+	last := -1
+	for i := len(b) - 1; i >= 0; i-- {
+		c := b[i]
+		if !isAlnum(c) {
+			continue
+		}
+		last = i
+
+		switch c {
+		case 'z':
+			b[i] = 'a'
+		case 'Z':
+			b[i] = 'A'
+		case '9':
+			b[i] = '0'
+		default:
+			b[i]++
+			return string(b)
+		}
+	}
+	if last < 0 {
+		return s + "a"
+	}
+
+	carry := b[last]
+	if carry == '0' {
+		carry = '1'
+	}
+	return string(b[:last]) + string(carry) + string(b[last:])
+}
+
+func isAlnum(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
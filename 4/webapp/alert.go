@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+)
+
+type LoginAttempt struct {
+	IP        string
+	CreatedAt time.Time
+}
+
+// LoginAlert describes suspicious activity around the latest successful login.
+type LoginAlert struct {
+	Login    string
+	Failures []LoginAttempt
+	NewIP    *LoginAttempt
+	// First is set on the first successful login, when Failures are all the
+	// failed attempts ever made.
+	First bool
+}
+
+// getLoginAlert looks at the login_log between the latest successful login and
+// the one before it, or since the start of the log on the first successful
+// login. It returns nil when there is nothing to warn about.
+func getLoginAlert(userID interface{}) *LoginAlert {
+	// One query reads from the successful login before the latest one on,
+	// each successful login telling whether its address had logged in before.
+	rows, err := db.Query(`
+SELECT l.login, l.ip, l.succeeded, l.created_at,
+	l.succeeded = 1 AND EXISTS (
+		SELECT 1 FROM login_log p WHERE p.user_id = l.user_id AND p.ip = l.ip AND p.succeeded = 1 AND p.id < l.id
+	)
+FROM login_log l
+WHERE l.user_id = ? AND l.id >= IFNULL(
+	(SELECT id FROM login_log WHERE user_id = ? AND succeeded = 1 ORDER BY id DESC LIMIT 1, 1), 0
+)
+ORDER BY l.id`,
+		userID, userID,
+	)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var alert *LoginAlert
+	var current LoginAttempt
+	var seen bool
+	successes := 0
+	// failures are those since the last successful login read so far; the
+	// ones after the latest are left for the next login to report.
+	var failures []LoginAttempt
+	for rows.Next() {
+		var login string
+		var attempt LoginAttempt
+		var succeeded, seenBefore bool
+		if err := rows.Scan(&login, &attempt.IP, &succeeded, &attempt.CreatedAt, &seenBefore); err != nil {
+			return nil
+		}
+		if !succeeded {
+			failures = append(failures, attempt)
+			continue
+		}
+		successes++
+		alert = &LoginAlert{Login: login, Failures: failures}
+		current, seen = attempt, seenBefore
+		failures = nil
+	}
+	if err := rows.Err(); err != nil {
+		return nil
+	}
+
+	if alert == nil {
+		return nil
+	}
+	alert.First = successes == 1
+	// on the first login every address is new
+	if !seen && !alert.First {
+		alert.NewIP = &current
+	}
+
+	if len(alert.Failures) == 0 && alert.NewIP == nil {
+		return nil
+	}
+	return alert
+}
+
+// since says where Failures start counting from.
+func (a *LoginAlert) since() string {
+	if a.First {
+		return "今回のログインまで"
+	}
+	return "前回のログイン以降"
+}
+
+// notifyLoginAlert queues a mail when the login that just succeeded looks suspicious.
+func notifyLoginAlert(user *User) {
+	alert := getLoginAlert(user.ID)
+	if alert == nil {
+		return
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "%s 様\n\nお客様のアカウントで以下の不審なログインを検知しました。\n\n", alert.Login)
+	if alert.NewIP != nil {
+		fmt.Fprintf(&body, "これまでにないIPアドレスからのログイン:\n  %s  %s\n\n",
+			alert.NewIP.CreatedAt.Format("2006-01-02 15:04:05"), alert.NewIP.IP)
+	}
+	if len(alert.Failures) > 0 {
+		fmt.Fprintf(&body, "%sに失敗したログイン (%d件):\n", alert.since(), len(alert.Failures))
+		for _, f := range alert.Failures {
+			fmt.Fprintf(&body, "  %s  %s\n", f.CreatedAt.Format("2006-01-02 15:04:05"), f.IP)
+		}
+		fmt.Fprintln(&body)
+	}
+	fmt.Fprintln(&body, "お心当たりのない場合は、至急パスワードを変更してください。")
+
+	sendMail(&Mail{
+		To:      alert.Login + "@" + mailDomain,
+		Subject: "【いすこん銀行】不審なログインを検知しました",
+		Body:    body.String(),
+		Date:    time.Now(),
+	})
+}
+
+func sendMail(m *Mail) {
+	select {
+	case mailQueue <- m:
+	default:
+		log.Printf("mail queue is full, dropped mail to %s", m.To)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+	Date    time.Time
+}
+
+type Mailer interface {
+	Send(m *Mail) error
+}
+
+// MaildirMailer delivers mails into a local maildir, for testing without an MTA.
+type MaildirMailer struct {
+	Dir string
+	seq uint64
+}
+
+func NewMaildirMailer(dir string) (*MaildirMailer, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	return &MaildirMailer{Dir: dir}, nil
+}
+
+func (m *MaildirMailer) Send(mail *Mail) error {
+	host, _ := os.Hostname()
+	name := fmt.Sprintf("%d.%d_%d.%s", mail.Date.Unix(), os.Getpid(), atomic.AddUint64(&m.seq, 1), host)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Date: %s\r\n", mail.Date.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "From: %s\r\n", mailFrom)
+	fmt.Fprintf(&buf, "To: %s\r\n", mail.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", mail.Subject))
+	fmt.Fprint(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprint(&buf, "Content-Type: text/plain; charset=UTF-8\r\n")
+	fmt.Fprint(&buf, "Content-Transfer-Encoding: 8bit\r\n\r\n")
+	buf.WriteString(mail.Body)
+
+	tmp := filepath.Join(m.Dir, "tmp", name)
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(m.Dir, "new", name))
+}
+
+func deliverMails(mailer Mailer) {
+	for m := range mailQueue {
+		if err := mailer.Send(m); err != nil {
+			log.Printf("failed to send mail to %s: %v", m.To, err)
+		}
+	}
+}
@@ -21,6 +21,7 @@ var (
 	db        *sql.DB
 	redisPool *redis.Pool
 	loginMap  *MultiMapLastLogin
+	mailQueue chan *Mail
 )
 
 var (
@@ -30,6 +31,8 @@ var (
 var (
 	userLockThreshold int
 	iPBanThreshold    int
+	mailFrom          string
+	mailDomain        string
 )
 
 func init() {
@@ -60,6 +63,15 @@ func init() {
 
 	redisPool = unixRedisPool()
 	loginMap = NewLoginMap(256)
+
+	mailFrom = getEnv("ISU4_MAIL_FROM", "noreply@isucon-bank.example.com")
+	mailDomain = getEnv("ISU4_MAIL_DOMAIN", "example.com")
+	mailer, err := NewMaildirMailer(getEnv("ISU4_MAILDIR", "/tmp/isu4_maildir"))
+	if err != nil {
+		panic(err)
+	}
+	mailQueue = make(chan *Mail, 1024)
+	go deliverMails(mailer)
 }
 
 func main() {
@@ -88,6 +100,7 @@ func main() {
 
 		session.Values["user_id"] = strconv.Itoa(user.ID)
 		session.Save(r, w)
+		go notifyLoginAlert(user)
 		http.Redirect(w, r, "/mypage", 302)
 	})
 
@@ -101,7 +114,10 @@ func main() {
 			return
 		}
 
-		templates.ExecuteTemplate(w, "mypage.tmpl", getLastLogin(userID))
+		templates.ExecuteTemplate(w, "mypage.tmpl", struct {
+			*LastLogin
+			Alert *LoginAlert
+		}{getLastLogin(userID), getLoginAlert(userID)})
 	})
 
 	http.HandleFunc("/report", func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The JSON API under /api/v1 serves the same data as the HTML pages through
+// the same load and create functions, so the permission checks, footprints
+// and notifications are shared. Clients log in for a token and send it as
+// "Authorization: Bearer <token>"; no cookie session is used.
+
+type apiHandlerFunc func(w http.ResponseWriter, r *http.Request, user *User) error
+
+// apiHandler is myHandler for the API: errors are written as
+// {"error": {"status": ..., "message": ...}}.
+func apiHandler(fn handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := runSafe(func() error { return fn(w, r) }); err != nil {
+			handleAPIError(w, r, err)
+		}
+	}
+}
+
+// withToken passes the user of the bearer token to fn.
+func withToken(fn apiHandlerFunc) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, err := tokenUser(r)
+		if err != nil {
+			return err
+		}
+		return fn(w, r, user)
+	}
+}
+
+type apiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+func handleAPIError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	message := http.StatusText(status)
+	if httpErr, ok := err.(*HTTPError); ok {
+		status, message = httpErr.Status, httpErr.Message
+	}
+	logError(r, status, err)
+
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="isuxi"`)
+	}
+	writeJSON(w, status, struct {
+		Error apiError `json:"error"`
+	}{apiError{status, message}})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+func readJSON(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return ErrInvalidParameter
+	}
+	return nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func bearerToken(r *http.Request) (string, error) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return "", ErrInvalidToken
+	}
+	return strings.TrimPrefix(h, "Bearer "), nil
+}
+
+func tokenUser(r *http.Request) (*User, error) {
+	token, err := bearerToken(r)
+	if err != nil {
+		return nil, err
+	}
+	userID, err := repo.Tokens.Find(hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	user, err := getUser(userID)
+	if err == ErrContentNotFound {
+		return nil, ErrInvalidToken
+	}
+	return user, err
+}
+
+type apiUser struct {
+	ID          int    `json:"id,omitempty"`
+	AccountName string `json:"account_name"`
+	NickName    string `json:"nick_name"`
+}
+
+func toAPIUser(u *User) apiUser {
+	return apiUser{u.ID, u.AccountName, u.NickName}
+}
+
+type apiProfile struct {
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name"`
+	Sex       string    `json:"sex"`
+	Birthday  *string   `json:"birthday"`
+	Pref      string    `json:"pref"`
+	Email     string    `json:"email,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Hidden lists the fields the viewer may not see, which are left empty.
+	Hidden []string `json:"hidden"`
+}
+
+// toAPIProfile takes the profile and email redacted by shown.
+func toAPIProfile(p Profile, email string, shown ProfileFields) apiProfile {
+	var birthday *string
+	if p.Birthday.Valid {
+		s := p.Birthday.Time.Format("2006-01-02")
+		birthday = &s
+	}
+	return apiProfile{p.FirstName, p.LastName, p.Sex, birthday, p.Pref, email, p.UpdatedAt, shown.hidden()}
+}
+
+type apiVisibility struct {
+	FirstName Visibility `json:"first_name"`
+	LastName  Visibility `json:"last_name"`
+	Sex       Visibility `json:"sex"`
+	Birthday  Visibility `json:"birthday"`
+	Pref      Visibility `json:"pref"`
+	Email     Visibility `json:"email"`
+}
+
+func toAPIVisibility(v *ProfileVisibility) *apiVisibility {
+	if v == nil {
+		return nil
+	}
+	a := apiVisibility(*v)
+	return &a
+}
+
+// apiEntry keeps private, true unless everyone may read the entry, for
+// clients that predate visibility.
+type apiEntry struct {
+	ID           int        `json:"id"`
+	User         *apiUser   `json:"user,omitempty"`
+	Private      bool       `json:"private"`
+	Visibility   Visibility `json:"visibility"`
+	ListID       int        `json:"list_id,omitempty"`
+	Title        string     `json:"title"`
+	Content      string     `json:"content,omitempty"`
+	CommentCount *int       `json:"comment_count,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+func toAPIEntry(e *Entry, u *apiUser) apiEntry {
+	return apiEntry{ID: e.ID, User: u, Private: e.Private(), Visibility: e.Visibility, ListID: e.ListID,
+		Title: e.Title, Content: e.Content, CreatedAt: e.CreatedAt}
+}
+
+func toAPIEntries(entries []Entry) []apiEntry {
+	l := make([]apiEntry, 0, len(entries))
+	for _, e := range entries {
+		l = append(l, toAPIEntry(&e, nil))
+	}
+	return l
+}
+
+type apiComment struct {
+	ID        int       `json:"id,omitempty"`
+	EntryID   int       `json:"entry_id,omitempty"`
+	ParentID  int       `json:"parent_id,omitempty"`
+	Depth     int       `json:"depth,omitempty"`
+	Deleted   bool      `json:"deleted,omitempty"`
+	User      apiUser   `json:"user"`
+	EntryUser *apiUser  `json:"entry_user,omitempty"`
+	Comment   string    `json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type apiFriend struct {
+	User      apiUser   `json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type apiFootprint struct {
+	User    apiUser   `json:"user"`
+	Date    string    `json:"date"`
+	Updated time.Time `json:"updated"`
+}
+
+func toAPIFootprints(footprints []FFootprint) []apiFootprint {
+	l := make([]apiFootprint, 0, len(footprints))
+	for _, f := range footprints {
+		l = append(l, apiFootprint{apiUser{AccountName: f.AccountName, NickName: f.NickName}, f.Date.Format("2006-01-02"), f.Updated})
+	}
+	return l
+}
+
+// apiPage holds the query strings of the neighbouring pages, as the pager
+// on the HTML pages links to them.
+type apiPage struct {
+	Prev string `json:"prev,omitempty"`
+	Next string `json:"next,omitempty"`
+}
+
+func APILogin(w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	user, err := checkPassword(req.Email, req.Password)
+	if err != nil {
+		return err
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+	if err := repo.Tokens.Create(hashToken(token), user.ID); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, struct {
+		Token string  `json:"token"`
+		User  apiUser `json:"user"`
+	}{token, toAPIUser(user)})
+}
+
+func APILogout(w http.ResponseWriter, r *http.Request, user *User) error {
+	token, err := bearerToken(r)
+	if err != nil {
+		return err
+	}
+	if err := repo.Tokens.Delete(hashToken(token)); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func APIGetIndex(w http.ResponseWriter, r *http.Request, user *User) error {
+	idx, err := loadIndex(user)
+	if err != nil {
+		return err
+	}
+
+	commentsForMe := make([]apiComment, 0, len(idx.CommentsForMe))
+	for _, c := range idx.CommentsForMe {
+		commentsForMe = append(commentsForMe, apiComment{
+			User: apiUser{AccountName: c.AccountName, NickName: c.NickName}, Comment: c.Comment, CreatedAt: c.CreatedAt,
+		})
+	}
+	entriesOfFriends := make([]apiEntry, 0, len(idx.EntriesOfFriends))
+	for _, e := range idx.EntriesOfFriends {
+		entriesOfFriends = append(entriesOfFriends, apiEntry{
+			ID: e.ID, User: &apiUser{AccountName: e.AccountName, NickName: e.NickName}, Title: e.Title, CreatedAt: e.CreatedAt,
+		})
+	}
+	commentsOfFriends := make([]apiComment, 0, len(idx.CommentsOfFriends))
+	for _, c := range idx.CommentsOfFriends {
+		commentsOfFriends = append(commentsOfFriends, apiComment{
+			ID:        c.ID,
+			EntryID:   c.EntryID,
+			User:      apiUser{c.UserID, c.AccountName, c.NickName},
+			EntryUser: &apiUser{c.EntryUserID, c.EntryAccountName, c.EntryNickName},
+			Comment:   c.Comment,
+			CreatedAt: c.CreatedAt,
+		})
+	}
+
+	return writeJSON(w, http.StatusOK, struct {
+		User              apiUser        `json:"user"`
+		Profile           apiProfile     `json:"profile"`
+		Entries           []apiEntry     `json:"entries"`
+		CommentsForMe     []apiComment   `json:"comments_for_me"`
+		EntriesOfFriends  []apiEntry     `json:"entries_of_friends"`
+		CommentsOfFriends []apiComment   `json:"comments_of_friends"`
+		Friends           int            `json:"friends"`
+		Footprints        []apiFootprint `json:"footprints"`
+	}{
+		toAPIUser(user), toAPIProfile(idx.Profile, idx.User.Email, idx.Shown), toAPIEntries(idx.Entries), commentsForMe,
+		entriesOfFriends, commentsOfFriends, idx.Friends, toAPIFootprints(idx.Footprints),
+	})
+}
+
+func APIGetProfile(w http.ResponseWriter, r *http.Request, user *User) error {
+	page, err := loadProfile(user, mux.Vars(r)["account_name"], r.FormValue("view_as"))
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, struct {
+		User        apiUser        `json:"user"`
+		Profile     apiProfile     `json:"profile"`
+		Entries     []apiEntry     `json:"entries"`
+		Private     bool           `json:"private"`
+		Requested   bool           `json:"requested"`
+		RequestedBy bool           `json:"requested_by"`
+		Visibility  *apiVisibility `json:"visibility,omitempty"`
+	}{
+		toAPIUser(&page.Owner), toAPIProfile(page.Profile, page.Owner.Email, page.Shown), toAPIEntries(page.Entries),
+		page.Friend, page.Requested, page.RequestedBy, toAPIVisibility(page.Visibility),
+	})
+}
+
+func APIPutProfile(w http.ResponseWriter, r *http.Request, user *User) error {
+	var req struct {
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+		Sex       string `json:"sex"`
+		Birthday  string `json:"birthday"`
+		Pref      string `json:"pref"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	if err := updateProfile(user, mux.Vars(r)["account_name"], req.FirstName, req.LastName, req.Sex, req.Birthday, req.Pref); err != nil {
+		return err
+	}
+	prof, err := repo.Profiles.Get(user.ID)
+	if err != nil {
+		return err
+	}
+	// Owners see every field, whatever the settings.
+	return writeJSON(w, http.StatusOK, struct {
+		Profile apiProfile `json:"profile"`
+	}{toAPIProfile(prof, user.Email, defaultProfileVisibility.shownTo(viewerSelf))})
+}
+
+func APIPutProfileVisibility(w http.ResponseWriter, r *http.Request, user *User) error {
+	var req apiVisibility
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	v := ProfileVisibility(req)
+	if err := updateVisibility(user, mux.Vars(r)["account_name"], v); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, struct {
+		Visibility *apiVisibility `json:"visibility"`
+	}{toAPIVisibility(&v)})
+}
+
+func APIListEntries(w http.ResponseWriter, r *http.Request, user *User) error {
+	q, err := parsePageQuery(r, 20)
+	if err != nil {
+		return err
+	}
+	owner, entries, err := listEntries(user, mux.Vars(r)["account_name"], q)
+	if err != nil {
+		return err
+	}
+
+	from, to, page := paginate(q, len(entries), func(i int) Cursor { return Cursor{entries[i].CreatedAt, entries[i].ID} })
+	l := make([]apiEntry, 0, to-from)
+	for _, e := range entries[from:to] {
+		count := e.Count
+		l = append(l, apiEntry{ID: e.ID, Private: e.Private(), Visibility: e.Visibility, ListID: e.ListID,
+			Title: e.Title, Content: e.Content, CommentCount: &count, CreatedAt: e.CreatedAt})
+	}
+	return writeJSON(w, http.StatusOK, struct {
+		User    apiUser    `json:"user"`
+		Entries []apiEntry `json:"entries"`
+		Page    apiPage    `json:"page"`
+	}{toAPIUser(owner), l, apiPage(page)})
+}
+
+func APIPostEntry(w http.ResponseWriter, r *http.Request, user *User) error {
+	var req struct {
+		Title      string `json:"title"`
+		Content    string `json:"content"`
+		Visibility string `json:"visibility"`
+		ListID     int    `json:"list_id"`
+		Private    bool   `json:"private"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	audience, err := entryAudience(user, req.Visibility, req.ListID, req.Private)
+	if err != nil {
+		return err
+	}
+	id, err := createEntry(user, audience, req.Title, req.Content, nil)
+	if err != nil {
+		return err
+	}
+	entry, err := repo.Entries.Get(id)
+	if err != nil {
+		return err
+	}
+	u := toAPIUser(user)
+	return writeJSON(w, http.StatusCreated, struct {
+		Entry apiEntry `json:"entry"`
+	}{toAPIEntry(entry, &u)})
+}
+
+func APIGetEntry(w http.ResponseWriter, r *http.Request, user *User) error {
+	q, err := parsePageQuery(r, 50)
+	if err != nil {
+		return err
+	}
+	entry, owner, comments, page, err := loadEntry(r, user, q)
+	if err != nil {
+		return err
+	}
+
+	l := make([]apiComment, 0, len(comments))
+	for _, c := range comments {
+		l = append(l, apiComment{
+			ID: c.ID, ParentID: c.ParentID, Depth: c.Depth, Deleted: c.Deleted,
+			User: apiUser{AccountName: c.AccountName, NickName: c.NickName}, Comment: c.Comment, CreatedAt: c.CreatedAt,
+		})
+	}
+	u := toAPIUser(owner)
+	return writeJSON(w, http.StatusOK, struct {
+		Entry    apiEntry     `json:"entry"`
+		Comments []apiComment `json:"comments"`
+		Page     apiPage      `json:"page"`
+	}{toAPIEntry(entry, &u), l, apiPage(page)})
+}
+
+func APIPostComment(w http.ResponseWriter, r *http.Request, user *User) error {
+	var req struct {
+		ParentID int    `json:"parent_id"`
+		Comment  string `json:"comment"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	if req.ParentID < 0 {
+		return ErrInvalidParameter
+	}
+	entry, err := entryFromPath(r, user)
+	if err != nil {
+		return err
+	}
+	id, err := createComment(user, entry, req.ParentID, req.Comment)
+	if err != nil {
+		return err
+	}
+	comment, err := repo.Comments.Get(id)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusCreated, struct {
+		Comment apiComment `json:"comment"`
+	}{apiComment{ID: comment.ID, EntryID: comment.EntryID, ParentID: comment.ParentID, Depth: comment.Depth, User: toAPIUser(user), Comment: comment.Comment, CreatedAt: comment.CreatedAt}})
+}
+
+func APIGetFootprints(w http.ResponseWriter, r *http.Request, user *User) error {
+	q, err := parsePageQuery(r, 50)
+	if err != nil {
+		return err
+	}
+	footprints, err := repo.Footprints.ListDaily(user.ID, q)
+	if err != nil {
+		return err
+	}
+	from, to, page := paginate(q, len(footprints), func(i int) Cursor { return Cursor{footprints[i].Updated, footprints[i].ID} })
+	return writeJSON(w, http.StatusOK, struct {
+		Footprints []apiFootprint `json:"footprints"`
+		Page       apiPage        `json:"page"`
+	}{toAPIFootprints(footprints[from:to]), apiPage(page)})
+}
+
+func APIGetFriends(w http.ResponseWriter, r *http.Request, user *User) error {
+	q, err := parsePageQuery(r, 50)
+	if err != nil {
+		return err
+	}
+	friends, err := repo.Relations.ListFriends(user.ID, q)
+	if err != nil {
+		return err
+	}
+	from, to, page := paginate(q, len(friends), func(i int) Cursor { return Cursor{friends[i].CreatedAt, friends[i].ID} })
+	l := make([]apiFriend, 0, to-from)
+	for _, f := range friends[from:to] {
+		l = append(l, apiFriend{apiUser{AccountName: f.AccountName, NickName: f.NickName}, f.CreatedAt})
+	}
+	return writeJSON(w, http.StatusOK, struct {
+		Friends []apiFriend `json:"friends"`
+		Page    apiPage     `json:"page"`
+	}{l, apiPage(page)})
+}
+
+// apiRoutes mirrors the HTML routes under /api/v1.
+func apiRoutes(a *mux.Router) {
+	a.HandleFunc("/login", apiHandler(APILogin)).Methods("POST")
+	a.HandleFunc("/logout", apiHandler(withToken(APILogout))).Methods("POST")
+	a.HandleFunc("/index", apiHandler(withToken(APIGetIndex))).Methods("GET")
+
+	a.HandleFunc("/profile/{account_name}", apiHandler(withToken(APIGetProfile))).Methods("GET")
+	a.HandleFunc("/profile/{account_name}", apiHandler(withToken(APIPutProfile))).Methods("PUT")
+	a.HandleFunc("/profile/{account_name}/visibility", apiHandler(withToken(APIPutProfileVisibility))).Methods("PUT")
+
+	a.HandleFunc("/diary/entries/{account_name}", apiHandler(withToken(APIListEntries))).Methods("GET")
+	a.HandleFunc("/diary/entry", apiHandler(withToken(APIPostEntry))).Methods("POST")
+	a.HandleFunc("/diary/entry/{entry_id}", apiHandler(withToken(APIGetEntry))).Methods("GET")
+	a.HandleFunc("/diary/comment/{entry_id}", apiHandler(withToken(APIPostComment))).Methods("POST")
+
+	a.HandleFunc("/footprints", apiHandler(withToken(APIGetFootprints))).Methods("GET")
+	a.HandleFunc("/friends", apiHandler(withToken(APIGetFriends))).Methods("GET")
+
+	// Keep unknown API paths away from the static file server.
+	a.PathPrefix("/").Handler(apiHandler(func(w http.ResponseWriter, r *http.Request) error { return ErrContentNotFound }))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// apiCall sends the JSON body, with the token as bearer when it is set, and
+// decodes the JSON answer.
+func apiCall(t *testing.T, srv *httptest.Server, method, path, token, body string) (int, map[string]interface{}) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, srv.URL+"/api/v1"+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if _, ok := res.Header["Set-Cookie"]; ok {
+		t.Fatalf("%s %s sets a cookie", method, path)
+	}
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := map[string]interface{}{}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &v); err != nil {
+			t.Fatalf("%s %s: %v in %s", method, path, err, b)
+		}
+	}
+	return res.StatusCode, v
+}
+
+func apiToken(t *testing.T, srv *httptest.Server, account string) string {
+	t.Helper()
+
+	code, v := apiCall(t, srv, "POST", "/login", "", `{"email":"`+account+`@example.com","password":"`+account+`"}`)
+	wantStatus(t, "API login as "+account, code, http.StatusOK)
+	return v["token"].(string)
+}
+
+func TestAPI(t *testing.T) {
+	srv := newTestServer(t)
+
+	code, v := apiCall(t, srv, "POST", "/login", "", `{"email":"alice@example.com","password":"wrong"}`)
+	wantStatus(t, "wrong password", code, http.StatusUnauthorized)
+	if e, ok := v["error"].(map[string]interface{}); !ok || e["status"] != float64(http.StatusUnauthorized) {
+		t.Fatalf("error body %v", v)
+	}
+	code, _ = apiCall(t, srv, "GET", "/index", "", "")
+	wantStatus(t, "no token", code, http.StatusUnauthorized)
+
+	alice, bob := apiToken(t, srv, "alice"), apiToken(t, srv, "bob")
+	code, _ = apiCall(t, srv, "POST", "/diary/entry", alice, `{"title":"secret","content":"c","visibility":"friends"}`)
+	wantStatus(t, "post entry", code, http.StatusCreated)
+	code, _ = apiCall(t, srv, "GET", "/diary/entry/1", bob, "")
+	wantStatus(t, "entry for friends", code, http.StatusForbidden)
+	code, _ = apiCall(t, srv, "POST", "/diary/comment/1", bob, `{"comment":"x"}`)
+	wantStatus(t, "comment on an entry for friends", code, http.StatusForbidden)
+	code, v = apiCall(t, srv, "GET", "/diary/entries/alice", bob, "")
+	if code != http.StatusOK || len(v["entries"].([]interface{})) != 0 {
+		t.Fatalf("entries of alice for bob: %d %v", code, v)
+	}
+
+	code, _ = apiCall(t, srv, "PUT", "/profile/alice", bob, `{"first_name":"x"}`)
+	wantStatus(t, "edit the profile of others", code, http.StatusForbidden)
+	code, v = apiCall(t, srv, "PUT", "/profile/alice", alice, `{"first_name":"Alice","birthday":"2000-01-02"}`)
+	if code != http.StatusOK || v["profile"].(map[string]interface{})["first_name"] != "Alice" {
+		t.Fatalf("edit profile: %d %v", code, v)
+	}
+
+	befriend(loggedIn(t, srv, "alice"), loggedIn(t, srv, "bob"), "alice", "bob")
+	code, _ = apiCall(t, srv, "POST", "/diary/comment/1", bob, `{"comment":"hi"}`)
+	wantStatus(t, "comment", code, http.StatusCreated)
+	code, v = apiCall(t, srv, "GET", "/diary/entry/1", bob, "")
+	if code != http.StatusOK || len(v["comments"].([]interface{})) != 1 {
+		t.Fatalf("entry: %d %v", code, v)
+	}
+	if err := footprintRecorder.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	code, v = apiCall(t, srv, "GET", "/index", alice, "")
+	if code != http.StatusOK || v["friends"] != float64(1) || len(v["comments_for_me"].([]interface{})) != 1 {
+		t.Fatalf("index: %d %v", code, v)
+	}
+	for _, path := range []string{"/friends", "/footprints"} {
+		code, v := apiCall(t, srv, "GET", path, alice, "")
+		key := strings.TrimPrefix(path, "/")
+		if code != http.StatusOK || len(v[key].([]interface{})) != 1 {
+			t.Fatalf("%s: %d %v", path, code, v)
+		}
+	}
+
+	code, v = apiCall(t, srv, "GET", "/nope", alice, "")
+	if code != http.StatusNotFound || v["error"] == nil {
+		t.Fatalf("unknown path: %d %v", code, v)
+	}
+	code, _ = apiCall(t, srv, "POST", "/logout", alice, "")
+	wantStatus(t, "logout", code, http.StatusNoContent)
+	code, _ = apiCall(t, srv, "GET", "/index", alice, "")
+	wantStatus(t, "after logout", code, http.StatusUnauthorized)
+}
@@ -1,20 +1,25 @@
 package main
 
 import (
+	"crypto/rand"
 	"crypto/sha512"
 	"database/sql"
-	"errors"
+	"encoding/hex"
+	"expvar"
+	"flag"
 	"fmt"
 	"html/template"
 	"log"
+	"math/big"
 	"net/http"
 	"os"
 	"path"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/go-sql-driver/mysql"
@@ -59,18 +64,25 @@ type Profile struct {
 }
 
 type Entry struct {
-	ID        int
-	UserID    int
-	Private   bool
+	ID     int
+	UserID int
+	Audience
 	Title     string
 	Content   string
 	CreatedAt time.Time
+	// UpdatedAt is CreatedAt until the entry is edited.
+	UpdatedAt time.Time
 }
 
+// Comment is a comment on an entry, or a reply to one. ThreadID is the
+// top-level comment a reply is under, and 0 for top-level comments.
 type Comment struct {
 	ID        int
 	EntryID   int
 	UserID    int
+	ParentID  int
+	ThreadID  int
+	Depth     int
 	Comment   string
 	CreatedAt time.Time
 }
@@ -92,43 +104,76 @@ var prefs = []string{"未入力",
 	"石川県", "福井県", "山梨県", "長野県", "岐阜県", "静岡県", "愛知県", "三重県", "滋賀県", "京都府", "大阪府", "兵庫県", "奈良県", "和歌山県", "鳥取県", "島根県",
 	"岡山県", "広島県", "山口県", "徳島県", "香川県", "愛媛県", "高知県", "福岡県", "佐賀県", "長崎県", "熊本県", "大分県", "宮崎県", "鹿児島県", "沖縄県"}
 
-var (
-	ErrAuthentication   = errors.New("Authentication error.")
-	ErrPermissionDenied = errors.New("Permission denied.")
-	ErrContentNotFound  = errors.New("Content not found.")
-)
+func authenticate(w http.ResponseWriter, r *http.Request, email, passwd string) error {
+	user, err := checkPassword(email, passwd)
+	if err != nil {
+		return err
+	}
+	return login(w, r, user)
+}
 
-func authenticate(w http.ResponseWriter, r *http.Request, email, passwd string) {
-	user, ok := fromEmail(email)
-	if !ok {
-		checkErr(ErrAuthentication)
+// checkPassword returns the user with the email, or ErrAuthentication when
+// the email or the password is wrong.
+func checkPassword(email, passwd string) (*User, error) {
+	user, err := userCache.FromEmail(email)
+	if err == ErrContentNotFound {
+		return nil, ErrAuthentication
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	s := sha512.New()
-	s.Write([]byte(passwd + user.Salt))
-	sha := fmt.Sprintf("%x", s.Sum(nil))
-	if user.PasswordHash != sha {
-		checkErr(ErrAuthentication)
+	if user.PasswordHash != calcPassHash(passwd, user.Salt) {
+		return nil, ErrAuthentication
 	}
+	return user, nil
+}
 
+func login(w http.ResponseWriter, r *http.Request, user *User) error {
 	session := getSession(w, r)
 	session.Values["user_id"] = user.ID
-	session.Save(r, w)
+	return session.Save(r, w)
+}
+
+// calcPassHash is the same as SHA2(CONCAT(password, salt), 512) in create_user.sql.
+func calcPassHash(passwd, salt string) string {
+	s := sha512.New()
+	s.Write([]byte(passwd + salt))
+	return fmt.Sprintf("%x", s.Sum(nil))
+}
+
+// newSalt returns a random salt that fits in users.salt, varchar(6).
+func newSalt() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return n.String(), nil
+}
+
+// newToken returns a random secret for URLs and API tokens.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
 func getCurrentUser(w http.ResponseWriter, r *http.Request) *User {
-	u := context.Get(r, "user")
-	if u != nil {
-		user := u.(User)
-		return &user
+	if u, ok := context.Get(r, "user").(*User); ok {
+		return u
 	}
 	session := getSession(w, r)
-	userID, ok := session.Values["user_id"]
-	if !ok || userID == nil {
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
 		return nil
 	}
 
-	user, _ := fromID(userID.(int))
+	user, err := userCache.FromID(userID)
+	if err != nil {
+		return nil
+	}
 
 	context.Set(r, "user", user)
 	return user
@@ -143,80 +188,97 @@ func authenticated(w http.ResponseWriter, r *http.Request) *User {
 	return user
 }
 
-func getUser(w http.ResponseWriter, userID int) *User {
-	user, _ := fromID(userID)
-	return user
+func getUser(userID int) (*User, error) {
+	return userCache.FromID(userID)
 }
 
-func getUserFromAccount(w http.ResponseWriter, name string) *User {
-	user, _ := fromAccount(name)
-	return user
+func getUserFromAccount(name string) (*User, error) {
+	return userCache.FromAccount(name)
 }
 
-func isFriend(w http.ResponseWriter, r *http.Request, anotherID int) bool {
-	session := getSession(w, r)
-	id := session.Values["user_id"]
-	row := db.QueryRow(`SELECT COUNT(1) AS cnt FROM relations WHERE (one = ? AND another = ?)`, id, anotherID)
-	cnt := new(int)
-	err := row.Scan(cnt)
-	checkErr(err)
-	return *cnt > 0
+func isFriend(userID, anotherID int) (bool, error) {
+	return friendGraph.IsFriend(userID, anotherID), nil
 }
 
-func isFriendAccount(w http.ResponseWriter, r *http.Request, name string) (*User, bool) {
-	user := getUserFromAccount(w, name)
-	if user == nil {
-		return nil, false
+func makeFriends(one, another int) error {
+	if err := friendGraph.Create(one, another); err != nil {
+		return err
 	}
-	return user, isFriend(w, r, user.ID)
+	if err := repo.Timelines.Connect(one, another); err != nil {
+		return err
+	}
+	return repo.Feeds.Connect(one, another)
+}
+
+func endFriendship(one, another int) error {
+	if err := friendGraph.Delete(one, another); err != nil {
+		return err
+	}
+	if err := repo.Timelines.Disconnect(one, another); err != nil {
+		return err
+	}
+	return repo.Feeds.Disconnect(one, another)
+}
+
+// checkBlocked returns ErrBlocked when either user has blocked the other.
+func checkBlocked(userID, anotherID int) error {
+	if userID == anotherID {
+		return nil
+	}
+	blocked, err := repo.Blocks.Between(userID, anotherID)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return ErrBlocked
+	}
+	return nil
+}
+
+// entryFromPath loads the entry named by entry_id in the path, and makes
+// sure user may read it.
+func entryFromPath(r *http.Request, user *User) (*Entry, error) {
+	entryID, err := strconv.Atoi(mux.Vars(r)["entry_id"])
+	if err != nil {
+		return nil, ErrContentNotFound
+	}
+	return readableEntry(user, entryID)
 }
 
-func permitted(w http.ResponseWriter, r *http.Request, userID int, anotherID int) bool {
-	if anotherID == userID {
-		return true
+// readableEntry loads the entry, and makes sure user may read it.
+func readableEntry(user *User, entryID int) (*Entry, error) {
+	entry, err := repo.Entries.Get(entryID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBlocked(user.ID, entry.UserID); err != nil {
+		return nil, err
+	}
+	ok, err := canRead(user.ID, entry)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrPermissionDenied
+	}
+	return entry, nil
+}
+
+// ownEntryFromPath is entryFromPath for changes only the author may make.
+func ownEntryFromPath(r *http.Request, user *User) (*Entry, error) {
+	entry, err := entryFromPath(r, user)
+	if err != nil {
+		return nil, err
 	}
-	return isFriend(w, r, anotherID)
+	if entry.UserID != user.ID {
+		return nil, ErrNotAuthor
+	}
+	return entry, nil
 }
 
 func markFootprint(user *User, id int) {
 	if user != nil && user.ID != id {
-		_, err := db.Exec(`INSERT INTO footprints (user_id, owner_id) VALUES (?,?)`, id, user.ID)
-		checkErr(err)
-	}
-}
-
-func myHandler(fn func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		defer func() {
-			rcv := recover()
-			if rcv != nil {
-				switch {
-				case rcv == ErrAuthentication:
-					session := getSession(w, r)
-					delete(session.Values, "user_id")
-					session.Save(r, w)
-					render(w, r, http.StatusUnauthorized, "login.html", struct{ Message string }{"ログインに失敗しました"})
-					return
-				case rcv == ErrPermissionDenied:
-					render(w, r, http.StatusForbidden, "error.html", struct{ Message string }{"友人のみしかアクセスできません"})
-					return
-				case rcv == ErrContentNotFound:
-					render(w, r, http.StatusNotFound, "error.html", struct{ Message string }{"要求されたコンテンツは存在しません"})
-					return
-				default:
-					var msg string
-					if e, ok := rcv.(runtime.Error); ok {
-						msg = e.Error()
-					}
-					if s, ok := rcv.(string); ok {
-						msg = s
-					}
-					msg = rcv.(error).Error()
-					http.Error(w, msg, http.StatusInternalServerError)
-				}
-			}
-		}()
-		fn(w, r)
+		footprintRecorder.Mark(id, user.ID)
 	}
 }
 
@@ -229,28 +291,153 @@ func getTemplatePath(file string) string {
 	return path.Join("templates", file)
 }
 
-func render(w http.ResponseWriter, r *http.Request, status int, file string, data interface{}) {
+// headerless lists the pages shown before login, which have no header.
+var headerless = map[string]bool{"login.html": true, "signup.html": true}
+
+// Header is what header.html shows above every other page.
+type Header struct {
+	User   *User
+	Unread int
+}
+
+// unreadBadgeLimit caps the count on the badge, shown as "99+" beyond it.
+const unreadBadgeLimit = 100
+
+// Badge is the unread count shown next to the link to /notifications.
+func (h Header) Badge() string {
+	if h.Unread >= unreadBadgeLimit {
+		return strconv.Itoa(unreadBadgeLimit-1) + "+"
+	}
+	return strconv.Itoa(h.Unread)
+}
+
+func render(w http.ResponseWriter, r *http.Request, status int, file string, data interface{}) error {
+	var header Header
+	if !headerless[file] {
+		header.User = getCurrentUser(w, r)
+		if header.User != nil {
+			// A broken badge should not take the page down with it.
+			unread, err := repo.Notifications.CountUnread(header.User.ID, unreadBadgeLimit)
+			if err != nil {
+				log.Printf("Failed to count notifications: %s.", err.Error())
+			}
+			header.Unread = unread
+		}
+	}
+
 	w.WriteHeader(status)
-	checkErr(templates.ExecuteTemplate(w, file, data))
+	if !headerless[file] {
+		if err := templates.ExecuteTemplate(w, "header.html", header); err != nil {
+			return err
+		}
+	}
+	return templates.ExecuteTemplate(w, file, data)
 }
 
-func GetLogin(w http.ResponseWriter, r *http.Request) {
-	render(w, r, http.StatusOK, "login.html", struct{ Message string }{"高負荷に耐えられるSNSコミュニティサイトへようこそ!"})
+func GetLogin(w http.ResponseWriter, r *http.Request) error {
+	return render(w, r, http.StatusOK, "login.html", struct{ Message string }{"高負荷に耐えられるSNSコミュニティサイトへようこそ!"})
 }
 
-func PostLogin(w http.ResponseWriter, r *http.Request) {
+func PostLogin(w http.ResponseWriter, r *http.Request) error {
 	email := r.FormValue("email")
 	passwd := r.FormValue("password")
-	authenticate(w, r, email, passwd)
+	if err := authenticate(w, r, email, passwd); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
+
+type SignupForm struct {
+	Message     string
+	AccountName string
+	NickName    string
+	Email       string
+}
+
+var accountNamePattern = regexp.MustCompile(`^[0-9A-Za-z_]{1,64}$`)
+
+func GetSignup(w http.ResponseWriter, r *http.Request) error {
+	return render(w, r, http.StatusOK, "signup.html", SignupForm{})
+}
+
+func PostSignup(w http.ResponseWriter, r *http.Request) error {
+	form := SignupForm{
+		AccountName: r.FormValue("account_name"),
+		NickName:    r.FormValue("nick_name"),
+		Email:       r.FormValue("email"),
+	}
+	passwd := r.FormValue("password")
+
+	invalid := func(status int, message string) error {
+		form.Message = message
+		return render(w, r, status, "signup.html", form)
+	}
+
+	switch {
+	case !accountNamePattern.MatchString(form.AccountName):
+		return invalid(http.StatusBadRequest, "アカウント名は64文字以内の英数字と_で入力してください")
+	case form.NickName == "" || utf8.RuneCountInString(form.NickName) > 32:
+		return invalid(http.StatusBadRequest, "ニックネームは32文字以内で入力してください")
+	case !strings.Contains(form.Email, "@") || len(form.Email) > 255:
+		return invalid(http.StatusBadRequest, "メールアドレスを正しく入力してください")
+	case passwd == "":
+		return invalid(http.StatusBadRequest, "パスワードを入力してください")
+	}
+
+	for _, check := range []struct {
+		find    func(string) (*User, error)
+		value   string
+		message string
+	}{
+		{userCache.FromAccount, form.AccountName, "そのアカウント名は既に使われています"},
+		{repo.Users.FindByNickName, form.NickName, "そのニックネームは既に使われています"},
+		{userCache.FromEmail, form.Email, "そのメールアドレスは既に使われています"},
+	} {
+		_, err := check.find(check.value)
+		if err == nil {
+			return invalid(http.StatusConflict, check.message)
+		}
+		if err != ErrContentNotFound {
+			return err
+		}
+	}
+
+	salt, err := newSalt()
+	if err != nil {
+		return err
+	}
+	user := User{
+		AccountName:  form.AccountName,
+		NickName:     form.NickName,
+		Email:        form.Email,
+		Salt:         salt,
+		PasswordHash: calcPassHash(passwd, salt),
+	}
+	// Someone may have taken the name between the checks above and here.
+	err = repo.Users.Create(&user)
+	if err == ErrUserExists {
+		return invalid(http.StatusConflict, ErrUserExists.Message)
+	}
+	if err != nil {
+		return err
+	}
+	userCache.Set(user)
+
+	if err := login(w, r, &user); err != nil {
+		return err
+	}
 	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
 }
 
-func GetLogout(w http.ResponseWriter, r *http.Request) {
+func GetLogout(w http.ResponseWriter, r *http.Request) error {
 	session := getSession(w, r)
 	delete(session.Values, "user_id")
 	session.Options = &sessions.Options{MaxAge: -1}
 	session.Save(r, w)
 	http.Redirect(w, r, "/login", http.StatusFound)
+	return nil
 }
 
 type IComment struct {
@@ -260,12 +447,6 @@ type IComment struct {
 	CreatedAt   time.Time
 }
 
-type IFootPrint struct {
-	AccountName string
-	NickName    string
-	CreatedAt   time.Time
-}
-
 type IEntry struct {
 	ID          int
 	Title       string
@@ -275,582 +456,1008 @@ type IEntry struct {
 }
 
 type FriendComment struct {
-	ID          int
-	EntryID     int
-	UserID      int
-	Comment     string
-	EntryUserID int
-	CreatedAt   time.Time
+	ID               int
+	EntryID          int
+	UserID           int
+	Comment          string
+	EntryUserID      int
+	CreatedAt        time.Time
+	AccountName      string
+	NickName         string
+	EntryAccountName string
+	EntryNickName    string
 }
 
-func GetIndex(w http.ResponseWriter, r *http.Request) {
-	user := authenticated(w, r)
-	if user == nil {
-		return
-	}
+// Index is what the top page shows.
+type Index struct {
+	User              User
+	Profile           Profile
+	Entries           []Entry
+	CommentsForMe     []IComment
+	EntriesOfFriends  []IEntry
+	CommentsOfFriends []FriendComment
+	Friends           int
+	Footprints        []FFootprint
+	Suggestions       []Suggestion
+	// Visibility is shown next to each field, as a reminder of who else
+	// sees it.
+	Visibility ProfileVisibility
+	Shown      ProfileFields
+}
 
-	var wg sync.WaitGroup
+func loadIndex(user *User) (*Index, error) {
+	idx := &Index{User: *user}
+	var g group
 
-	wg.Add(1)
-	prof := Profile{}
-	go func() {
-		defer wg.Done()
-
-		row := db.QueryRow(`
-SELECT * FROM profiles
-WHERE user_id = ?`, user.ID)
-		err := row.Scan(&prof.UserID, &prof.FirstName, &prof.LastName, &prof.Sex, &prof.Birthday, &prof.Pref, &prof.UpdatedAt)
-		if err != sql.ErrNoRows {
-			checkErr(err)
-		}
-	}()
+	g.Go(func() (err error) {
+		idx.Profile, err = repo.Profiles.Get(user.ID)
+		return
+	})
 
-	wg.Add(1)
-	entries := make([]Entry, 0, 5)
-	go func() {
-		defer wg.Done()
-
-		rows, err := db.Query(`
-SELECT id, body FROM entries
-WHERE user_id = ?
-ORDER BY created_at LIMIT 5`, user.ID)
-		defer rows.Close()
-		if err != sql.ErrNoRows {
-			checkErr(err)
-		}
+	g.Go(func() (err error) {
+		idx.Visibility, err = repo.Profiles.Visibility(user.ID)
+		return
+	})
 
-		for rows.Next() {
-			var id int
-			var body string
-			checkErr(rows.Scan(&id, &body))
-			entries = append(entries, Entry{ID: id, Title: strings.SplitN(body, "\n", 2)[0]})
-		}
-	}()
+	g.Go(func() (err error) {
+		idx.Entries, err = repo.Entries.ListByUser(user.ID, user.ID, 5)
+		return
+	})
 
-	wg.Add(1)
-	commentsForMe := make([]IComment, 0, 10)
-	go func() {
-		defer wg.Done()
+	g.Go(func() (err error) {
+		idx.CommentsForMe, err = repo.Comments.ListForOwner(user.ID, 10)
+		return
+	})
 
-		rows, err := db.Query(`
-SELECT c.comment AS comment, c.created_at AS created_at, u.nick_name AS nick_name, u.account_name AS account_name
-FROM comments c
-JOIN entries e ON c.entry_id = e.id
-JOIN users u ON u.id = e.user_id
-WHERE e.user_id = ?
-ORDER BY c.created_at DESC
-LIMIT 10`, user.ID)
+	g.Go(func() (err error) {
+		idx.EntriesOfFriends, err = repo.Timelines.List(user.ID, 10)
+		return
+	})
 
-		defer rows.Close()
+	g.Go(func() (err error) {
+		idx.CommentsOfFriends, err = repo.Feeds.List(user.ID, 10)
+		return
+	})
 
-		if err != sql.ErrNoRows {
-			checkErr(err)
-		}
+	g.Go(func() (err error) {
+		idx.Footprints, err = repo.Footprints.ListDaily(user.ID, PageQuery{Limit: 10})
+		return
+	})
 
-		for rows.Next() {
-			c := IComment{}
-			checkErr(rows.Scan(&c.Comment, &c.CreatedAt, &c.NickName, &c.AccountName))
-			commentsForMe = append(commentsForMe, c)
-		}
-	}()
+	g.Go(func() (err error) {
+		idx.Suggestions, err = suggestionEngine.List(user.ID, 5)
+		return
+	})
 
-	wg.Add(1)
-	entriesOfFriends := make([]IEntry, 0, 10)
-	go func() {
-		defer wg.Done()
-
-		rows, err := db.Query(`
-SELECT e.id, e.body, e.created_at, u.account_name, u.nick_name FROM relations r
-INNER JOIN (SELECT id, body, user_id, created_at FROM entries
-	ORDER BY created_at DESC
-	LIMIT 1000) as e ON e.user_id = r.one
-INNER JOIN users u ON e.user_id = u.id
-WHERE r.another = ?
-ORDER BY e.created_at DESC
-LIMIT 10`, user.ID)
-		if err != sql.ErrNoRows {
-			checkErr(err)
-		}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	idx.Friends = friendGraph.Count(user.ID)
+	idx.Shown = idx.Visibility.shownTo(viewerSelf)
+	idx.Profile, idx.User = idx.Shown.redact(idx.Profile, idx.User)
+	return idx, nil
+}
 
-		for rows.Next() {
-			var id int
-			var body, accountName, nickName string
-			var createdAt time.Time
-			checkErr(rows.Scan(&id, &body, &createdAt, &accountName, &nickName))
-
-			entriesOfFriends = append(entriesOfFriends,
-				IEntry{
-					ID:          id,
-					Title:       strings.SplitN(body, "\n", 2)[0],
-					CreatedAt:   createdAt,
-					AccountName: accountName,
-					NickName:    nickName,
-				})
-		}
-		rows.Close()
-	}()
+func GetIndex(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
 
-	wg.Add(1)
-	commentsOfFriends := make([]FriendComment, 0, 10)
-	commentsOfFriendsData := make(map[int]User)
-	go func() {
-		defer wg.Done()
-
-		rows, err := db.Query(`
-SELECT c.entry_id, c.user_id, c.comment, c.created_at, e.user_id
-FROM (SELECT entry_id, user_id, comment, created_at FROM comments
-      ORDER BY created_at
-      DESC LIMIT 1000) as c
-INNER JOIN relations r ON r.one = c.user_id
-INNER JOIN entries e ON e.id = c.entry_id
-WHERE r.another = ? AND
-	  (e.private = 0 OR EXISTS (SELECT * FROM relations rr WHERE rr.one = c.user_id AND rr.another = e.user_id))
-ORDER BY created_at DESC
-LIMIT 10`, user.ID)
-
-		if err != sql.ErrNoRows {
-			checkErr(err)
-		}
+	idx, err := loadIndex(user)
+	if err != nil {
+		return err
+	}
+	return render(w, r, http.StatusOK, "index.html", idx)
+}
 
-		ids := make([]int, 0, 20)
-		for rows.Next() {
-			c := FriendComment{}
-			checkErr(rows.Scan(
-				&c.EntryID, &c.UserID, &c.Comment, &c.CreatedAt,
-				&c.EntryUserID))
+// ProfilePage is what the profile of Owner shows to User. When ViewAs is
+// set, it is the preview of their own profile as another viewer sees it.
+type ProfilePage struct {
+	Owner       User
+	Profile     Profile
+	Entries     []Entry
+	Friend      bool
+	Requested   bool
+	RequestedBy bool
+	User        *User
+	Prefectures []string
+	Shown       ProfileFields
+	ViewAs      string
+	// Visibility is only set for the owner.
+	Visibility   *ProfileVisibility
+	Visibilities []VisibilityChoice
+	// Mutual is the number of friends User and Owner have in common.
+	Mutual int
+}
 
-			commentsOfFriends = append(commentsOfFriends, c)
+// VisibilityFields is the settings form, shown to the owner only.
+func (p *ProfilePage) VisibilityFields() []VisibilityField {
+	if p.Visibility == nil {
+		return nil
+	}
+	return p.Visibility.fields()
+}
 
-			ids = append(ids, c.UserID, c.EntryUserID)
+// loadProfile loads the profile of the account as user sees it, and leaves
+// a footprint. Owners can pass view_as to see it as someone else would.
+func loadProfile(user *User, account, as string) (*ProfilePage, error) {
+	owner, err := getUserFromAccount(account)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBlocked(user.ID, owner.ID); err != nil {
+		return nil, err
+	}
+	w, err := viewerOf(user.ID, owner.ID)
+	if err != nil {
+		return nil, err
+	}
+	self := w == viewerSelf
+	if as != "" {
+		var ok bool
+		if w, ok = viewAs[as]; !ok {
+			return nil, ErrInvalidParameter
 		}
+		if !self {
+			return nil, ErrPermissionDenied
+		}
+	}
+
+	prof, err := repo.Profiles.Get(owner.ID)
+	if err != nil {
+		return nil, err
+	}
+	vis, err := repo.Profiles.Visibility(owner.ID)
+	if err != nil {
+		return nil, err
+	}
 
-		rows.Close()
+	var entries []Entry
+	if as == "" {
+		entries, err = repo.Entries.ListByUser(owner.ID, user.ID, 5)
+	} else {
+		entries, err = previewEntries(owner.ID, w, 5)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		for _, id := range ids {
-			data, _ := fromID(id)
-			commentsOfFriendsData[id] = *data
+	page := &ProfilePage{Owner: *owner, Entries: entries, Friend: w >= viewerFriend, User: user,
+		Prefectures: prefs, ViewAs: as, Visibilities: visibilities}
+	if as == "" {
+		page.Requested, err = repo.Requests.Exists(user.ID, owner.ID)
+		if err != nil {
+			return nil, err
 		}
-	}()
+		page.RequestedBy, err = repo.Requests.Exists(owner.ID, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		page.Mutual = friendGraph.Mutual(user.ID, owner.ID)
+		markFootprint(user, owner.ID)
+	}
+	if self && as == "" {
+		page.Visibility = &vis
+	}
+	page.Shown = vis.shownTo(w)
+	page.Profile, page.Owner = page.Shown.redact(prof, *owner)
+	return page, nil
+}
 
-	wg.Add(1)
-	friends := 0
-	go func() {
-		defer wg.Done()
-		// count friends
-		row := db.QueryRow(`
-SELECT COUNT(*) FROM relations
-WHERE one = ?`, user.ID)
-		row.Scan(&friends)
-	}()
+// previewScanSize is how many of the oldest entries previewEntries looks at.
+const previewScanSize = 1000
 
-	wg.Add(1)
-	footprints := make([]IFootPrint, 0, 10)
-	go func() {
-		defer wg.Done()
-		rows, err := db.Query(`
-SELECT DATE(f.created_at) AS date, MAX(f.created_at) AS updated, MIN(u.account_name), MIN(u.nick_name)
-FROM footprints f
-INNER JOIN users u ON u.id = f.owner_id
-WHERE f.user_id = ?
-GROUP BY user_id, f.owner_id, DATE(f.created_at)
-ORDER BY updated DESC
-LIMIT 10`, user.ID)
-		if err != sql.ErrNoRows {
-			checkErr(err)
+// previewEntries returns the oldest entries of the owner that any viewer
+// related to them as w may read. Such a viewer is in none of the friend
+// lists, so entries shared with a list are left out.
+func previewEntries(ownerID int, w viewer, limit int) ([]Entry, error) {
+	all, err := repo.Entries.ListByUser(ownerID, ownerID, previewScanSize)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, limit)
+	for _, e := range all {
+		if len(entries) == limit {
+			break
 		}
-		for rows.Next() {
-			fp := IFootPrint{}
-			checkErr(rows.Scan(&fp.CreatedAt, &time.Time{}, &fp.AccountName, &fp.NickName))
-			footprints = append(footprints, fp)
+		if e.Visibility.visibleTo(w) {
+			entries = append(entries, e)
 		}
-		rows.Close()
-	}()
-
-	wg.Wait()
-	render(w, r, http.StatusOK, "index.html", struct {
-		User                  User
-		Profile               Profile
-		Entries               []Entry
-		CommentsForMe         []IComment
-		EntriesOfFriends      []IEntry
-		CommentsOfFriends     []FriendComment
-		CommentsOfFriendsData map[int]User
-		Friends               int
-		Footprints            []IFootPrint
-	}{
-		*user, prof, entries, commentsForMe, entriesOfFriends, commentsOfFriends, commentsOfFriendsData, friends, footprints,
-	})
+	}
+	return entries, nil
 }
 
-func GetProfile(w http.ResponseWriter, r *http.Request) {
+func GetProfile(w http.ResponseWriter, r *http.Request) error {
 	user := authenticated(w, r)
 	if user == nil {
-		return
+		return nil
 	}
 
-	account := mux.Vars(r)["account_name"]
-	owner := getUserFromAccount(w, account)
-	row := db.QueryRow(`SELECT * FROM profiles WHERE user_id = ?`, owner.ID)
-	prof := Profile{}
-	err := row.Scan(&prof.UserID, &prof.FirstName, &prof.LastName, &prof.Sex, &prof.Birthday, &prof.Pref, &prof.UpdatedAt)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-	var query string
-	if permitted(w, r, user.ID, owner.ID) {
-		query = `SELECT * FROM entries WHERE user_id = ? ORDER BY created_at LIMIT 5`
-	} else {
-		query = `SELECT * FROM entries WHERE user_id = ? AND private=0 ORDER BY created_at LIMIT 5`
-	}
-	rows, err := db.Query(query, owner.ID)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-	entries := make([]Entry, 0, 5)
-	for rows.Next() {
-		var id, userID, private int
-		var body string
-		var createdAt time.Time
-		checkErr(rows.Scan(&id, &userID, &private, &body, &createdAt))
-		entry := Entry{id, userID, private == 1, strings.SplitN(body, "\n", 2)[0], strings.SplitN(body, "\n", 2)[1], createdAt}
-		entries = append(entries, entry)
+	page, err := loadProfile(user, mux.Vars(r)["account_name"], r.FormValue("view_as"))
+	if err != nil {
+		return err
 	}
-	rows.Close()
-
-	markFootprint(user, owner.ID)
+	return render(w, r, http.StatusOK, "profile.html", page)
+}
 
-	render(w, r, http.StatusOK, "profile.html", struct {
-		Owner       User
-		Profile     Profile
-		Entries     []Entry
-		Private     bool
-		User        *User
-		Prefectures []string
-	}{
-		*owner, prof, entries, permitted(w, r, user.ID, owner.ID), user, prefs,
-	})
+// updateProfile lets users change their own profile only.
+func updateProfile(user *User, account, firstName, lastName, sex, birth, pref string) error {
+	if account != user.AccountName {
+		return ErrPermissionDenied
+	}
+	return repo.Profiles.Update(user.ID, firstName, lastName, sex, birth, pref)
 }
 
-func PostProfile(w http.ResponseWriter, r *http.Request) {
+func PostProfile(w http.ResponseWriter, r *http.Request) error {
 	user := authenticated(w, r)
 	if user == nil {
-		return
+		return nil
 	}
 	account := mux.Vars(r)["account_name"]
-	if account != user.AccountName {
-		checkErr(ErrPermissionDenied)
-	}
-	query := `
-UPDATE profiles
-SET first_name=?, last_name=?, sex=?, birthday=?, pref=?, updated_at=CURRENT_TIMESTAMP()
-WHERE user_id = ?`
 	birth := r.FormValue("birthday")
 	firstName := r.FormValue("first_name")
 	lastName := r.FormValue("last_name")
 	sex := r.FormValue("sex")
 	pref := r.FormValue("pref")
-	_, err := db.Exec(query, firstName, lastName, sex, birth, pref, user.ID)
-	checkErr(err)
+	if err := updateProfile(user, account, firstName, lastName, sex, birth, pref); err != nil {
+		return err
+	}
 	// TODO should escape the account name?
 	http.Redirect(w, r, "/profile/"+account, http.StatusSeeOther)
+	return nil
+}
+
+// updateVisibility lets users change who sees their own profile only.
+func updateVisibility(user *User, account string, v ProfileVisibility) error {
+	if account != user.AccountName {
+		return ErrPermissionDenied
+	}
+	if !v.valid() {
+		return ErrInvalidParameter
+	}
+	return repo.Profiles.SetVisibility(user.ID, v)
+}
+
+func PostProfileVisibility(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
+	account := mux.Vars(r)["account_name"]
+	v := ProfileVisibility{
+		FirstName: Visibility(r.FormValue("first_name")),
+		LastName:  Visibility(r.FormValue("last_name")),
+		Sex:       Visibility(r.FormValue("sex")),
+		Birthday:  Visibility(r.FormValue("birthday")),
+		Pref:      Visibility(r.FormValue("pref")),
+		Email:     Visibility(r.FormValue("email")),
+	}
+	if err := updateVisibility(user, account, v); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/profile/"+account, http.StatusSeeOther)
+	return nil
 }
 
 type LEntry struct {
-	ID        int
-	Private   bool
+	ID int
+	Audience
 	Title     string
 	Content   string
 	Count     int
 	CreatedAt time.Time
 }
 
-func ListEntries(w http.ResponseWriter, r *http.Request) {
+// listEntries lists the entries of the account that user may read, and
+// leaves a footprint.
+func listEntries(user *User, account string, q PageQuery) (*User, []LEntry, error) {
+	owner, err := getUserFromAccount(account)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkBlocked(user.ID, owner.ID); err != nil {
+		return nil, nil, err
+	}
+
+	entries, err := repo.Entries.ListWithCommentCount(owner.ID, user.ID, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	markFootprint(user, owner.ID)
+	return owner, entries, nil
+}
+
+func ListEntries(w http.ResponseWriter, r *http.Request) error {
 	user := authenticated(w, r)
 	if user == nil {
-		return
+		return nil
 	}
 
-	account := mux.Vars(r)["account_name"]
-	owner := getUserFromAccount(w, account)
-
-	var wg sync.WaitGroup
+	q, err := parsePageQuery(r, 20)
+	if err != nil {
+		return err
+	}
+	owner, entries, err := listEntries(user, mux.Vars(r)["account_name"], q)
+	if err != nil {
+		return err
+	}
 
-	wg.Add(1)
-	entries := make([]LEntry, 0, 20)
-	go func() {
-		defer wg.Done()
-
-		var query string
-		if permitted(w, r, user.ID, owner.ID) {
-			query = `
-SELECT e.id, e.private, e.body, e.created_at,
-	   (SELECT COUNT(*) FROM comments c WHERE c.entry_id = e.id) as count
-FROM entries e
-WHERE e.user_id = ?
-ORDER BY e.created_at DESC
-LIMIT 20`
-		} else {
-			query = `
-SELECT e.id, e.private, e.body, e.created_at,
-	   (SELECT COUNT(*) FROM comments c WHERE c.entry_id = e.id) as count
-FROM entries e
-WHERE e.user_id = ? AND private = 0
-ORDER BY e.created_at DESC
-LIMIT 20`
+	var form *AudienceForm
+	if user.ID == owner.ID {
+		form, err = audienceForm(user, Audience{Visibility: VisibleEveryone})
+		if err != nil {
+			return err
 		}
+	}
 
-		rows, err := db.Query(query, owner.ID)
-		if err != sql.ErrNoRows {
-			checkErr(err)
-		}
-		for rows.Next() {
-			var id, private, count int
-			var body string
-			var createdAt time.Time
-			checkErr(rows.Scan(&id, &private, &body, &createdAt, &count))
-			entry := LEntry{ID: id, Private: private == 1,
-				Title:     strings.SplitN(body, "\n", 2)[0],
-				Content:   strings.SplitN(body, "\n", 2)[1],
-				CreatedAt: createdAt,
-				Count:     count}
-			entries = append(entries, entry)
-		}
-		rows.Close()
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		markFootprint(user, owner.ID)
-	}()
-
-	wg.Wait()
-	render(w, r, http.StatusOK, "entries.html", struct {
-		Owner   *User
-		Entries []LEntry
-		Myself  bool
-	}{owner, entries, user.ID == owner.ID})
-}
+	from, to, page := paginate(q, len(entries), func(i int) Cursor { return Cursor{entries[i].CreatedAt, entries[i].ID} })
+	return render(w, r, http.StatusOK, "entries.html", struct {
+		Owner    *User
+		Entries  []LEntry
+		Myself   bool
+		Audience *AudienceForm
+		Page     Page
+	}{owner, entries[from:to], user.ID == owner.ID, form, page})
+}
 
+// EComment is a comment as the entry page shows it. Deleted is set for
+// comments that are deleted, or whose author the entry owner has blocked;
+// they are only shown, without their text, to keep their replies in place.
 type EComment struct {
+	ID          int
+	ParentID    int
+	Depth       int
+	Deleted     bool
 	Comment     string
 	NickName    string
 	AccountName string
 	CreatedAt   time.Time
 }
 
-type EOwner struct {
-	id       int
-	NickName string
+// loadEntry loads the entry named in the path with a page of its comment
+// threads if user may read it, and leaves a footprint.
+func loadEntry(r *http.Request, user *User, q PageQuery) (*Entry, *User, []EComment, Page, error) {
+	entry, err := entryFromPath(r, user)
+	if err != nil {
+		return nil, nil, nil, Page{}, err
+	}
+	owner, err := getUser(entry.UserID)
+	if err != nil {
+		return nil, nil, nil, Page{}, err
+	}
+
+	comments, page, err := loadThreads(entry.ID, q)
+	if err != nil {
+		return nil, nil, nil, Page{}, err
+	}
+	markFootprint(user, owner.ID)
+	return entry, owner, comments, page, nil
 }
 
-func GetEntry(w http.ResponseWriter, r *http.Request) {
+func GetEntry(w http.ResponseWriter, r *http.Request) error {
 	user := authenticated(w, r)
 	if user == nil {
-		return
+		return nil
 	}
-	entryID := mux.Vars(r)["entry_id"]
-
-	row := db.QueryRow(`
-SELECT e.id, e.user_id, e.private, e.body, e.created_at, u.id, u.nick_name,
-(CASE WHEN e.user_id = ? THEN 1
-	  WHEN e.private = 1 AND NOT EXISTS (SELECT * FROM relations r WHERE r.one = e.user_id AND r.another = ?) THEN 0
-	  ELSE 1 END) as permitted
-FROM entries e
-INNER JOIN users u ON u.id = e.user_id
-WHERE e.id = ?`, user.ID, user.ID, entryID)
-	var id, userID, private, permit int
-	var body string
-	var createdAt time.Time
-	var owner EOwner
-	err := row.Scan(&id, &userID, &private, &body, &createdAt, &owner.id, &owner.NickName, &permit)
-	if err == sql.ErrNoRows {
-		checkErr(ErrContentNotFound)
+	q, err := parsePageQuery(r, 50)
+	if err != nil {
+		return err
 	}
-	checkErr(err)
-	if permit == 0 {
-		checkErr(ErrPermissionDenied)
+	entry, owner, comments, page, err := loadEntry(r, user, q)
+	if err != nil {
+		return err
+	}
+	images, err := repo.Images.ListByEntry(entry.ID)
+	if err != nil {
+		return err
 	}
 
-	entry := Entry{id, userID, private == 1, strings.SplitN(body, "\n", 2)[0], strings.SplitN(body, "\n", 2)[1], createdAt}
-
-	var wg sync.WaitGroup
-
-	wg.Add(1)
-	comments := make([]EComment, 0, 10)
-	go func() {
-		defer wg.Done()
-
-		rows, err := db.Query(`
-SELECT c.comment, c.created_at, u.nick_name, u.account_name
-FROM comments c
-INNER JOIN users u ON u.id = c.user_id
-WHERE c.entry_id = ?`, entry.ID)
-		if err != sql.ErrNoRows {
-			checkErr(err)
-		}
-		for rows.Next() {
-			c := EComment{}
-			checkErr(rows.Scan(&c.Comment, &c.CreatedAt, &c.NickName, &c.AccountName))
-			comments = append(comments, c)
-		}
-		rows.Close()
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		markFootprint(user, owner.id)
-	}()
+	return render(w, r, http.StatusOK, "entry.html", struct {
+		User     *User
+		Owner    *User
+		Entry    *Entry
+		Images   []Image
+		Comments []EComment
+		Page     Page
+	}{user, owner, entry, images, comments, page})
+}
 
-	wg.Wait()
+func GetEntryEdit(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
 
-	render(w, r, http.StatusOK, "entry.html", struct {
-		Owner    EOwner
-		Entry    Entry
-		Comments []EComment
-	}{owner, entry, comments})
+	entry, err := ownEntryFromPath(r, user)
+	if err != nil {
+		return err
+	}
+	form, err := audienceForm(user, entry.Audience)
+	if err != nil {
+		return err
+	}
+	return render(w, r, http.StatusOK, "entry_edit.html", struct {
+		Entry    *Entry
+		Audience *AudienceForm
+	}{entry, form})
 }
 
-func PostEntry(w http.ResponseWriter, r *http.Request) {
+func PostEntryEdit(w http.ResponseWriter, r *http.Request) error {
 	user := authenticated(w, r)
 	if user == nil {
-		return
+		return nil
 	}
 
+	entry, err := ownEntryFromPath(r, user)
+	if err != nil {
+		return err
+	}
 	title := r.FormValue("title")
 	if title == "" {
 		title = "タイトルなし"
 	}
+	audience, err := audienceFromForm(r, user)
+	if err != nil {
+		return err
+	}
 	content := r.FormValue("content")
-	var private int
-	if r.FormValue("private") == "" {
-		private = 0
-	} else {
-		private = 1
+	if err := repo.Entries.Update(entry.ID, audience, title, content); err != nil {
+		return err
+	}
+	searchIndex.AddEntry(entry.ID, title, content)
+	http.Redirect(w, r, "/diary/entry/"+strconv.Itoa(entry.ID), http.StatusSeeOther)
+	return nil
+}
+
+func DeleteEntry(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
+
+	entry, err := ownEntryFromPath(r, user)
+	if err != nil {
+		return err
+	}
+	if err := repo.Entries.Delete(entry.ID); err != nil {
+		return err
 	}
-	_, err := db.Exec(`INSERT INTO entries (user_id, private, body) VALUES (?,?,?)`, user.ID, private, title+"\n"+content)
-	checkErr(err)
 	http.Redirect(w, r, "/diary/entries/"+user.AccountName, http.StatusSeeOther)
+	return nil
+}
+
+// audienceFromForm reads the visibility and list_id fields of the entry
+// forms, or the private checkbox of older ones.
+func audienceFromForm(r *http.Request, user *User) (Audience, error) {
+	listID, _ := strconv.Atoi(r.FormValue("list_id"))
+	return entryAudience(user, r.FormValue("visibility"), listID, r.FormValue("private") != "")
+}
+
+// createEntry posts an entry with the images attached and delivers it to the
+// timelines of friends. When an image cannot be saved, the entry and the
+// images saved so far are deleted before anyone is told about it.
+func createEntry(user *User, audience Audience, title, content string, uploads []upload) (int, error) {
+	if title == "" {
+		title = "タイトルなし"
+	}
+	id, err := repo.Entries.Create(user.ID, audience, title, content)
+	if err != nil {
+		return 0, err
+	}
+	if err := saveImages(user, id, uploads); err != nil {
+		deleteImages(id)
+		if err := repo.Entries.Delete(id); err != nil {
+			log.Printf("Failed to delete entry %d: %s.", id, err.Error())
+		}
+		return 0, err
+	}
+	searchIndex.AddEntry(id, title, content)
+	return id, repo.Timelines.Push(id)
 }
 
-func PostComment(w http.ResponseWriter, r *http.Request) {
+func PostEntry(w http.ResponseWriter, r *http.Request) error {
 	user := authenticated(w, r)
 	if user == nil {
-		return
+		return nil
+	}
+
+	limitUploads(w, r)
+	uploads, err := readImages(r)
+	if err != nil {
+		return err
 	}
+	audience, err := audienceFromForm(r, user)
+	if err != nil {
+		return err
+	}
+	if _, err := createEntry(user, audience, r.FormValue("title"), r.FormValue("content"), uploads); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/diary/entries/"+user.AccountName, http.StatusSeeOther)
+	return nil
+}
 
-	entryID := mux.Vars(r)["entry_id"]
-	row := db.QueryRow(`SELECT * FROM entries WHERE id = ?`, entryID)
-	var id, userID, private int
-	var body string
-	var createdAt time.Time
-	err := row.Scan(&id, &userID, &private, &body, &createdAt)
-	if err == sql.ErrNoRows {
-		checkErr(ErrContentNotFound)
+// createComment posts a comment on an entry the caller has checked user may
+// read, delivers it to the feeds of friends and notifies the entry owner.
+// A parentID other than 0 makes it a reply, and notifies the author of the
+// parent comment instead when that is not the entry owner.
+func createComment(user *User, entry *Entry, parentID int, comment string) (int, error) {
+	c := Comment{EntryID: entry.ID, UserID: user.ID, Comment: comment}
+	var parent *Comment
+	if parentID != 0 {
+		var err error
+		if parent, err = repo.Comments.Get(parentID); err != nil {
+			return 0, err
+		}
+		if parent.EntryID != entry.ID {
+			return 0, ErrContentNotFound
+		}
+		if err := checkBlocked(user.ID, parent.UserID); err != nil {
+			return 0, err
+		}
+		c.place(parent)
 	}
-	checkErr(err)
 
-	entry := Entry{id, userID, private == 1, strings.SplitN(body, "\n", 2)[0], strings.SplitN(body, "\n", 2)[1], createdAt}
-	owner := getUser(w, entry.UserID)
-	if entry.Private {
-		if !permitted(w, r, user.ID, owner.ID) {
-			checkErr(ErrPermissionDenied)
+	id, err := repo.Comments.Create(c)
+	if err != nil {
+		return 0, err
+	}
+	searchIndex.AddComment(id, comment)
+	if err := repo.Feeds.Push(id); err != nil {
+		return 0, err
+	}
+	if parent != nil {
+		if err := notify(parent.UserID, user.ID, NotifyReply, entry.ID); err != nil {
+			return 0, err
+		}
+		if parent.UserID == entry.UserID {
+			return id, nil
 		}
 	}
+	return id, notify(entry.UserID, user.ID, NotifyComment, entry.ID)
+}
 
-	_, err = db.Exec(`INSERT INTO comments (entry_id, user_id, comment) VALUES (?,?,?)`, entry.ID, user.ID, r.FormValue("comment"))
-	checkErr(err)
+func PostComment(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
+
+	entry, err := entryFromPath(r, user)
+	if err != nil {
+		return err
+	}
+	parentID := 0
+	if s := r.FormValue("parent_id"); s != "" {
+		if parentID, err = strconv.Atoi(s); err != nil || parentID <= 0 {
+			return ErrInvalidParameter
+		}
+	}
+	if _, err := createComment(user, entry, parentID, r.FormValue("comment")); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/diary/entry/"+strconv.Itoa(entry.ID), http.StatusSeeOther)
+	return nil
+}
+
+// DeleteComment lets the entry owner remove any comment on the entry, and
+// commenters remove their own comments on entries they can still read.
+func DeleteComment(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
+
+	entry, err := entryFromPath(r, user)
+	if err != nil {
+		return err
+	}
+	commentID, err := strconv.Atoi(mux.Vars(r)["comment_id"])
+	if err != nil {
+		return ErrContentNotFound
+	}
+	comment, err := repo.Comments.Get(commentID)
+	if err != nil {
+		return err
+	}
+	if comment.EntryID != entry.ID {
+		return ErrContentNotFound
+	}
+	if comment.UserID != user.ID && entry.UserID != user.ID {
+		return ErrNotAuthor
+	}
+	if err := repo.Comments.Delete(comment.ID); err != nil {
+		return err
+	}
 	http.Redirect(w, r, "/diary/entry/"+strconv.Itoa(entry.ID), http.StatusSeeOther)
+	return nil
 }
 
 type FFootprint struct {
+	ID          int
 	NickName    string
 	AccountName string
+	Date        time.Time
 	Updated     time.Time
 }
 
-func GetFootprints(w http.ResponseWriter, r *http.Request) {
+func GetFootprints(w http.ResponseWriter, r *http.Request) error {
 	user := authenticated(w, r)
 	if user == nil {
+		return nil
+	}
+
+	q, err := parsePageQuery(r, 50)
+	if err != nil {
+		return err
+	}
+	footprints, err := repo.Footprints.ListDaily(user.ID, q)
+	if err != nil {
+		return err
+	}
+	from, to, page := paginate(q, len(footprints), func(i int) Cursor { return Cursor{footprints[i].Updated, footprints[i].ID} })
+	return render(w, r, http.StatusOK, "footprints.html", struct {
+		Footprints []FFootprint
+		Page       Page
+	}{footprints[from:to], page})
+}
+
+func GetNotifications(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
+
+	q, err := parsePageQuery(r, 50)
+	if err != nil {
+		return err
+	}
+
+	var g group
+
+	var notifications []Notification
+	g.Go(func() (err error) {
+		notifications, err = repo.Notifications.List(user.ID, q)
 		return
+	})
+
+	var optOuts map[string]bool
+	g.Go(func() (err error) {
+		optOuts, err = repo.Notifications.OptOuts(user.ID)
+		return
+	})
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	from, to, page := paginate(q, len(notifications), func(i int) Cursor { return Cursor{notifications[i].CreatedAt, notifications[i].ID} })
+	return render(w, r, http.StatusOK, "notifications.html", struct {
+		Notifications []Notification
+		Types         []NotificationType
+		OptOuts       map[string]bool
+		Page          Page
+	}{notifications[from:to], notificationTypes, optOuts, page})
+}
+
+// PostNotificationsRead marks one notification as read, or all of them when
+// no ID is in the path.
+func PostNotificationsRead(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
 	}
 
-	footprints := make([]FFootprint, 0, 50)
-	rows, err := db.Query(`
-SELECT MAX(f.created_at) as updated, MIN(u.account_name), MIN(u.nick_name)
-FROM footprints f
-INNER JOIN users u ON u.id = f.owner_id
-WHERE f.user_id = ?
-GROUP BY f.user_id, f.owner_id, DATE(f.created_at)
-ORDER BY updated DESC
-LIMIT 50`, user.ID)
-	if err != sql.ErrNoRows {
-		checkErr(err)
+	id := 0
+	if s, ok := mux.Vars(r)["notification_id"]; ok {
+		var err error
+		if id, err = strconv.Atoi(s); err != nil || id <= 0 {
+			return ErrContentNotFound
+		}
 	}
-	for rows.Next() {
-		fp := FFootprint{}
-		checkErr(rows.Scan(&fp.Updated, &fp.AccountName, &fp.NickName))
-		footprints = append(footprints, fp)
+	if err := repo.Notifications.MarkRead(user.ID, id); err != nil {
+		return err
 	}
-	rows.Close()
-	render(w, r, http.StatusOK, "footprints.html", struct{ Footprints []FFootprint }{footprints})
+	http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+	return nil
+}
+
+// PostNotificationSettings turns off the types whose checkbox is unchecked.
+func PostNotificationSettings(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return ErrInvalidParameter
+	}
+	enabled := make(map[string]bool)
+	for _, typ := range r.PostForm["enabled"] {
+		enabled[typ] = true
+	}
+	var optOuts []string
+	for _, t := range notificationTypes {
+		if !enabled[t.Type] {
+			optOuts = append(optOuts, t.Type)
+		}
+	}
+	if err := repo.Notifications.SetOptOuts(user.ID, optOuts); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+	return nil
 }
 
 type FFriend struct {
+	ID          int
 	AccountName string
 	NickName    string
 	CreatedAt   time.Time
 }
 
-func GetFriends(w http.ResponseWriter, r *http.Request) {
+// Friendship is a row of relations: Another is a friend of One.
+type Friendship struct {
+	One     int
+	Another int
+}
+
+func GetFriends(w http.ResponseWriter, r *http.Request) error {
 	user := authenticated(w, r)
 	if user == nil {
+		return nil
+	}
+
+	q, err := parsePageQuery(r, 50)
+	if err != nil {
+		return err
+	}
+
+	var g group
+
+	var friends []FFriend
+	g.Go(func() (err error) {
+		friends, err = repo.Relations.ListFriends(user.ID, q)
 		return
+	})
+
+	var incoming, outgoing []FFriend
+	g.Go(func() (err error) {
+		incoming, err = repo.Requests.ListIncoming(user.ID)
+		return
+	})
+	g.Go(func() (err error) {
+		outgoing, err = repo.Requests.ListOutgoing(user.ID)
+		return
+	})
+
+	var blocks []FFriend
+	g.Go(func() (err error) {
+		blocks, err = repo.Blocks.List(user.ID)
+		return
+	})
+
+	var feedToken string
+	g.Go(func() (err error) {
+		feedToken, err = repo.FeedTokens.Get(user.ID)
+		return
+	})
+
+	if err := g.Wait(); err != nil {
+		return err
 	}
-	rows, err := db.Query(`
-SELECT r.created_at, u.account_name, u.nick_name
-FROM relations r
-INNER JOIN users u ON u.id = r.another
-WHERE r.one = ?
-ORDER BY r.created_at DESC`, user.ID)
-	if err != sql.ErrNoRows {
-		checkErr(err)
+	from, to, page := paginate(q, len(friends), func(i int) Cursor { return Cursor{friends[i].CreatedAt, friends[i].ID} })
+	feedURL := ""
+	if feedToken != "" {
+		feedURL = baseURL(r) + "/feeds/" + feedToken + "/friends.atom"
 	}
-	defer rows.Close()
+	return render(w, r, http.StatusOK, "friends.html", struct {
+		Friends  []FFriend
+		Page     Page
+		Incoming []FFriend
+		Outgoing []FFriend
+		Blocks   []FFriend
+		FeedURL  string
+	}{friends[from:to], page, incoming, outgoing, blocks, feedURL})
+}
 
-	friends := make([]FFriend, 0, 100)
-	for rows.Next() {
-		var friend FFriend
-		checkErr(rows.Scan(&friend.CreatedAt, &friend.AccountName, &friend.NickName))
-		friends = append(friends, friend)
+// otherUser returns the user named in the path, who must not be user.
+func otherUser(r *http.Request, user *User) (*User, error) {
+	another, err := getUserFromAccount(mux.Vars(r)["account_name"])
+	if err != nil {
+		return nil, err
+	}
+	if another.ID == user.ID {
+		return nil, ErrInvalidParameter
 	}
-	render(w, r, http.StatusOK, "friends.html", struct{ Friends []FFriend }{friends})
+	return another, nil
 }
 
-func PostFriends(w http.ResponseWriter, r *http.Request) {
+func PostFriends(w http.ResponseWriter, r *http.Request) error {
 	user := authenticated(w, r)
 	if user == nil {
-		return
+		return nil
 	}
 
-	anotherAccount := mux.Vars(r)["account_name"]
-	another, isFriend := isFriendAccount(w, r, anotherAccount)
-	if !isFriend {
-		_, err := db.Exec(`INSERT INTO relations (one, another) VALUES (?,?), (?,?)`, user.ID, another.ID, another.ID, user.ID)
-		checkErr(err)
-		http.Redirect(w, r, "/friends", http.StatusSeeOther)
+	another, err := otherUser(r, user)
+	if err != nil {
+		return err
+	}
+	if err := checkBlocked(user.ID, another.ID); err != nil {
+		return err
 	}
+	ok, err := isFriend(user.ID, another.ID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// Asking someone who has already asked us is the same as accepting.
+		accepted, err := repo.Requests.Delete(another.ID, user.ID)
+		if err != nil {
+			return err
+		}
+		if accepted {
+			err = makeFriends(user.ID, another.ID)
+		} else {
+			err = repo.Requests.Create(user.ID, another.ID)
+		}
+		if err != nil {
+			return err
+		}
+		typ := NotifyFriendRequest
+		if accepted {
+			typ = NotifyFriendAccept
+		}
+		if err := notify(another.ID, user.ID, typ, 0); err != nil {
+			return err
+		}
+	}
+	http.Redirect(w, r, "/friends", http.StatusSeeOther)
+	return nil
 }
 
-func GetInitialize(w http.ResponseWriter, r *http.Request) {
-	db.Exec("DELETE FROM relations WHERE id > 500000")
-	db.Exec("DELETE FROM footprints WHERE id > 500000")
-	db.Exec("DELETE FROM entries WHERE id > 500000")
-	db.Exec("DELETE FROM comments WHERE id > 1500000")
+func PostFriendAccept(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
+
+	another, err := otherUser(r, user)
+	if err != nil {
+		return err
+	}
+	ok, err := repo.Requests.Delete(another.ID, user.ID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrContentNotFound
+	}
+	if err := makeFriends(user.ID, another.ID); err != nil {
+		return err
+	}
+	if err := notify(another.ID, user.ID, NotifyFriendAccept, 0); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/friends", http.StatusSeeOther)
+	return nil
+}
+
+func PostFriendDecline(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
+
+	another, err := otherUser(r, user)
+	if err != nil {
+		return err
+	}
+	if _, err := repo.Requests.Delete(another.ID, user.ID); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/friends", http.StatusSeeOther)
+	return nil
+}
+
+// DeleteFriends unfriends the user, or withdraws the request sent to them.
+func DeleteFriends(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
+
+	another, err := otherUser(r, user)
+	if err != nil {
+		return err
+	}
+	if err := endFriendship(user.ID, another.ID); err != nil {
+		return err
+	}
+	if _, err := repo.Requests.Delete(user.ID, another.ID); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/friends", http.StatusSeeOther)
+	return nil
+}
+
+// PostBlocks blocks the user, which also ends the friendship and drops
+// requests in both directions.
+func PostBlocks(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
+
+	another, err := otherUser(r, user)
+	if err != nil {
+		return err
+	}
+	if err := repo.Blocks.Create(user.ID, another.ID); err != nil {
+		return err
+	}
+	if err := endFriendship(user.ID, another.ID); err != nil {
+		return err
+	}
+	if _, err := repo.Requests.Delete(user.ID, another.ID); err != nil {
+		return err
+	}
+	if _, err := repo.Requests.Delete(another.ID, user.ID); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/friends", http.StatusSeeOther)
+	return nil
+}
+
+func DeleteBlocks(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
+
+	another, err := otherUser(r, user)
+	if err != nil {
+		return err
+	}
+	if err := repo.Blocks.Delete(user.ID, another.ID); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/friends", http.StatusSeeOther)
+	return nil
+}
+
+func GetInitialize(w http.ResponseWriter, r *http.Request) error {
+	footprintRecorder.Discard()
+	for _, initialize := range []func() error{
+		repo.Profiles.Initialize,
+		repo.Relations.Initialize,
+		friendGraph.Load,
+		repo.Requests.Initialize,
+		repo.Blocks.Initialize,
+		repo.Footprints.Initialize,
+		repo.Entries.Initialize,
+		repo.Comments.Initialize,
+		repo.Timelines.Initialize,
+		repo.Feeds.Initialize,
+		repo.Notifications.Initialize,
+		repo.Tokens.Initialize,
+		repo.FeedTokens.Initialize,
+		repo.Images.Initialize,
+		repo.Suggestions.Initialize,
+		repo.FriendLists.Initialize,
+	} {
+		if err := initialize(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func main() {
+	backfillTL := flag.Bool("backfill-timelines", false, "rebuild the timeline of every user and exit")
+	backfillCF := flag.Bool("backfill-comment-feeds", false, "rebuild the friend comment feed of every user and exit")
+	flag.Parse()
+
 	runtime.GOMAXPROCS(4)
 
 	var err error
@@ -859,15 +1466,65 @@ func main() {
 		log.Fatalf("Failed to connect to DB: %s.", err.Error())
 	}
 	defer db.Close()
+	repo = NewMySQLRepository(db)
+
+	if *backfillTL || *backfillCF {
+		if *backfillTL {
+			if err := backfill("timelines", repo.Timelines.Rebuild, 8); err != nil {
+				log.Fatalf("Failed to backfill timelines: %s.", err.Error())
+			}
+		}
+		if *backfillCF {
+			if err := backfill("comment feeds", repo.Feeds.Rebuild, 8); err != nil {
+				log.Fatalf("Failed to backfill comment feeds: %s.", err.Error())
+			}
+		}
+		return
+	}
 
 	// load users
-	rows, _ := db.Query(`SELECT id, account_name, nick_name, email, passhash, salt FROM users`)
-	for rows.Next() {
-		var user User
-		rows.Scan(&user.ID, &user.AccountName, &user.NickName, &user.Email, &user.PasswordHash, &user.Salt)
-		unsafeSetUser(user)
+	userCache = NewUserCache(repo.Users)
+	if err := userCache.Load(); err != nil {
+		log.Fatalf("Failed to load users: %s.", err.Error())
+	}
+	expvar.Publish("user_cache", expvar.Func(func() interface{} { return userCache.Stats() }))
+
+	// load friendships
+	friendGraph = NewFriendGraph(repo.Relations)
+	if err := friendGraph.Load(); err != nil {
+		log.Fatalf("Failed to load friendships: %s.", err.Error())
 	}
-	rows.Close()
+	expvar.Publish("friend_graph", expvar.Func(func() interface{} { return friendGraph.Stats() }))
+	expvar.Publish("markdown_cache", expvar.Func(func() interface{} { return markdownCache.Stats() }))
+
+	footprintRecorder = NewFootprintRecorder(repo.Footprints, 100*time.Millisecond)
+	go footprintRecorder.Run()
+
+	suggestionEngine = NewSuggestionEngine(10 * time.Minute)
+	expvar.Publish("suggestions", expvar.Func(func() interface{} { return suggestionEngine.Stats() }))
+	go suggestionEngine.Run()
+
+	searchIndex = NewSearchIndex()
+	expvar.Publish("search_index", expvar.Func(func() interface{} { return searchIndex.Stats() }))
+	go rebuildSearchIndex()
+
+	imageDir := os.Getenv("ISUCON5_IMAGE_DIR")
+	if imageDir == "" {
+		imageDir = "../images"
+	}
+	if imageStorage, err = NewLocalStorage(imageDir); err != nil {
+		log.Fatalf("Failed to open the image directory: %s.", err.Error())
+	}
+
+	// The stats published above are served by expvar on the default mux,
+	// which only listens on a local address, apart from the app.
+	debugAddr := os.Getenv("ISUCON5_DEBUG_ADDR")
+	if debugAddr == "" {
+		debugAddr = "127.0.0.1:6060"
+	}
+	go func() {
+		log.Printf("Debug server stopped: %s.", http.ListenAndServe(debugAddr, nil))
+	}()
 
 	ssecret := os.Getenv("ISUCON5_SESSION_SECRET")
 	if ssecret == "" {
@@ -875,39 +1532,79 @@ func main() {
 	}
 	store = sessions.NewCookieStore([]byte(ssecret))
 
+	r := newRouter()
+	log.Fatal(unixSocketServe("/tmp/isucon_go.sock", r))
+	// log.Fatal(http.ListenAndServe(":8080", r))
+}
+
+func newRouter() *mux.Router {
 	r := mux.NewRouter()
+	// HTML forms can only POST, so each DELETE also has a .../delete alias.
 
 	l := r.Path("/login").Subrouter()
 	l.Methods("GET").HandlerFunc(myHandler(GetLogin))
 	l.Methods("POST").HandlerFunc(myHandler(PostLogin))
+	su := r.Path("/signup").Subrouter()
+	su.Methods("GET").HandlerFunc(myHandler(GetSignup))
+	su.Methods("POST").HandlerFunc(myHandler(PostSignup))
 	r.Path("/logout").Methods("GET").HandlerFunc(myHandler(GetLogout))
 
 	p := r.Path("/profile/{account_name}").Subrouter()
 	p.Methods("GET").HandlerFunc(myHandler(GetProfile))
 	p.Methods("POST").HandlerFunc(myHandler(PostProfile))
+	r.HandleFunc("/profile/{account_name}/visibility", myHandler(PostProfileVisibility)).Methods("POST")
 
 	d := r.PathPrefix("/diary").Subrouter()
 	d.HandleFunc("/entries/{account_name}", myHandler(ListEntries)).Methods("GET")
+	d.HandleFunc("/entries/{account_name}/feed.atom", myHandler(GetEntriesFeed)).Methods("GET")
 	d.HandleFunc("/entry", myHandler(PostEntry)).Methods("POST")
 	d.HandleFunc("/entry/{entry_id}", myHandler(GetEntry)).Methods("GET")
+	d.HandleFunc("/entry/{entry_id}", myHandler(PostEntryEdit)).Methods("POST")
+	d.HandleFunc("/entry/{entry_id}", myHandler(DeleteEntry)).Methods("DELETE")
+	d.HandleFunc("/entry/{entry_id}/edit", myHandler(GetEntryEdit)).Methods("GET")
+	d.HandleFunc("/entry/{entry_id}/delete", myHandler(DeleteEntry)).Methods("POST")
+
+	d.HandleFunc("/image/{image_id}", myHandler(GetImage)).Methods("GET")
+	d.HandleFunc("/image/{image_id}/thumb", myHandler(GetImageThumbnail)).Methods("GET")
 
 	d.HandleFunc("/comment/{entry_id}", myHandler(PostComment)).Methods("POST")
+	d.HandleFunc("/comment/{entry_id}/{comment_id}", myHandler(DeleteComment)).Methods("DELETE")
+	d.HandleFunc("/comment/{entry_id}/{comment_id}/delete", myHandler(DeleteComment)).Methods("POST")
 
 	r.HandleFunc("/footprints", myHandler(GetFootprints)).Methods("GET")
 
+	r.HandleFunc("/search", myHandler(GetSearch)).Methods("GET")
+
+	r.HandleFunc("/feeds/token", myHandler(PostFeedToken)).Methods("POST")
+	r.HandleFunc("/feeds/{token}/friends.atom", myHandler(GetFriendsFeed)).Methods("GET")
+
+	r.HandleFunc("/notifications", myHandler(GetNotifications)).Methods("GET")
+	r.HandleFunc("/notifications/read", myHandler(PostNotificationsRead)).Methods("POST")
+	r.HandleFunc("/notifications/settings", myHandler(PostNotificationSettings)).Methods("POST")
+	r.HandleFunc("/notifications/{notification_id}/read", myHandler(PostNotificationsRead)).Methods("POST")
+
 	r.HandleFunc("/friends", myHandler(GetFriends)).Methods("GET")
+	r.HandleFunc("/friends/suggestions", myHandler(GetSuggestions)).Methods("GET")
+	r.HandleFunc("/friends/suggestions/{account_name}/dismiss", myHandler(PostSuggestionDismiss)).Methods("POST")
+	r.HandleFunc("/friends/lists", myHandler(GetFriendLists)).Methods("GET")
+	r.HandleFunc("/friends/lists", myHandler(PostFriendList)).Methods("POST")
+	r.HandleFunc("/friends/lists/{list_id}/delete", myHandler(DeleteFriendList)).Methods("POST")
+	r.HandleFunc("/friends/lists/{list_id}/members", myHandler(PostFriendListMember)).Methods("POST")
+	r.HandleFunc("/friends/lists/{list_id}/members/{account_name}/delete", myHandler(DeleteFriendListMember)).Methods("POST")
 	r.HandleFunc("/friends/{account_name}", myHandler(PostFriends)).Methods("POST")
+	r.HandleFunc("/friends/{account_name}", myHandler(DeleteFriends)).Methods("DELETE")
+	r.HandleFunc("/friends/{account_name}/delete", myHandler(DeleteFriends)).Methods("POST")
+	r.HandleFunc("/friends/{account_name}/accept", myHandler(PostFriendAccept)).Methods("POST")
+	r.HandleFunc("/friends/{account_name}/decline", myHandler(PostFriendDecline)).Methods("POST")
+
+	r.HandleFunc("/blocks/{account_name}", myHandler(PostBlocks)).Methods("POST")
+	r.HandleFunc("/blocks/{account_name}", myHandler(DeleteBlocks)).Methods("DELETE")
+	r.HandleFunc("/blocks/{account_name}/delete", myHandler(DeleteBlocks)).Methods("POST")
+
+	apiRoutes(r.PathPrefix("/api/v1").Subrouter())
 
 	r.HandleFunc("/initialize", myHandler(GetInitialize))
 	r.HandleFunc("/", myHandler(GetIndex))
 	r.PathPrefix("/").Handler(http.FileServer(http.Dir("../static")))
-
-	log.Fatal(unixSocketServe("/tmp/isucon_go.sock", r))
-	// log.Fatal(http.ListenAndServe(":8080", r))
-}
-
-func checkErr(err error) {
-	if err != nil {
-		panic(err)
-	}
+	return r
 }
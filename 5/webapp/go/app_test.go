@@ -0,0 +1,602 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// The handler tests run the whole router against the in-memory repository.
+// Every user's password is their account name.
+var testAccounts = []string{"alice", "bob", "carol", "dave"}
+
+func testUser(id int, name string) User {
+	return User{
+		ID:           id,
+		AccountName:  name,
+		NickName:     strings.ToUpper(name),
+		Email:        name + "@example.com",
+		Salt:         "salt",
+		PasswordHash: calcPassHash(name, "salt"),
+	}
+}
+
+// setupGlobals points the globals main sets up at a fresh in-memory
+// repository holding the users.
+func setupGlobals(t *testing.T, users []User) {
+	t.Helper()
+
+	setupRepository(t, NewMemoryRepository(users...))
+}
+
+// setupRepository points the globals main sets up at r.
+func setupRepository(t *testing.T, r *Repository) {
+	t.Helper()
+
+	repo = r
+	userCache = NewUserCache(repo.Users)
+	if err := userCache.Load(); err != nil {
+		t.Fatal(err)
+	}
+	friendGraph = NewFriendGraph(repo.Relations)
+	if err := friendGraph.Load(); err != nil {
+		t.Fatal(err)
+	}
+	footprintRecorder = NewFootprintRecorder(repo.Footprints, time.Hour)
+	suggestionEngine = NewSuggestionEngine(time.Hour)
+	searchIndex = NewSearchIndex()
+	if err := searchIndex.Rebuild(); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if imageStorage, err = NewLocalStorage(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	store = sessions.NewCookieStore([]byte("test"))
+}
+
+// testMySQL opens the database of ISUCON5_TEST_DSN, skipping the test when
+// it is not set, and empties every table in it. The DSN needs
+// parseTime=true and a database made from sql/schema.sql.
+func testMySQL(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("ISUCON5_TEST_DSN")
+	if dsn == "" {
+		t.Skip("ISUCON5_TEST_DSN is not set")
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	rows, err := db.Query("SHOW TABLES")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, table)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		if _, err := db.Exec("TRUNCATE " + table); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// newTestServer serves the router with the users in testAccounts.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	users := make([]User, len(testAccounts))
+	for i, name := range testAccounts {
+		users[i] = testUser(i+1, name)
+	}
+	setupGlobals(t, users)
+	srv := httptest.NewServer(newRouter())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testClient is a browser with its own cookies that does not follow
+// redirects, so that tests see the 303 of every form post.
+type testClient struct {
+	t    *testing.T
+	srv  *httptest.Server
+	http *http.Client
+}
+
+func newTestClient(t *testing.T, srv *httptest.Server) *testClient {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t, srv, &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+}
+
+// loggedIn returns a client logged in as the account.
+func loggedIn(t *testing.T, srv *httptest.Server, account string) *testClient {
+	c := newTestClient(t, srv)
+	if code, _ := c.post("/login", url.Values{"email": {account + "@example.com"}, "password": {account}}); code != http.StatusSeeOther {
+		t.Fatalf("login as %s: status %d", account, code)
+	}
+	return c
+}
+
+// do returns the status and the body, or the Location of a redirect.
+func (c *testClient) do(req *http.Request) (int, string) {
+	c.t.Helper()
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if loc := res.Header.Get("Location"); loc != "" {
+		return res.StatusCode, loc
+	}
+	return res.StatusCode, string(body)
+}
+
+func (c *testClient) get(path string) (int, string) {
+	c.t.Helper()
+
+	req, err := http.NewRequest("GET", c.srv.URL+path, nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return c.do(req)
+}
+
+func (c *testClient) post(path string, form url.Values) (int, string) {
+	c.t.Helper()
+
+	req, err := http.NewRequest("POST", c.srv.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(req)
+}
+
+// befriend makes the two accounts friends through a request and its
+// acceptance.
+func befriend(a, b *testClient, aName, bName string) {
+	a.t.Helper()
+
+	if code, _ := a.post("/friends/"+bName, nil); code != http.StatusSeeOther {
+		a.t.Fatalf("%s requests %s: status %d", aName, bName, code)
+	}
+	if code, _ := b.post("/friends/"+aName+"/accept", nil); code != http.StatusSeeOther {
+		b.t.Fatalf("%s accepts %s: status %d", bName, aName, code)
+	}
+}
+
+// wantStatus fails the test unless the request got the status.
+func wantStatus(t *testing.T, what string, got, want int) {
+	t.Helper()
+
+	if got != want {
+		t.Fatalf("%s: status %d, want %d", what, got, want)
+	}
+}
+
+// wantBody fails the test unless the body contains every one of want.
+func wantBody(t *testing.T, what, body string, want ...string) {
+	t.Helper()
+
+	for _, w := range want {
+		if !strings.Contains(body, w) {
+			t.Fatalf("%s: %q not found in\n%s", what, w, body)
+		}
+	}
+}
+
+// wantNoBody fails the test if the body contains any of unwanted.
+func wantNoBody(t *testing.T, what, body string, unwanted ...string) {
+	t.Helper()
+
+	for _, w := range unwanted {
+		if strings.Contains(body, w) {
+			t.Fatalf("%s: %q found in\n%s", what, w, body)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	srv := newTestServer(t)
+	c := newTestClient(t, srv)
+
+	code, loc := c.get("/")
+	wantStatus(t, "index before login", code, http.StatusFound)
+	wantBody(t, "redirect", loc, "/login")
+	code, body := c.get("/login")
+	wantStatus(t, "login page", code, http.StatusOK)
+
+	code, _ = c.post("/login", url.Values{"email": {"alice@example.com"}, "password": {"wrong"}})
+	wantStatus(t, "wrong password", code, http.StatusUnauthorized)
+	code, _ = c.post("/login", url.Values{"email": {"nobody@example.com"}, "password": {"alice"}})
+	wantStatus(t, "unknown email", code, http.StatusUnauthorized)
+
+	c = loggedIn(t, srv, "alice")
+	code, body = c.get("/")
+	wantStatus(t, "index", code, http.StatusOK)
+	wantBody(t, "index", body, "ALICE")
+
+	code, _ = c.get("/logout")
+	wantStatus(t, "logout", code, http.StatusFound)
+	code, _ = c.get("/")
+	wantStatus(t, "index after logout", code, http.StatusFound)
+}
+
+func TestSignup(t *testing.T) {
+	srv := newTestServer(t)
+	c := newTestClient(t, srv)
+
+	code, body := c.get("/signup")
+	wantStatus(t, "signup form", code, http.StatusOK)
+	wantBody(t, "signup form", body, "signup-form")
+
+	form := func(account, nick, email string) url.Values {
+		return url.Values{"account_name": {account}, "nick_name": {nick}, "email": {email}, "password": {"pw"}}
+	}
+	tests := []struct {
+		form url.Values
+		want int
+	}{
+		{form("alice", "X", "x@example.com"), http.StatusConflict},
+		{form("zed", "BOB", "x@example.com"), http.StatusConflict},
+		{form("zed", "X", "bob@example.com"), http.StatusConflict},
+		{form("a b", "X", "x@example.com"), http.StatusBadRequest},
+		{form("", "X", "x@example.com"), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		code, _ := c.post("/signup", tt.form)
+		wantStatus(t, "signup "+tt.form.Encode(), code, tt.want)
+	}
+
+	code, _ = c.post("/signup", form("eve", "EVE", "eve@example.com"))
+	wantStatus(t, "signup", code, http.StatusSeeOther)
+	code, body = c.get("/")
+	wantStatus(t, "index after signup", code, http.StatusOK)
+	wantBody(t, "index after signup", body, "EVE")
+
+	c = newTestClient(t, srv)
+	code, _ = c.post("/login", url.Values{"email": {"eve@example.com"}, "password": {"pw"}})
+	wantStatus(t, "login as the new user", code, http.StatusSeeOther)
+	code, _ = c.post("/signup", form("eve", "EVE2", "eve2@example.com"))
+	wantStatus(t, "signup twice", code, http.StatusConflict)
+}
+
+// TestSignupProfile fills in the profile of a new user, whose birthday
+// stays empty, through the pages and the API, in the in-memory repository
+// and, when ISUCON5_TEST_DSN is set, in the MySQL one.
+func TestSignupProfile(t *testing.T) {
+	run := func(t *testing.T, r *Repository) {
+		setupRepository(t, r)
+		srv := httptest.NewServer(newRouter())
+		t.Cleanup(srv.Close)
+		c := newTestClient(t, srv)
+
+		code, _ := c.post("/signup", url.Values{"account_name": {"eve"}, "nick_name": {"EVE"}, "email": {"eve@example.com"}, "password": {"eve"}})
+		wantStatus(t, "signup", code, http.StatusSeeOther)
+		code, _ = c.post("/profile/eve", url.Values{"first_name": {"Eve"}, "last_name": {"Adams"}, "birthday": {""}, "pref": {"東京都"}})
+		wantStatus(t, "edit profile without a birthday", code, http.StatusSeeOther)
+		code, body := c.get("/profile/eve")
+		wantStatus(t, "profile", code, http.StatusOK)
+		wantBody(t, "profile", body, "Adams", "東京都", "未入力")
+		code, _ = c.post("/profile/eve", url.Values{"first_name": {"Eve"}, "birthday": {"2000-01-02"}})
+		wantStatus(t, "edit profile with a birthday", code, http.StatusSeeOther)
+		_, body = c.get("/profile/eve")
+		wantBody(t, "profile with a birthday", body, "1月2日")
+
+		token := apiToken(t, srv, "eve")
+		code, v := apiCall(t, srv, "PUT", "/profile/eve", token, `{"first_name":"Eve","birthday":""}`)
+		if code != http.StatusOK || v["profile"].(map[string]interface{})["birthday"] != nil {
+			t.Fatalf("clear the birthday through the API: %d %v", code, v)
+		}
+	}
+	t.Run("memory", func(t *testing.T) { run(t, NewMemoryRepository()) })
+	t.Run("mysql", func(t *testing.T) { run(t, NewMySQLRepository(testMySQL(t))) })
+}
+
+func TestEntryPages(t *testing.T) {
+	srv := newTestServer(t)
+	alice := loggedIn(t, srv, "alice")
+	for i := 0; i < 45; i++ {
+		if _, err := repo.Entries.Create(1, Audience{Visibility: VisibleEveryone}, "t", "c"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path, seen := "/diary/entries/alice", 0
+	for pages := 0; ; pages++ {
+		code, body := alice.get(path)
+		wantStatus(t, path, code, http.StatusOK)
+		seen += strings.Count(body, `class="entry-title"`)
+		i := strings.Index(body, `class="next"><a href="`)
+		if i < 0 {
+			if pages != 2 {
+				t.Fatalf("%d pages, want 3", pages+1)
+			}
+			break
+		}
+		rest := body[i+len(`class="next"><a href="`):]
+		path = "/diary/entries/alice" + strings.Replace(rest[:strings.Index(rest, `"`)], "&amp;", "&", -1)
+	}
+	if seen != 45 {
+		t.Fatalf("saw %d entries over the pages, want 45", seen)
+	}
+
+	code, _ := alice.get("/diary/entries/alice?after=zzz")
+	wantStatus(t, "bad cursor", code, http.StatusBadRequest)
+}
+
+func TestFriends(t *testing.T) {
+	srv := newTestServer(t)
+	alice, bob, carol := loggedIn(t, srv, "alice"), loggedIn(t, srv, "bob"), loggedIn(t, srv, "carol")
+
+	code, _ := alice.post("/friends/alice", nil)
+	wantStatus(t, "befriend yourself", code, http.StatusBadRequest)
+	bob.post("/friends/alice", nil)
+	_, body := alice.get("/friends")
+	wantBody(t, "incoming request", body, "friend-requests-incoming", "BOB")
+	_, body = bob.get("/profile/alice")
+	wantBody(t, "pending request", body, "友だち申請中")
+	code, _ = alice.post("/friends/bob/accept", nil)
+	wantStatus(t, "accept", code, http.StatusSeeOther)
+	if !friendGraph.IsFriend(1, 2) {
+		t.Fatal("not friends after accept")
+	}
+
+	carol.post("/friends/alice", nil)
+	code, _ = alice.post("/friends/carol/decline", nil)
+	wantStatus(t, "decline", code, http.StatusSeeOther)
+	code, _ = alice.post("/friends/carol/accept", nil)
+	wantStatus(t, "accept a declined request", code, http.StatusNotFound)
+
+	// Requests both ways make friends at once.
+	alice.post("/friends/carol", nil)
+	carol.post("/friends/alice", nil)
+	if !friendGraph.IsFriend(1, 3) {
+		t.Fatal("not friends after requests both ways")
+	}
+	_, body = alice.get("/friends")
+	wantBody(t, "friends", body, "BOB", "CAROL")
+
+	req, err := http.NewRequest("DELETE", srv.URL+"/friends/bob", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ = alice.do(req)
+	wantStatus(t, "unfriend", code, http.StatusSeeOther)
+	if friendGraph.IsFriend(2, 1) {
+		t.Fatal("still friends after unfriending")
+	}
+}
+
+func TestBlocks(t *testing.T) {
+	srv := newTestServer(t)
+	alice, bob := loggedIn(t, srv, "alice"), loggedIn(t, srv, "bob")
+	alice.post("/diary/entry", url.Values{"title": {"t"}, "content": {"c"}})
+	bob.post("/diary/comment/1", url.Values{"comment": {"bob says"}})
+
+	code, _ := alice.post("/blocks/bob", nil)
+	wantStatus(t, "block", code, http.StatusSeeOther)
+	_, body := alice.get("/diary/entry/1")
+	wantNoBody(t, "comments of the blocked", body, "bob says")
+	_, body = alice.get("/friends")
+	wantBody(t, "block list", body, "ブロック中")
+	for _, path := range []string{"/profile/alice", "/diary/entries/alice", "/diary/entry/1"} {
+		code, _ := bob.get(path)
+		wantStatus(t, "blocked "+path, code, http.StatusForbidden)
+	}
+	code, _ = bob.post("/diary/comment/1", url.Values{"comment": {"x"}})
+	wantStatus(t, "blocked comment", code, http.StatusForbidden)
+	code, _ = bob.post("/friends/alice", nil)
+	wantStatus(t, "blocked request", code, http.StatusForbidden)
+
+	alice.post("/blocks/bob/delete", nil)
+	code, _ = bob.get("/profile/alice")
+	wantStatus(t, "unblocked", code, http.StatusOK)
+}
+
+func TestEntries(t *testing.T) {
+	srv := newTestServer(t)
+	alice, bob := loggedIn(t, srv, "alice"), loggedIn(t, srv, "bob")
+
+	code, loc := alice.post("/diary/entry", url.Values{"title": {"first"}, "content": {"hello"}})
+	wantStatus(t, "post entry", code, http.StatusSeeOther)
+	wantBody(t, "redirect", loc, "/diary/entries/alice")
+	code, body := bob.get("/diary/entry/1")
+	wantStatus(t, "read entry", code, http.StatusOK)
+	wantBody(t, "entry", body, "first", "hello")
+	code, body = bob.get("/diary/entries/alice")
+	wantStatus(t, "list entries", code, http.StatusOK)
+	wantBody(t, "list", body, "first")
+	code, _ = bob.get("/diary/entry/99")
+	wantStatus(t, "missing entry", code, http.StatusNotFound)
+
+	code, _ = bob.get("/diary/entry/1/edit")
+	wantStatus(t, "edit form of others", code, http.StatusForbidden)
+	code, _ = bob.post("/diary/entry/1", url.Values{"title": {"hacked"}})
+	wantStatus(t, "edit of others", code, http.StatusForbidden)
+	code, body = alice.get("/diary/entry/1/edit")
+	wantStatus(t, "edit form", code, http.StatusOK)
+	wantBody(t, "edit form", body, `value="first"`)
+	code, _ = alice.post("/diary/entry/1", url.Values{"title": {"edited"}, "content": {"hello again"}})
+	wantStatus(t, "edit", code, http.StatusSeeOther)
+	_, body = bob.get("/diary/entry/1")
+	wantBody(t, "edited entry", body, "edited", "hello again")
+
+	code, _ = bob.post("/diary/entry/1/delete", nil)
+	wantStatus(t, "delete of others", code, http.StatusForbidden)
+	code, _ = alice.post("/diary/entry/1/delete", nil)
+	wantStatus(t, "delete", code, http.StatusSeeOther)
+	code, _ = bob.get("/diary/entry/1")
+	wantStatus(t, "deleted entry", code, http.StatusNotFound)
+
+	alice.get("/initialize")
+	code, _ = bob.get("/diary/entry/1")
+	wantStatus(t, "entry after /initialize", code, http.StatusOK)
+}
+
+func TestComments(t *testing.T) {
+	srv := newTestServer(t)
+	alice, bob, carol := loggedIn(t, srv, "alice"), loggedIn(t, srv, "bob"), loggedIn(t, srv, "carol")
+	befriend(alice, bob, "alice", "bob")
+	alice.post("/diary/entry", url.Values{"title": {"t"}, "content": {"c"}, "visibility": {"friends"}})
+
+	code, _ := carol.post("/diary/comment/1", url.Values{"comment": {"stranger"}})
+	wantStatus(t, "comment on an entry for friends", code, http.StatusForbidden)
+	code, _ = bob.post("/diary/comment/1", url.Values{"comment": {"from bob"}})
+	wantStatus(t, "comment", code, http.StatusSeeOther)
+	alice.post("/diary/comment/1", url.Values{"comment": {"from alice"}})
+	_, body := alice.get("/diary/entry/1")
+	wantBody(t, "entry", body, "from bob", "from alice")
+	_, body = alice.get("/")
+	wantBody(t, "comments for me", body, "from bob")
+	_, body = alice.get("/diary/entries/alice")
+	wantBody(t, "entries", body, "コメント: 2件")
+
+	code, _ = bob.post("/diary/comment/1/2/delete", nil)
+	wantStatus(t, "delete the comment of others", code, http.StatusForbidden)
+	code, _ = bob.post("/diary/comment/1/1/delete", nil)
+	wantStatus(t, "delete own comment", code, http.StatusSeeOther)
+	code, _ = bob.post("/diary/comment/1/1/delete", nil)
+	wantStatus(t, "delete twice", code, http.StatusNotFound)
+	_, body = alice.get("/diary/entry/1")
+	wantNoBody(t, "entry after delete", body, "from bob")
+}
+
+func TestFootprints(t *testing.T) {
+	srv := newTestServer(t)
+	alice, bob := loggedIn(t, srv, "alice"), loggedIn(t, srv, "bob")
+
+	for i := 0; i < 3; i++ {
+		bob.get("/profile/alice")
+		bob.get("/diary/entries/alice")
+	}
+	_, body := alice.get("/footprints")
+	wantNoBody(t, "footprints before the flush", body, "BOB")
+	if err := footprintRecorder.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	code, body := alice.get("/footprints")
+	wantStatus(t, "footprints", code, http.StatusOK)
+	if n := strings.Count(body, "BOBさん"); n != 1 {
+		t.Fatalf("bob is listed %d times, want once a day", n)
+	}
+	_, body = alice.get("/")
+	wantBody(t, "index", body, "BOBさん")
+}
+
+func TestProfile(t *testing.T) {
+	srv := newTestServer(t)
+	alice, bob := loggedIn(t, srv, "alice"), loggedIn(t, srv, "bob")
+
+	code, _ := bob.post("/profile/alice", url.Values{"first_name": {"x"}})
+	wantStatus(t, "edit the profile of others", code, http.StatusForbidden)
+	code, _ = alice.post("/profile/alice", url.Values{
+		"first_name": {"Alice"}, "last_name": {"Liddell"}, "sex": {"女性"}, "birthday": {"2000-01-02"}, "pref": {"東京都"},
+	})
+	wantStatus(t, "edit profile", code, http.StatusSeeOther)
+	code, body := alice.get("/profile/alice")
+	wantStatus(t, "profile", code, http.StatusOK)
+	wantBody(t, "profile", body, "Liddell", "東京都")
+	code, body = bob.get("/profile/alice")
+	wantStatus(t, "profile of others", code, http.StatusOK)
+	wantBody(t, "profile of others", body, "ALICEさんのプロフィール")
+	code, _ = bob.get("/profile/nobody")
+	wantStatus(t, "unknown profile", code, http.StatusNotFound)
+}
+
+func TestHandlerPanics(t *testing.T) {
+	store = sessions.NewCookieStore([]byte("test"))
+	handlers := map[string]func(http.ResponseWriter, *http.Request) error{
+		"panic": func(http.ResponseWriter, *http.Request) error {
+			panic("boom")
+		},
+		"panic in a group": func(http.ResponseWriter, *http.Request) error {
+			var g group
+			g.Go(func() error {
+				var m map[string]int
+				m["x"] = 1
+				return nil
+			})
+			return g.Wait()
+		},
+	}
+	for name, h := range handlers {
+		rec := httptest.NewRecorder()
+		myHandler(h)(rec, httptest.NewRequest("GET", "/", nil))
+		wantStatus(t, name, rec.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestFriendComments(t *testing.T) {
+	srv := newTestServer(t)
+	alice, bob, dave := loggedIn(t, srv, "alice"), loggedIn(t, srv, "bob"), loggedIn(t, srv, "dave")
+	dave.post("/diary/entry", url.Values{"title": {"dave's"}, "content": {"x"}})
+	for i := 0; i < commentFeedSize+5; i++ {
+		if _, err := repo.Comments.Create(Comment{EntryID: 1, UserID: 2, Comment: "old"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bob.post("/diary/comment/1", url.Values{"comment": {"newest"}})
+
+	befriend(alice, bob, "alice", "bob")
+	feed, err := repo.Feeds.List(1, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feed) != commentFeedSize || feed[0].Comment != "newest" {
+		t.Fatalf("%d comments copied on connect, want the newest %d", len(feed), commentFeedSize)
+	}
+	if err := repo.Feeds.Rebuild(1); err != nil {
+		t.Fatal(err)
+	}
+	if feed, _ = repo.Feeds.List(1, 1000); len(feed) != commentFeedSize {
+		t.Fatalf("%d comments after a rebuild, want %d", len(feed), commentFeedSize)
+	}
+	_, body := alice.get("/")
+	wantBody(t, "index", body, "newest", "DAVEさん")
+
+	// A block between the reader and the entry author hides the comment,
+	// whichever way it goes.
+	dave.post("/blocks/alice", nil)
+	_, body = alice.get("/")
+	wantNoBody(t, "blocked by the entry author", body, "newest")
+	dave.post("/blocks/alice/delete", nil)
+	alice.post("/blocks/dave", nil)
+	_, body = alice.get("/")
+	wantNoBody(t, "entry author blocked", body, "newest")
+}
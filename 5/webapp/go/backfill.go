@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// backfill calls rebuild for every user with the given number of workers.
+// It is run once with -backfill-timelines or -backfill-comment-feeds after
+// the table behind them is created; from then on the handlers that post
+// entries and comments or change friendships keep it up to date.
+func backfill(name string, rebuild func(userID int) error, workers int) error {
+	users, err := repo.Users.All()
+	if err != nil {
+		return err
+	}
+
+	ids := make(chan int)
+	var done int64
+	var g group
+	for i := 0; i < workers; i++ {
+		g.Go(func() (err error) {
+			for id := range ids {
+				// Keep draining after a failure so that the sender never blocks.
+				if err != nil {
+					continue
+				}
+				if err = rebuild(id); err != nil {
+					continue
+				}
+				if n := atomic.AddInt64(&done, 1); n%500 == 0 {
+					log.Printf("backfilled %d/%d %s", n, len(users), name)
+				}
+			}
+			return err
+		})
+	}
+	for _, u := range users {
+		ids <- u.ID
+	}
+	close(ids)
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	log.Printf("backfilled %d %s", len(users), name)
+	return nil
+}
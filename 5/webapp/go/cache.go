@@ -1,47 +1,229 @@
 package main
 
-import "sync"
-
-var (
-	userCache        map[int]*User
-	userAccountCache map[string]*User
-	userEmailCache   map[string]*User
-	userCachem       [100]sync.RWMutex
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
 )
 
-func init() {
-	userCache = make(map[int]*User)
-	userAccountCache = make(map[string]*User)
-	userEmailCache = make(map[string]*User)
+const userCacheShards = 100
+
+// UserCache keeps users in memory, looked up by ID, account name and email.
+// Every index is sharded with its own RWMutex; writers are serialized by wmu
+// so an update never leaves the three indexes disagreeing for long.
+// Users missing from the preload are loaded from the repository on demand.
+type UserCache struct {
+	repo UserRepository
+
+	wmu    sync.Mutex
+	shards [userCacheShards]userCacheShard
+	// gen counts Set and Invalidate calls. A lookup that misses reads it
+	// before going to the repository and caches what it loaded only if it
+	// is unchanged, so a slow load never overwrites a newer write with a
+	// stale row. It is one counter for all users because a lookup by
+	// account name or email does not know the user ID until it has loaded.
+	gen uint64
+
+	hits   uint64
+	misses uint64
+}
+
+type userCacheShard struct {
+	sync.RWMutex
+	byID      map[int]*User
+	byAccount map[string]*User
+	byEmail   map[string]*User
+}
+
+type UserCacheStats struct {
+	Hits   uint64
+	Misses uint64
+	Size   int
+}
+
+var userCache *UserCache
+
+func NewUserCache(repo UserRepository) *UserCache {
+	c := &UserCache{repo: repo}
+	for i := range c.shards {
+		c.shards[i].byID = make(map[int]*User)
+		c.shards[i].byAccount = make(map[string]*User)
+		c.shards[i].byEmail = make(map[string]*User)
+	}
+	return c
+}
+
+func (c *UserCache) idShard(id int) *userCacheShard {
+	if id < 0 {
+		id = -id
+	}
+	return &c.shards[id%userCacheShards]
+}
+
+func (c *UserCache) keyShard(key string) *userCacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &c.shards[h.Sum32()%userCacheShards]
+}
+
+// Load preloads every user in the repository.
+func (c *UserCache) Load() error {
+	users, err := c.repo.All()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		c.Set(user)
+	}
+	return nil
+}
+
+// Set puts the user in the cache, replacing the entries of its old account
+// name and email when they have changed.
+func (c *UserCache) Set(user User) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	atomic.AddUint64(&c.gen, 1)
+	c.set(&user)
+}
+
+// fill caches a user loaded after a miss, unless a Set or Invalidate has run
+// since gen was read.
+func (c *UserCache) fill(user User, gen uint64) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if atomic.LoadUint64(&c.gen) != gen {
+		return
+	}
+	c.set(&user)
+}
+
+// set does the work of Set with wmu held.
+func (c *UserCache) set(u *User) {
+	s := c.idShard(u.ID)
+	s.Lock()
+	old := s.byID[u.ID]
+	s.byID[u.ID] = u
+	s.Unlock()
+
+	if old != nil {
+		c.deleteKeys(old)
+	}
+
+	s = c.keyShard(u.AccountName)
+	s.Lock()
+	s.byAccount[u.AccountName] = u
+	s.Unlock()
+
+	s = c.keyShard(u.Email)
+	s.Lock()
+	s.byEmail[u.Email] = u
+	s.Unlock()
+}
+
+// Invalidate drops the user; the next lookup reloads it from the repository.
+func (c *UserCache) Invalidate(id int) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	atomic.AddUint64(&c.gen, 1)
+
+	s := c.idShard(id)
+	s.Lock()
+	old := s.byID[id]
+	delete(s.byID, id)
+	s.Unlock()
+
+	if old != nil {
+		c.deleteKeys(old)
+	}
+}
+
+// deleteKeys removes the account and email entries that still point at u.
+func (c *UserCache) deleteKeys(u *User) {
+	s := c.keyShard(u.AccountName)
+	s.Lock()
+	if s.byAccount[u.AccountName] == u {
+		delete(s.byAccount, u.AccountName)
+	}
+	s.Unlock()
+
+	s = c.keyShard(u.Email)
+	s.Lock()
+	if s.byEmail[u.Email] == u {
+		delete(s.byEmail, u.Email)
+	}
+	s.Unlock()
+}
+
+func (c *UserCache) lookup(get func() (*User, bool), load func() (*User, error)) (*User, error) {
+	if u, ok := get(); ok {
+		atomic.AddUint64(&c.hits, 1)
+		return u, nil
+	}
+	atomic.AddUint64(&c.misses, 1)
 
-	// for i := 0; i < 100; i++ {
-	// 	userCachem[i] = sync.RWMutex{}
-	// }
+	gen := atomic.LoadUint64(&c.gen)
+	u, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.fill(*u, gen)
+	return u, nil
 }
 
-func unsafeSetUser(user User) {
-	userAccountCache[user.AccountName] = &user
-	userEmailCache[user.Email] = &user
-	userCache[user.ID] = &user
+// FromID returns ErrContentNotFound when there is no such user.
+func (c *UserCache) FromID(id int) (*User, error) {
+	s := c.idShard(id)
+	return c.lookup(func() (*User, bool) {
+		s.RLock()
+		defer s.RUnlock()
+		u, ok := s.byID[id]
+		return u, ok
+	}, func() (*User, error) {
+		return c.repo.FindByID(id)
+	})
 }
 
-func fromAccount(name string) (user *User, ok bool) {
-	// userCachem[user.ID%100].RLock()
-	// defer userCachem[user.ID%100].RUnlock()
-	user, ok = userAccountCache[name]
-	return
+// FromAccount returns ErrContentNotFound when there is no such user.
+func (c *UserCache) FromAccount(name string) (*User, error) {
+	s := c.keyShard(name)
+	return c.lookup(func() (*User, bool) {
+		s.RLock()
+		defer s.RUnlock()
+		u, ok := s.byAccount[name]
+		return u, ok
+	}, func() (*User, error) {
+		return c.repo.FindByAccount(name)
+	})
 }
 
-func fromEmail(email string) (user *User, ok bool) {
-	// userCachem[user.ID%100].RLock()
-	// defer userCachem[user.ID%100].RUnlock()
-	user, ok = userEmailCache[email]
-	return
+// FromEmail returns ErrContentNotFound when there is no such user.
+func (c *UserCache) FromEmail(email string) (*User, error) {
+	s := c.keyShard(email)
+	return c.lookup(func() (*User, bool) {
+		s.RLock()
+		defer s.RUnlock()
+		u, ok := s.byEmail[email]
+		return u, ok
+	}, func() (*User, error) {
+		return c.repo.FindByEmail(email)
+	})
 }
 
-func fromID(id int) (user *User, ok bool) {
-	// userCachem[user.ID%100].RLock()
-	// defer userCachem[user.ID%100].RUnlock()
-	user, ok = userCache[id]
-	return
+func (c *UserCache) Stats() UserCacheStats {
+	size := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.RLock()
+		size += len(s.byID)
+		s.RUnlock()
+	}
+	return UserCacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+		Size:   size,
+	}
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func cacheTestUsers(n int) []User {
+	users := make([]User, n)
+	for i := range users {
+		id := i + 1
+		users[i] = User{ID: id, AccountName: fmt.Sprint("account", id), NickName: fmt.Sprint("nick", id), Email: fmt.Sprintf("user%d@example.com", id)}
+	}
+	return users
+}
+
+// Run with -race: lookups, writes and invalidations of the same users all
+// at once must never return a user under someone else's key, and the cache
+// must end up holding the last write.
+func TestUserCacheConcurrent(t *testing.T) {
+	users := cacheTestUsers(50)
+	c := NewUserCache(NewMemoryRepository(users...).Users)
+	if err := c.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				want := users[(g*7+i)%len(users)]
+				var u *User
+				var err error
+				switch i % 5 {
+				case 0:
+					w := want
+					w.NickName = fmt.Sprintf("nick%d-%d-%d", want.ID, g, i)
+					c.Set(w)
+					continue
+				case 1:
+					c.Invalidate(want.ID)
+					continue
+				case 2:
+					u, err = c.FromID(want.ID)
+				case 3:
+					u, err = c.FromAccount(want.AccountName)
+				case 4:
+					u, err = c.FromEmail(want.Email)
+				}
+				if err != nil {
+					t.Errorf("lookup of %d: %v", want.ID, err)
+					return
+				}
+				if u.ID != want.ID || u.AccountName != want.AccountName || u.Email != want.Email {
+					t.Errorf("lookup of %+v returned %+v", want, *u)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for _, want := range users {
+		want.NickName = "final"
+		c.Set(want)
+	}
+	for _, want := range users {
+		for _, lookup := range []func() (*User, error){
+			func() (*User, error) { return c.FromID(want.ID) },
+			func() (*User, error) { return c.FromAccount(want.AccountName) },
+			func() (*User, error) { return c.FromEmail(want.Email) },
+		} {
+			u, err := lookup()
+			if err != nil || u.ID != want.ID || u.NickName != "final" {
+				t.Fatalf("after the last Set of %d: got %+v, %v", want.ID, u, err)
+			}
+		}
+	}
+	if st := c.Stats(); st.Size != len(users) {
+		t.Errorf("size %d, want %d", st.Size, len(users))
+	}
+}
+
+// blockingUsers holds FindByID after reading the row until release is
+// closed, to let a write overtake a slow load.
+type blockingUsers struct {
+	UserRepository
+	loaded  chan struct{}
+	release chan struct{}
+}
+
+func (r *blockingUsers) FindByID(id int) (*User, error) {
+	u, err := r.UserRepository.FindByID(id)
+	r.loaded <- struct{}{}
+	<-r.release
+	return u, err
+}
+
+func TestUserCacheSlowMiss(t *testing.T) {
+	users := cacheTestUsers(1)
+	tests := []struct {
+		name     string
+		overtake func(c *UserCache)
+		// want is the NickName cached afterwards, "" for nothing.
+		want string
+	}{
+		{"set", func(c *UserCache) {
+			u := users[0]
+			u.NickName = "newer"
+			c.Set(u)
+		}, "newer"},
+		{"invalidate", func(c *UserCache) {
+			c.Invalidate(users[0].ID)
+		}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &blockingUsers{NewMemoryRepository(users...).Users, make(chan struct{}, 1), make(chan struct{})}
+			c := NewUserCache(r)
+
+			done := make(chan *User)
+			go func() {
+				u, err := c.FromID(users[0].ID)
+				if err != nil {
+					t.Error(err)
+				}
+				done <- u
+			}()
+			<-r.loaded
+			tt.overtake(c)
+			close(r.release)
+			if u := <-done; u == nil || u.NickName != users[0].NickName {
+				t.Fatalf("the slow lookup returned %+v, want the row it loaded", u)
+			}
+
+			s := c.idShard(users[0].ID)
+			s.RLock()
+			cached := s.byID[users[0].ID]
+			s.RUnlock()
+			switch {
+			case tt.want == "" && cached != nil:
+				t.Errorf("cached %+v after Invalidate", *cached)
+			case tt.want != "" && (cached == nil || cached.NickName != tt.want):
+				t.Errorf("cached %+v, want NickName %q", cached, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// HTTPError is an error that is shown to the user with its status and message.
+type HTTPError struct {
+	Status  int
+	Message string
+	text    string
+}
+
+func (e *HTTPError) Error() string {
+	return e.text
+}
+
+var (
+	ErrAuthentication   = &HTTPError{http.StatusUnauthorized, "ログインに失敗しました", "Authentication error."}
+	ErrPermissionDenied = &HTTPError{http.StatusForbidden, "友人のみしかアクセスできません", "Permission denied."}
+	ErrContentNotFound  = &HTTPError{http.StatusNotFound, "要求されたコンテンツは存在しません", "Content not found."}
+	ErrNotAuthor        = &HTTPError{http.StatusForbidden, "投稿者のみが変更できます", "Not the author."}
+	ErrBlocked          = &HTTPError{http.StatusForbidden, "このユーザーとはやりとりできません", "Blocked."}
+	ErrInvalidParameter = &HTTPError{http.StatusBadRequest, "パラメータが不正です", "Invalid parameter."}
+	ErrUserExists       = &HTTPError{http.StatusConflict, "アカウント名またはメールアドレスは既に使われています", "User already exists."}
+	ErrInvalidToken     = &HTTPError{http.StatusUnauthorized, "トークンが無効です", "Invalid token."}
+	ErrInvalidImage     = &HTTPError{http.StatusBadRequest, "JPEG、PNG、GIFの画像のみ添付できます", "Invalid image."}
+	ErrImageTooLarge    = &HTTPError{http.StatusRequestEntityTooLarge, "画像が大きすぎます", "Image too large."}
+)
+
+type handlerFunc func(http.ResponseWriter, *http.Request) error
+
+func myHandler(fn handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := runSafe(func() error { return fn(w, r) }); err != nil {
+			handleError(w, r, err)
+		}
+	}
+}
+
+func handleError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	httpErr, ok := err.(*HTTPError)
+	if ok {
+		status = httpErr.Status
+	}
+	logError(r, status, err)
+
+	switch {
+	case err == ErrAuthentication:
+		session := getSession(w, r)
+		delete(session.Values, "user_id")
+		session.Save(r, w)
+		render(w, r, status, "login.html", struct{ Message string }{httpErr.Message})
+	case ok:
+		render(w, r, status, "error.html", struct{ Message string }{httpErr.Message})
+	default:
+		http.Error(w, http.StatusText(status), status)
+	}
+}
+
+func logError(r *http.Request, status int, err error) {
+	route := r.URL.Path
+	if cur := mux.CurrentRoute(r); cur != nil {
+		if tpl, e := cur.GetPathTemplate(); e == nil {
+			route = tpl
+		}
+	}
+
+	userID := 0
+	if id, ok := getSession(nil, r).Values["user_id"].(int); ok {
+		userID = id
+	}
+
+	log.Printf("level=error method=%s route=%q user_id=%d status=%d error=%q", r.Method, route, userID, status, err.Error())
+}
+
+// runSafe calls fn and turns a panic in it into an error.
+func runSafe(fn func() error) (err error) {
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			err = fmt.Errorf("panic: %v\n%s", rcv, debug.Stack())
+		}
+	}()
+	return fn()
+}
+
+// group runs functions concurrently and keeps the first error, like
+// errgroup.Group, but a panicking function fails the group instead of the
+// whole process.
+type group struct {
+	wg   sync.WaitGroup
+	once sync.Once
+	err  error
+}
+
+func (g *group) Go(fn func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := runSafe(fn); err != nil {
+			g.once.Do(func() { g.err = err })
+		}
+	}()
+}
+
+func (g *group) Wait() error {
+	g.wg.Wait()
+	return g.err
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// feedSize is the number of entries in a feed.
+const feedSize = 20
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  *atomPerson `xml:"author,omitempty"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	ID        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Published string     `xml:"published"`
+	Updated   string     `xml:"updated"`
+	Link      atomLink   `xml:"link"`
+	Author    atomPerson `xml:"author"`
+	Content   atomText   `xml:"content"`
+}
+
+func atomTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// baseURL is the scheme and host the request came in on, for the absolute
+// URLs Atom asks for.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// newAtomFeed builds a feed of the entries, newest first. The permalink of an
+// entry is its ID, so the ID stays the same when the entry is edited.
+func newAtomFeed(r *http.Request, title, self, alternate string, author *User, entries []Entry) (*atomFeed, time.Time, error) {
+	base := baseURL(r)
+	feed := &atomFeed{
+		ID:    base + self,
+		Title: title,
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: base + self},
+			{Rel: "alternate", Type: "text/html", Href: base + alternate},
+		},
+	}
+	if author != nil {
+		feed.Author = &atomPerson{author.NickName, base + "/profile/" + author.AccountName}
+	}
+
+	// An empty feed has not changed since the epoch.
+	updated := time.Unix(0, 0)
+	for _, e := range entries {
+		u, err := getUser(e.UserID)
+		if err != nil {
+			return nil, updated, err
+		}
+		link := base + "/diary/entry/" + strconv.Itoa(e.ID)
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:        link,
+			Title:     e.Title,
+			Published: atomTime(e.CreatedAt),
+			Updated:   atomTime(e.UpdatedAt),
+			Link:      atomLink{Rel: "alternate", Type: "text/html", Href: link},
+			Author:    atomPerson{u.NickName, base + "/profile/" + u.AccountName},
+			Content:   atomText{"text", e.Content},
+		})
+		if e.UpdatedAt.After(updated) {
+			updated = e.UpdatedAt
+		}
+	}
+	feed.Updated = atomTime(updated)
+	return feed, updated, nil
+}
+
+// serveFeed writes the feed with an ETag and Last-Modified, and lets
+// http.ServeContent answer If-None-Match and If-Modified-Since with 304.
+func serveFeed(w http.ResponseWriter, r *http.Request, feed *atomFeed, updated time.Time) error {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(feed); err != nil {
+		return err
+	}
+	sum := sha1.Sum(buf.Bytes())
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	http.ServeContent(w, r, "", updated, bytes.NewReader(buf.Bytes()))
+	return nil
+}
+
+// GetEntriesFeed is the public feed of a diary; only entries for everyone
+// appear in it, whoever asks.
+func GetEntriesFeed(w http.ResponseWriter, r *http.Request) error {
+	owner, err := getUserFromAccount(mux.Vars(r)["account_name"])
+	if err != nil {
+		return err
+	}
+	entries, err := repo.Entries.ListRecent(owner.ID, 0, feedSize)
+	if err != nil {
+		return err
+	}
+	feed, updated, err := newAtomFeed(r, owner.NickName+"さんの日記",
+		"/diary/entries/"+owner.AccountName+"/feed.atom", "/diary/entries/"+owner.AccountName, owner, entries)
+	if err != nil {
+		return err
+	}
+	return serveFeed(w, r, feed, updated)
+}
+
+// GetFriendsFeed is the friends timeline of the user the token in the path
+// was issued to, with the entries of friends that user may read, as on the
+// top page.
+func GetFriendsFeed(w http.ResponseWriter, r *http.Request) error {
+	token := mux.Vars(r)["token"]
+	userID, err := repo.FeedTokens.FindUser(token)
+	if err != nil {
+		return err
+	}
+	user, err := getUser(userID)
+	if err != nil {
+		return err
+	}
+
+	timeline, err := repo.Timelines.List(user.ID, feedSize)
+	if err != nil {
+		return err
+	}
+	ids := make([]int, 0, len(timeline))
+	for _, e := range timeline {
+		ids = append(ids, e.ID)
+	}
+	entries, err := repo.Entries.ListByIDs(ids)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return newer(entries[i].CreatedAt, entries[j].CreatedAt, entries[i].ID, entries[j].ID)
+	})
+
+	feed, updated, err := newAtomFeed(r, user.NickName+"さんの友だちの日記", "/feeds/"+token+"/friends.atom", "/", nil, entries)
+	if err != nil {
+		return err
+	}
+	// The URL is the secret, so shared caches must not keep the feed.
+	w.Header().Set("Cache-Control", "private, no-cache")
+	return serveFeed(w, r, feed, updated)
+}
+
+// PostFeedToken issues a new friends feed URL; the old one stops working.
+func PostFeedToken(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+	if err := repo.FeedTokens.Set(user.ID, token); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/friends", http.StatusSeeOther)
+	return nil
+}
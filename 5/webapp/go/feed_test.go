@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// feedGet fetches the feed without cookies, as a feed reader does.
+func feedGet(t *testing.T, u string, header map[string]string) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(b)
+}
+
+func TestEntriesFeed(t *testing.T) {
+	srv := newTestServer(t)
+	alice := loggedIn(t, srv, "alice")
+	alice.post("/diary/entry", url.Values{"title": {"public <&>"}, "content": {"x & y"}})
+	alice.post("/diary/entry", url.Values{"title": {"secret"}, "content": {"s"}, "visibility": {"friends"}})
+	feed := srv.URL + "/diary/entries/alice/feed.atom"
+
+	res, body := feedGet(t, feed, nil)
+	wantStatus(t, "feed", res.StatusCode, http.StatusOK)
+	wantBody(t, "content type", res.Header.Get("Content-Type"), "application/atom+xml")
+	wantBody(t, "feed", body, "public &lt;&amp;&gt;")
+	wantNoBody(t, "feed", body, "secret")
+
+	etag, modified := res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+	res, _ = feedGet(t, feed, map[string]string{"If-None-Match": etag})
+	wantStatus(t, "If-None-Match", res.StatusCode, http.StatusNotModified)
+	res, _ = feedGet(t, feed, map[string]string{"If-Modified-Since": modified})
+	wantStatus(t, "If-Modified-Since", res.StatusCode, http.StatusNotModified)
+
+	// Last-Modified has a resolution of a second.
+	time.Sleep(1100 * time.Millisecond)
+	alice.post("/diary/entry/1", url.Values{"title": {"edited"}, "content": {"x"}})
+	res, body = feedGet(t, feed, map[string]string{"If-None-Match": etag})
+	wantStatus(t, "feed after an edit", res.StatusCode, http.StatusOK)
+	wantBody(t, "feed after an edit", body, "edited")
+}
+
+var friendsFeedRe = regexp.MustCompile(`/feeds/[0-9a-f]+/friends\.atom`)
+
+func TestFriendsFeed(t *testing.T) {
+	srv := newTestServer(t)
+	alice, bob := loggedIn(t, srv, "alice"), loggedIn(t, srv, "bob")
+	befriend(alice, bob, "alice", "bob")
+	alice.post("/diary/entry", url.Values{"title": {"secret"}, "content": {"s"}, "visibility": {"friends"}})
+
+	_, body := bob.get("/friends")
+	wantNoBody(t, "friends page before a token", body, "friends.atom")
+	code, _ := bob.post("/feeds/token", nil)
+	wantStatus(t, "make a token", code, http.StatusSeeOther)
+	_, body = bob.get("/friends")
+	feed := friendsFeedRe.FindString(body)
+	if feed == "" {
+		t.Fatalf("no feed URL in\n%s", body)
+	}
+	res, body := feedGet(t, srv.URL+feed, nil)
+	wantStatus(t, "friends feed", res.StatusCode, http.StatusOK)
+	wantBody(t, "friends feed", body, "secret")
+
+	bob.post("/feeds/token", nil)
+	res, _ = feedGet(t, srv.URL+feed, nil)
+	wantStatus(t, "replaced token", res.StatusCode, http.StatusNotFound)
+	res, _ = feedGet(t, srv.URL+"/feeds/nope/friends.atom", nil)
+	wantStatus(t, "unknown token", res.StatusCode, http.StatusNotFound)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// DailyFootprint is the latest visit of OwnerID to the pages of UserID on
+// Date, as in the footprints table where user_id is the visited user.
+type DailyFootprint struct {
+	UserID  int
+	OwnerID int
+	Date    time.Time
+	Updated time.Time
+}
+
+type footprintKey struct {
+	userID  int
+	ownerID int
+	date    time.Time
+}
+
+// FootprintRecorder collects footprints in memory and writes them to the
+// repository in batches, so that views never wait for the INSERT. Visits to
+// the same user on the same day collapse into one row holding the latest
+// visit until the next flush.
+type FootprintRecorder struct {
+	repo     FootprintRepository
+	interval time.Duration
+
+	// flushMu keeps Discard from returning while a batch is being written.
+	flushMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[footprintKey]time.Time
+}
+
+var footprintRecorder *FootprintRecorder
+
+func NewFootprintRecorder(repo FootprintRepository, interval time.Duration) *FootprintRecorder {
+	return &FootprintRecorder{
+		repo:     repo,
+		interval: interval,
+		pending:  make(map[footprintKey]time.Time),
+	}
+}
+
+// Mark records that ownerID visited the pages of userID now.
+func (f *FootprintRecorder) Mark(userID, ownerID int) {
+	now := time.Now()
+	k := footprintKey{userID, ownerID, truncateDate(now)}
+
+	f.mu.Lock()
+	if t, ok := f.pending[k]; !ok || now.After(t) {
+		f.pending[k] = now
+	}
+	f.mu.Unlock()
+}
+
+// Run flushes the pending footprints every interval. It never returns.
+func (f *FootprintRecorder) Run() {
+	for range time.Tick(f.interval) {
+		if err := f.Flush(); err != nil {
+			log.Printf("Failed to record footprints: %s.", err.Error())
+		}
+	}
+}
+
+// Flush writes the pending footprints. Those that fail to be written are
+// kept for the next flush.
+func (f *FootprintRecorder) Flush() error {
+	f.flushMu.Lock()
+	defer f.flushMu.Unlock()
+
+	f.mu.Lock()
+	pending := f.pending
+	f.pending = make(map[footprintKey]time.Time)
+	f.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+	visits := make([]DailyFootprint, 0, len(pending))
+	for k, t := range pending {
+		visits = append(visits, DailyFootprint{UserID: k.userID, OwnerID: k.ownerID, Date: k.date, Updated: t})
+	}
+	if err := f.repo.Record(visits); err != nil {
+		f.mu.Lock()
+		for k, t := range pending {
+			if u, ok := f.pending[k]; !ok || t.After(u) {
+				f.pending[k] = t
+			}
+		}
+		f.mu.Unlock()
+		return err
+	}
+	notifyFootprints(visits)
+	return nil
+}
+
+// Discard drops the pending footprints; /initialize calls it before
+// resetting the tables.
+func (f *FootprintRecorder) Discard() {
+	f.flushMu.Lock()
+	defer f.flushMu.Unlock()
+
+	f.mu.Lock()
+	f.pending = make(map[footprintKey]time.Time)
+	f.mu.Unlock()
+}
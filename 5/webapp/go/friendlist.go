@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+const maxFriendListName = 64
+
+// FriendList is a group of friends an entry can be shared with. Only its
+// owner sees it, and members who stop being friends of the owner can no
+// longer read what is shared with it.
+type FriendList struct {
+	ID        int
+	UserID    int
+	Name      string
+	CreatedAt time.Time
+}
+
+// FriendListPage is a list with its members, for the settings page.
+type FriendListPage struct {
+	FriendList
+	Members []FFriend
+}
+
+// AudienceForm is the part of the entry forms that picks who may read the
+// entry, with Selected checked.
+type AudienceForm struct {
+	Visibilities []VisibilityChoice
+	Lists        []FriendList
+	Selected     Audience
+}
+
+func audienceForm(user *User, selected Audience) (*AudienceForm, error) {
+	lists, err := repo.FriendLists.ListByUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &AudienceForm{entryVisibilities, lists, selected}, nil
+}
+
+// ownFriendListFromPath loads the list named by list_id in the path. Lists
+// of others are not found, as if they did not exist.
+func ownFriendListFromPath(r *http.Request, user *User) (*FriendList, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["list_id"])
+	if err != nil {
+		return nil, ErrContentNotFound
+	}
+	list, err := repo.FriendLists.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if list.UserID != user.ID {
+		return nil, ErrContentNotFound
+	}
+	return list, nil
+}
+
+func GetFriendLists(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
+
+	lists, err := repo.FriendLists.ListByUser(user.ID)
+	if err != nil {
+		return err
+	}
+	pages := make([]FriendListPage, len(lists))
+	var g group
+	for i, l := range lists {
+		i, l := i, l
+		g.Go(func() (err error) {
+			pages[i] = FriendListPage{FriendList: l}
+			pages[i].Members, err = repo.FriendLists.Members(l.ID)
+			return
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	return render(w, r, http.StatusOK, "friend_lists.html", struct {
+		Lists []FriendListPage
+	}{pages})
+}
+
+func PostFriendList(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
+
+	name := r.FormValue("name")
+	if name == "" || utf8.RuneCountInString(name) > maxFriendListName {
+		return ErrInvalidParameter
+	}
+	if _, err := repo.FriendLists.Create(user.ID, name); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/friends/lists", http.StatusSeeOther)
+	return nil
+}
+
+// DeleteFriendList removes the list. Entries shared with it are left for
+// their author only.
+func DeleteFriendList(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
+
+	list, err := ownFriendListFromPath(r, user)
+	if err != nil {
+		return err
+	}
+	if err := repo.FriendLists.Delete(list.ID); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/friends/lists", http.StatusSeeOther)
+	return nil
+}
+
+// PostFriendListMember adds a friend, named by account_name in the form, to
+// the list.
+func PostFriendListMember(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
+
+	list, err := ownFriendListFromPath(r, user)
+	if err != nil {
+		return err
+	}
+	member, err := getUserFromAccount(r.FormValue("account_name"))
+	if err == ErrContentNotFound {
+		return ErrInvalidParameter
+	} else if err != nil {
+		return err
+	}
+	if friend, err := isFriend(user.ID, member.ID); err != nil {
+		return err
+	} else if !friend {
+		return ErrInvalidParameter
+	}
+	if err := repo.FriendLists.AddMember(list.ID, member.ID); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/friends/lists", http.StatusSeeOther)
+	return nil
+}
+
+func DeleteFriendListMember(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
+
+	list, err := ownFriendListFromPath(r, user)
+	if err != nil {
+		return err
+	}
+	member, err := getUserFromAccount(mux.Vars(r)["account_name"])
+	if err != nil {
+		return err
+	}
+	if err := repo.FriendLists.RemoveMember(list.ID, member.ID); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/friends/lists", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestFriendLists(t *testing.T) {
+	srv := newTestServer(t)
+	alice, bob, carol := loggedIn(t, srv, "alice"), loggedIn(t, srv, "bob"), loggedIn(t, srv, "carol")
+	befriend(alice, bob, "alice", "bob")
+	befriend(alice, carol, "alice", "carol")
+
+	code, _ := alice.post("/friends/lists", url.Values{"name": {""}})
+	wantStatus(t, "list without a name", code, http.StatusBadRequest)
+	code, _ = alice.post("/friends/lists", url.Values{"name": {"close"}})
+	wantStatus(t, "make a list", code, http.StatusSeeOther)
+	code, _ = alice.post("/friends/lists/1/members", url.Values{"account_name": {"dave"}})
+	wantStatus(t, "add a stranger", code, http.StatusBadRequest)
+	code, _ = alice.post("/friends/lists/1/members", url.Values{"account_name": {"bob"}})
+	wantStatus(t, "add a friend", code, http.StatusSeeOther)
+	code, _ = bob.post("/friends/lists/1/members", url.Values{"account_name": {"bob"}})
+	wantStatus(t, "edit the list of others", code, http.StatusNotFound)
+	_, body := alice.get("/friends/lists")
+	wantBody(t, "lists", body, "close", "BOB")
+
+	alice.post("/diary/entry", url.Values{"title": {"for the list"}, "content": {"x"}, "visibility": {"list"}, "list_id": {"1"}})
+	code, _ = bob.get("/diary/entry/1")
+	wantStatus(t, "list member", code, http.StatusOK)
+	code, _ = carol.get("/diary/entry/1")
+	wantStatus(t, "friend outside the list", code, http.StatusForbidden)
+
+	alice.post("/friends/lists/1/members/bob/delete", nil)
+	code, _ = bob.get("/diary/entry/1")
+	wantStatus(t, "removed member", code, http.StatusForbidden)
+	code, _ = alice.post("/friends/lists/1/delete", nil)
+	wantStatus(t, "delete the list", code, http.StatusSeeOther)
+	code, _ = alice.get("/diary/entry/1")
+	wantStatus(t, "author after the list is gone", code, http.StatusOK)
+}
@@ -0,0 +1,159 @@
+package main
+
+import "sync"
+
+// FriendGraph keeps every friendship in memory as adjacency sets, so that
+// permission checks never query relations. It is loaded at startup like
+// UserCache, and friendships are written through it to the repository.
+// Writers are serialized by wmu, so that the graph and the repository apply
+// changes to the same pair in the same order.
+type FriendGraph struct {
+	repo RelationRepository
+
+	wmu sync.Mutex
+
+	mu      sync.RWMutex
+	friends map[int]map[int]struct{}
+	edges   int
+}
+
+type FriendGraphStats struct {
+	Users       int
+	Friendships int
+}
+
+var friendGraph *FriendGraph
+
+func NewFriendGraph(repo RelationRepository) *FriendGraph {
+	return &FriendGraph{repo: repo, friends: make(map[int]map[int]struct{})}
+}
+
+// Load replaces the graph with the friendships in the repository.
+func (g *FriendGraph) Load() error {
+	g.wmu.Lock()
+	defer g.wmu.Unlock()
+
+	friendships, err := g.repo.ListAll()
+	if err != nil {
+		return err
+	}
+	friends := make(map[int]map[int]struct{})
+	for _, f := range friendships {
+		if friends[f.One] == nil {
+			friends[f.One] = make(map[int]struct{})
+		}
+		friends[f.One][f.Another] = struct{}{}
+	}
+
+	g.mu.Lock()
+	g.friends, g.edges = friends, len(friendships)
+	g.mu.Unlock()
+	return nil
+}
+
+func (g *FriendGraph) link(one, another int) {
+	if g.friends[one] == nil {
+		g.friends[one] = make(map[int]struct{})
+	}
+	if _, ok := g.friends[one][another]; !ok {
+		g.friends[one][another] = struct{}{}
+		g.edges++
+	}
+}
+
+func (g *FriendGraph) unlink(one, another int) {
+	if _, ok := g.friends[one][another]; ok {
+		delete(g.friends[one], another)
+		g.edges--
+	}
+}
+
+// Create makes the two users friends in the repository and then in the graph.
+func (g *FriendGraph) Create(one, another int) error {
+	g.wmu.Lock()
+	defer g.wmu.Unlock()
+
+	if err := g.repo.Create(one, another); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	g.link(one, another)
+	g.link(another, one)
+	g.mu.Unlock()
+	return nil
+}
+
+// Delete ends the friendship in the repository and then in the graph.
+func (g *FriendGraph) Delete(one, another int) error {
+	g.wmu.Lock()
+	defer g.wmu.Unlock()
+
+	if err := g.repo.Delete(one, another); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	g.unlink(one, another)
+	g.unlink(another, one)
+	g.mu.Unlock()
+	return nil
+}
+
+func (g *FriendGraph) IsFriend(one, another int) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	_, ok := g.friends[one][another]
+	return ok
+}
+
+// Count returns the number of friends of the user.
+func (g *FriendGraph) Count(userID int) int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return len(g.friends[userID])
+}
+
+// Mutual returns the number of friends the two users have in common.
+func (g *FriendGraph) Mutual(one, another int) int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	a, b := g.friends[one], g.friends[another]
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	n := 0
+	for id := range a {
+		if _, ok := b[id]; ok {
+			n++
+		}
+	}
+	return n
+}
+
+// Adjacency returns a copy of the friends of every user who has any.
+func (g *FriendGraph) Adjacency() map[int][]int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	adjacency := make(map[int][]int, len(g.friends))
+	for userID, fs := range g.friends {
+		if len(fs) == 0 {
+			continue
+		}
+		ids := make([]int, 0, len(fs))
+		for id := range fs {
+			ids = append(ids, id)
+		}
+		adjacency[userID] = ids
+	}
+	return adjacency
+}
+
+func (g *FriendGraph) Stats() FriendGraphStats {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return FriendGraphStats{len(g.friends), g.edges / 2}
+}
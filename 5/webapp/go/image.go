@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxImagesPerEntry = 4
+	maxImageSize      = 5 << 20
+	// maxImagePixels keeps a small file from decoding into a huge bitmap.
+	maxImagePixels = 4096 * 4096
+	thumbnailSize  = 240
+)
+
+// Image is a picture attached to an entry. Its files are in imageStorage
+// under the names fileName returns.
+type Image struct {
+	ID          int
+	EntryID     int
+	UserID      int
+	ContentType string
+	Width       int
+	Height      int
+	CreatedAt   time.Time
+}
+
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// thumbnailType is the type of the thumbnail: JPEG for photos, and PNG for
+// the rest so that transparency survives.
+func (i Image) thumbnailType() string {
+	if i.ContentType == "image/jpeg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+func (i Image) fileName(thumb bool) string {
+	if thumb {
+		return strconv.Itoa(i.ID) + "_thumb" + imageExtensions[i.thumbnailType()]
+	}
+	return strconv.Itoa(i.ID) + imageExtensions[i.ContentType]
+}
+
+// ImageStorage keeps the files of images by name.
+type ImageStorage interface {
+	// Put replaces the file if there is one already.
+	Put(name string, data []byte) error
+	// Get returns ErrContentNotFound when there is no such file.
+	Get(name string) ([]byte, error)
+	// Delete does nothing when there is no such file.
+	Delete(name string) error
+}
+
+// LocalStorage keeps files in a directory. It must not be under ../static,
+// or http.FileServer would serve images of private entries to anyone.
+type LocalStorage struct {
+	dir string
+}
+
+var imageStorage ImageStorage
+
+func NewLocalStorage(dir string) (*LocalStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalStorage{dir}, nil
+}
+
+func (s *LocalStorage) path(name string) string {
+	return filepath.Join(s.dir, filepath.Base(name))
+}
+
+// Put writes to a temporary file first, so that readers never see half a file.
+func (s *LocalStorage) Put(name string, data []byte) error {
+	f, err := ioutil.TempFile(s.dir, ".upload")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path(name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s *LocalStorage) Get(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		return nil, ErrContentNotFound
+	}
+	return data, err
+}
+
+func (s *LocalStorage) Delete(name string) error {
+	if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// upload is a posted image, checked and re-encoded, waiting for its entry.
+type upload struct {
+	contentType string
+	width       int
+	height      int
+	data        []byte
+	thumb       []byte
+}
+
+// limitUploads caps the request body at what maxImagesPerEntry images and
+// the text fields can take.
+func limitUploads(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImagesPerEntry*maxImageSize+1<<20)
+}
+
+// readImages parses the form and processes the files posted as "images".
+// A form that is not multipart has no images.
+func readImages(r *http.Request) ([]upload, error) {
+	if err := r.ParseMultipartForm(1 << 20); err == http.ErrNotMultipart {
+		return nil, nil
+	} else if err != nil {
+		return nil, ErrImageTooLarge
+	}
+
+	var uploads []upload
+	for _, fh := range r.MultipartForm.File["images"] {
+		f, err := fh.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(f, maxImageSize+1))
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		// An empty file input is posted as a part without content.
+		if len(data) == 0 {
+			continue
+		}
+		if len(data) > maxImageSize {
+			return nil, ErrImageTooLarge
+		}
+		if len(uploads) == maxImagesPerEntry {
+			return nil, ErrInvalidParameter
+		}
+		u, err := processImage(data)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads, nil
+}
+
+// processImage checks the image by its content, not the name or type the
+// browser sent, and makes its thumbnail. JPEG and PNG are encoded again,
+// which drops EXIF and other metadata such as the location a photo was
+// taken at; the EXIF orientation is applied to the pixels first. GIF has no
+// EXIF and is kept as is, so that animations still play.
+func processImage(data []byte) (upload, error) {
+	u := upload{contentType: http.DetectContentType(data)}
+	if _, ok := imageExtensions[u.contentType]; !ok {
+		return u, ErrInvalidImage
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return u, ErrInvalidImage
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxImagePixels {
+		return u, ErrImageTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return u, ErrInvalidImage
+	}
+
+	var buf bytes.Buffer
+	switch u.contentType {
+	case "image/jpeg":
+		img = orient(img, jpegOrientation(data))
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	case "image/png":
+		err = png.Encode(&buf, img)
+	default:
+		_, err = buf.Write(data)
+	}
+	if err != nil {
+		return u, err
+	}
+	u.data = buf.Bytes()
+	b := img.Bounds()
+	u.width, u.height = b.Dx(), b.Dy()
+
+	var thumb bytes.Buffer
+	if u.contentType == "image/jpeg" {
+		err = jpeg.Encode(&thumb, thumbnail(img, thumbnailSize), &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&thumb, thumbnail(img, thumbnailSize))
+	}
+	u.thumb = thumb.Bytes()
+	return u, err
+}
+
+// saveImages attaches the uploads to the entry.
+func saveImages(user *User, entryID int, uploads []upload) error {
+	for _, u := range uploads {
+		img := Image{EntryID: entryID, UserID: user.ID, ContentType: u.contentType, Width: u.width, Height: u.height}
+		if err := repo.Images.Create(&img); err != nil {
+			return err
+		}
+		if err := imageStorage.Put(img.fileName(false), u.data); err != nil {
+			return err
+		}
+		if err := imageStorage.Put(img.fileName(true), u.thumb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteImages removes the images of the entry, files first, logging what
+// cannot be removed. It undoes a saveImages that failed part way.
+func deleteImages(entryID int) {
+	images, err := repo.Images.ListByEntry(entryID)
+	if err != nil {
+		log.Printf("Failed to list the images of entry %d: %s.", entryID, err.Error())
+	}
+	for _, img := range images {
+		for _, thumb := range []bool{false, true} {
+			if err := imageStorage.Delete(img.fileName(thumb)); err != nil {
+				log.Printf("Failed to delete image file %s: %s.", img.fileName(thumb), err.Error())
+			}
+		}
+	}
+	if err := repo.Images.DeleteByEntry(entryID); err != nil {
+		log.Printf("Failed to delete the images of entry %d: %s.", entryID, err.Error())
+	}
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG, 1 to 8, or 1 when
+// it has none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		marker := data[i+1]
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) {
+			break
+		}
+		if seg := data[i+4 : end]; marker == 0xe1 && len(seg) > 14 && string(seg[:6]) == "Exif\x00\x00" {
+			return exifOrientation(seg[6:])
+		}
+		i = end
+	}
+	return 1
+}
+
+// exifOrientation reads tag 0x0112 of the first IFD of the TIFF header.
+func exifOrientation(tiff []byte) int {
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 0 || ifd+2 > len(tiff) {
+		return 1
+	}
+	n := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < n; i++ {
+		e := ifd + 2 + 12*i
+		if e+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[e:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[e+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// orient turns the image the way the EXIF orientation says it should be
+// shown.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// thumbnail shrinks the image to fit in a size by size square, averaging
+// the pixels each thumbnail pixel covers. Smaller images are kept as is.
+func thumbnail(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	dw, dh := size, h*size/w
+	if h > w {
+		dw, dh = w*size/h, size
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA64(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*h/dh, (y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*w/dw, (x+1)*w/dw
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(b.Min.X+sx, b.Min.Y+sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+func GetImage(w http.ResponseWriter, r *http.Request) error {
+	return serveImage(w, r, false)
+}
+
+func GetImageThumbnail(w http.ResponseWriter, r *http.Request) error {
+	return serveImage(w, r, true)
+}
+
+// serveImage serves an image to those who may read its entry, with the same
+// errors as the entry page.
+func serveImage(w http.ResponseWriter, r *http.Request, thumb bool) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["image_id"])
+	if err != nil {
+		return ErrContentNotFound
+	}
+	img, err := repo.Images.Get(id)
+	if err != nil {
+		return err
+	}
+	if _, err := readableEntry(user, img.EntryID); err != nil {
+		return err
+	}
+	data, err := imageStorage.Get(img.fileName(thumb))
+	if err != nil {
+		return err
+	}
+
+	contentType := img.ContentType
+	if thumb {
+		contentType = img.thumbnailType()
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeContent(w, r, "", img.CreatedAt, bytes.NewReader(data))
+	return nil
+}
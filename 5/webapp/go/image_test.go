@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+type formFile struct {
+	name string
+	data []byte
+}
+
+// postImages posts the entry form with the files as its images, in order.
+func (c *testClient) postImages(path string, fields map[string]string, files ...formFile) (int, string) {
+	c.t.Helper()
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		if err := mw.WriteField(k, v); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	for _, f := range files {
+		fw, err := mw.CreateFormFile("images", f.name)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		fw.Write(f.data)
+	}
+	if err := mw.Close(); err != nil {
+		c.t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", c.srv.URL+path, &buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return c.do(req)
+}
+
+// rotatedJPEG returns a w×h JPEG with an EXIF orientation of 6, to be
+// turned a quarter clockwise, and a marker string inside the EXIF data.
+func rotatedJPEG(t *testing.T, w, h int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			img.Set(x, y, color.RGBA{uint8(x), 0, 0, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 1, 0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, 6, 0, 0, 0, 0, 0, 0, 0, 0}
+	seg := append(append([]byte("Exif\x00\x00"), tiff...), "GPSSECRET"...)
+	app1 := append([]byte{0xff, 0xe1, byte((len(seg) + 2) >> 8), byte(len(seg) + 2)}, seg...)
+	out := append(append([]byte{}, b[:2]...), app1...)
+	return append(out, b[2:]...)
+}
+
+func TestImages(t *testing.T) {
+	srv := newTestServer(t)
+	alice, bob, carol := loggedIn(t, srv, "alice"), loggedIn(t, srv, "bob"), loggedIn(t, srv, "carol")
+	befriend(alice, bob, "alice", "bob")
+
+	photo := rotatedJPEG(t, 600, 300)
+	if o := jpegOrientation(photo); o != 6 {
+		t.Fatalf("orientation %d, want 6", o)
+	}
+	var icon bytes.Buffer
+	if err := png.Encode(&icon, image.NewNRGBA(image.Rect(0, 0, 10, 10))); err != nil {
+		t.Fatal(err)
+	}
+
+	code, _ := alice.postImages("/diary/entry", map[string]string{"title": "photo", "content": "c", "visibility": "friends"},
+		formFile{"a.jpg", photo}, formFile{"b.png", icon.Bytes()})
+	wantStatus(t, "post with images", code, http.StatusSeeOther)
+	_, body := bob.get("/diary/entry/1")
+	wantBody(t, "entry", body, "/diary/image/1/thumb", "/diary/image/2/thumb")
+
+	code, data := bob.get("/diary/image/1")
+	wantStatus(t, "image", code, http.StatusOK)
+	wantNoBody(t, "image", data, "GPSSECRET", "Exif")
+	if cfg, err := jpeg.DecodeConfig(strings.NewReader(data)); err != nil || cfg.Width != 300 || cfg.Height != 600 {
+		t.Fatalf("image %+v, %v, want 300×600 after the rotation", cfg, err)
+	}
+	code, data = bob.get("/diary/image/1/thumb")
+	wantStatus(t, "thumbnail", code, http.StatusOK)
+	if cfg, err := jpeg.DecodeConfig(strings.NewReader(data)); err != nil || cfg.Width != 120 || cfg.Height != 240 {
+		t.Fatalf("thumbnail %+v, %v, want 120×240", cfg, err)
+	}
+	code, _ = carol.get("/diary/image/1")
+	wantStatus(t, "image of an entry for friends", code, http.StatusForbidden)
+
+	tests := []struct {
+		file formFile
+		want int
+	}{
+		{formFile{"x.jpg", []byte("\x89PNG\r\n\x1a\n garbage")}, http.StatusBadRequest},
+		{formFile{"x.txt", []byte("hello")}, http.StatusBadRequest},
+		{formFile{"x.jpg", make([]byte, maxImageSize+10)}, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		code, _ := alice.postImages("/diary/entry", map[string]string{"title": "bad"}, tt.file)
+		wantStatus(t, "post with "+tt.file.name, code, tt.want)
+	}
+	if l, err := repo.Entries.ListRecent(1, 1, 10); err != nil || len(l) != 1 {
+		t.Fatalf("%d entries, %v: rejected posts left entries behind", len(l), err)
+	}
+
+	code, _ = alice.postImages("/diary/entry", map[string]string{"title": "no images", "content": "x"}, formFile{"", nil})
+	wantStatus(t, "post with an empty file input", code, http.StatusSeeOther)
+
+	alice.post("/diary/entry/1/delete", nil)
+	code, _ = bob.get("/diary/image/1")
+	wantStatus(t, "image of a deleted entry", code, http.StatusNotFound)
+}
+
+// failingStorage fails every Put after the first ok ones.
+type failingStorage struct {
+	ImageStorage
+	ok int
+}
+
+func (s *failingStorage) Put(name string, data []byte) error {
+	if s.ok == 0 {
+		return errors.New("disk full")
+	}
+	s.ok--
+	return s.ImageStorage.Put(name, data)
+}
+
+var thumbRe = regexp.MustCompile(`/diary/image/(\d+)/thumb`)
+
+func TestImageStorageFailure(t *testing.T) {
+	srv := newTestServer(t)
+	alice, bob := loggedIn(t, srv, "alice"), loggedIn(t, srv, "bob")
+	befriend(alice, bob, "alice", "bob")
+	var icon bytes.Buffer
+	if err := png.Encode(&icon, image.NewNRGBA(image.Rect(0, 0, 10, 10))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The files and thumbnail of the first image are written, and the second
+	// image fails.
+	imageStorage = &failingStorage{imageStorage, 2}
+	code, _ := alice.postImages("/diary/entry", map[string]string{"title": "灯台の写真", "content": "c"},
+		formFile{"a.png", icon.Bytes()}, formFile{"b.png", icon.Bytes()})
+	wantStatus(t, "post when the storage fails", code, http.StatusInternalServerError)
+
+	if l, err := repo.Entries.ListRecent(1, 1, 10); err != nil || len(l) != 0 {
+		t.Fatalf("%d entries, %v: the failed post left its entry behind", len(l), err)
+	}
+	if l, err := repo.Images.ListByEntry(1); err != nil || len(l) != 0 {
+		t.Fatalf("%d images, %v: the failed post left its images behind", len(l), err)
+	}
+	files, err := os.ReadDir(imageStorage.(*failingStorage).ImageStorage.(*LocalStorage).dir)
+	if err != nil || len(files) != 0 {
+		t.Fatalf("%d files, %v: the failed post left its files behind", len(files), err)
+	}
+	_, body := bob.get("/")
+	wantNoBody(t, "timeline", body, "灯台の写真")
+	u, err := userCache.FromAccount("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results, err := search(u, "灯台"); err != nil || len(results) != 0 {
+		t.Fatalf("search found %+v, %v", results, err)
+	}
+
+	imageStorage = imageStorage.(*failingStorage).ImageStorage
+	code, _ = alice.postImages("/diary/entry", map[string]string{"title": "灯台の写真", "content": "c"},
+		formFile{"a.png", icon.Bytes()})
+	wantStatus(t, "post again", code, http.StatusSeeOther)
+	_, body = bob.get("/diary/entry/2")
+	m := thumbRe.FindStringSubmatch(body)
+	if m == nil {
+		t.Fatalf("entry posted again has no thumbnail: %s", body)
+	}
+	if m[1] == "1" || m[1] == "2" {
+		t.Fatalf("image %s posted again reuses the ID of a deleted image", m[1])
+	}
+	_, body = bob.get("/")
+	wantBody(t, "timeline after posting again", body, "灯台の写真")
+	code, _ = bob.get("/diary/image/" + m[1])
+	wantStatus(t, "image posted again", code, http.StatusOK)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"hash/fnv"
+	"html/template"
+	"sync"
+	"sync/atomic"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/russross/blackfriday"
+)
+
+const (
+	markdownCacheShards = 64
+	// markdownCacheSize bounds the number of entries kept rendered.
+	markdownCacheSize = 20000
+)
+
+const markdownExtensions = blackfriday.EXTENSION_NO_INTRA_EMPHASIS |
+	blackfriday.EXTENSION_TABLES |
+	blackfriday.EXTENSION_FENCED_CODE |
+	blackfriday.EXTENSION_AUTOLINK |
+	blackfriday.EXTENSION_STRIKETHROUGH |
+	blackfriday.EXTENSION_HARD_LINE_BREAK
+
+// markdownPolicy decides what of the rendered HTML reaches the page:
+// formatting, lists, tables, code, images and links, all of which get
+// rel="nofollow". Raw HTML in entries goes through it too.
+var markdownPolicy = bluemonday.UGCPolicy().RequireNoFollowOnLinks(true)
+
+// renderMarkdown turns entry content into sanitized HTML. Line breaks are
+// kept as they are, as diaries were written before Markdown was supported.
+func renderMarkdown(content string) template.HTML {
+	renderer := blackfriday.HtmlRenderer(blackfriday.HTML_USE_XHTML|blackfriday.HTML_SKIP_STYLE, "", "")
+	html := blackfriday.MarkdownOptions([]byte(content), renderer, blackfriday.Options{Extensions: markdownExtensions})
+	return template.HTML(markdownPolicy.SanitizeBytes(html))
+}
+
+// MarkdownCache keeps the rendered content of entries by ID. An entry is
+// rendered again when its content no longer has the hash it was rendered
+// from, so an edit needs no invalidation. When a shard is full an arbitrary
+// entry of it is dropped.
+type MarkdownCache struct {
+	shards [markdownCacheShards]markdownCacheShard
+
+	hits   uint64
+	misses uint64
+}
+
+type markdownCacheShard struct {
+	sync.RWMutex
+	rendered map[int]renderedEntry
+}
+
+type renderedEntry struct {
+	sum  uint64
+	html template.HTML
+}
+
+type MarkdownCacheStats struct {
+	Hits   uint64
+	Misses uint64
+	Size   int
+}
+
+var markdownCache = NewMarkdownCache()
+
+func NewMarkdownCache() *MarkdownCache {
+	c := &MarkdownCache{}
+	for i := range c.shards {
+		c.shards[i].rendered = make(map[int]renderedEntry)
+	}
+	return c
+}
+
+// Render returns the HTML of the content of entry id.
+func (c *MarkdownCache) Render(id int, content string) template.HTML {
+	h := fnv.New64a()
+	h.Write([]byte(content))
+	sum := h.Sum64()
+
+	if id < 0 {
+		id = -id
+	}
+	s := &c.shards[id%markdownCacheShards]
+	s.RLock()
+	r, ok := s.rendered[id]
+	s.RUnlock()
+	if ok && r.sum == sum {
+		atomic.AddUint64(&c.hits, 1)
+		return r.html
+	}
+	atomic.AddUint64(&c.misses, 1)
+
+	html := renderMarkdown(content)
+	s.Lock()
+	if _, ok := s.rendered[id]; !ok && len(s.rendered) >= markdownCacheSize/markdownCacheShards {
+		for k := range s.rendered {
+			delete(s.rendered, k)
+			break
+		}
+	}
+	s.rendered[id] = renderedEntry{sum, html}
+	s.Unlock()
+	return html
+}
+
+func (c *MarkdownCache) Stats() MarkdownCacheStats {
+	size := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.RLock()
+		size += len(s.rendered)
+		s.RUnlock()
+	}
+	return MarkdownCacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+		Size:   size,
+	}
+}
+
+// HTML is the content rendered from Markdown.
+func (e Entry) HTML() template.HTML {
+	return markdownCache.Render(e.ID, e.Content)
+}
+
+// HTML is the content rendered from Markdown.
+func (e LEntry) HTML() template.HTML {
+	return markdownCache.Render(e.ID, e.Content)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	NotifyComment       = "comment"
+	NotifyReply         = "reply"
+	NotifyFriendRequest = "friend_request"
+	NotifyFriendAccept  = "friend_accept"
+	NotifyFootprint     = "footprint"
+)
+
+type NotificationType struct {
+	Type  string
+	Label string
+}
+
+// notificationTypes lists the types in the order the settings show them.
+var notificationTypes = []NotificationType{
+	{NotifyComment, "日記へのコメント"},
+	{NotifyReply, "コメントへの返信"},
+	{NotifyFriendRequest, "友だち申請"},
+	{NotifyFriendAccept, "友だち申請の承認"},
+	{NotifyFootprint, "足あと"},
+}
+
+// Notification tells UserID that ActorID did something. EntryID is set for
+// comments and replies. Key, when not empty, keeps the same event from being notified
+// twice, such as visits on the same day.
+type Notification struct {
+	ID        int
+	UserID    int
+	Type      string
+	ActorID   int
+	EntryID   int
+	Key       string
+	Read      bool
+	CreatedAt time.Time
+
+	AccountName string
+	NickName    string
+	EntryTitle  string
+}
+
+// notify sends a notification unless it is about the user's own action.
+func notify(userID, actorID int, typ string, entryID int) error {
+	if userID == actorID {
+		return nil
+	}
+	return repo.Notifications.Create(Notification{UserID: userID, Type: typ, ActorID: actorID, EntryID: entryID})
+}
+
+// notifyFootprints sends one notification per visitor and day. It is called
+// by FootprintRecorder after the visits are written, off the request path, so
+// failures are only logged.
+func notifyFootprints(visits []DailyFootprint) {
+	for _, v := range visits {
+		n := Notification{
+			UserID:  v.UserID,
+			Type:    NotifyFootprint,
+			ActorID: v.OwnerID,
+			Key:     fmt.Sprintf("footprint:%d:%s", v.OwnerID, v.Date.Format("2006-01-02")),
+		}
+		if err := repo.Notifications.Create(n); err != nil {
+			log.Printf("Failed to notify footprint: %s.", err.Error())
+			return
+		}
+	}
+}
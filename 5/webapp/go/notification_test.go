@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNotifications(t *testing.T) {
+	srv := newTestServer(t)
+	alice, bob := loggedIn(t, srv, "alice"), loggedIn(t, srv, "bob")
+
+	bob.post("/friends/alice", nil)
+	_, body := alice.get("/")
+	wantBody(t, "badge", body, `id="notifications-unread">1<`)
+	alice.post("/friends/bob/accept", nil)
+	alice.post("/diary/entry", url.Values{"title": {"t1"}, "content": {"x"}})
+	bob.post("/diary/comment/1", url.Values{"comment": {"c"}})
+	alice.post("/diary/comment/1", url.Values{"comment": {"own comment"}})
+	bob.get("/profile/alice")
+	if err := footprintRecorder.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := alice.get("/notifications")
+	wantStatus(t, "notifications", code, http.StatusOK)
+	wantBody(t, "notifications", body, "友だち申請", "「t1」", "訪れました")
+	// Three unread items and the badge.
+	if n := strings.Count(body, "notifications-unread"); n != 4 {
+		t.Fatalf("%d unread markers, want 4 in\n%s", n, body)
+	}
+	_, body = bob.get("/notifications")
+	wantBody(t, "accepted request", body, "友だちになりました")
+
+	code, _ = alice.post("/notifications/1/read", nil)
+	wantStatus(t, "read one", code, http.StatusSeeOther)
+	_, body = alice.get("/")
+	wantBody(t, "badge after reading one", body, `id="notifications-unread">2<`)
+	alice.post("/notifications/read", nil)
+	_, body = alice.get("/")
+	wantNoBody(t, "badge after reading all", body, "notifications-unread")
+
+	alice.post("/notifications/settings", url.Values{"enabled": {"footprint", "friend_request", "friend_accept"}})
+	bob.post("/diary/comment/1", url.Values{"comment": {"c2"}})
+	_, body = alice.get("/")
+	wantNoBody(t, "comments turned off", body, "notifications-unread")
+	_, body = alice.get("/notifications")
+	wantBody(t, "settings", body, `value="footprint" checked`)
+	wantNoBody(t, "settings", body, `value="comment" checked`)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cursor is a position in a list ordered by (created_at, id).
+type Cursor struct {
+	CreatedAt time.Time
+	ID        int
+}
+
+func (c Cursor) String() string {
+	return fmt.Sprintf("%d-%d", c.CreatedAt.UnixNano(), c.ID)
+}
+
+func parseCursor(s string) (*Cursor, error) {
+	i := strings.IndexByte(s, '-')
+	if i < 0 {
+		return nil, ErrInvalidParameter
+	}
+	nsec, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidParameter
+	}
+	id, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return nil, ErrInvalidParameter
+	}
+	return &Cursor{time.Unix(0, nsec), id}, nil
+}
+
+// PageQuery selects up to Limit items that come right after After or right
+// before Before, in the order the list is shown. Both nil means the first
+// page. Repositories return the items in list order either way.
+type PageQuery struct {
+	After  *Cursor
+	Before *Cursor
+	Limit  int
+}
+
+// parsePageQuery reads the after and before parameters. The query fetches
+// one item more than perPage so that paginate can tell whether the list goes
+// on past the page.
+func parsePageQuery(r *http.Request, perPage int) (PageQuery, error) {
+	q := PageQuery{Limit: perPage + 1}
+	var err error
+	if s := r.FormValue("after"); s != "" {
+		if q.After, err = parseCursor(s); err != nil {
+			return q, err
+		}
+	}
+	if s := r.FormValue("before"); s != "" {
+		if q.Before, err = parseCursor(s); err != nil {
+			return q, err
+		}
+	}
+	if q.After != nil && q.Before != nil {
+		return q, ErrInvalidParameter
+	}
+	return q, nil
+}
+
+// Page holds the links to the neighbouring pages, empty when there is none.
+type Page struct {
+	Prev string
+	Next string
+}
+
+func pageLink(param string, c Cursor) string {
+	return "?" + url.Values{param: {c.String()}}.Encode()
+}
+
+// paginate drops the extra item fetched for q from the n items returned and
+// builds the links. It returns the range of the items to show.
+func paginate(q PageQuery, n int, cursorAt func(i int) Cursor) (from, to int, page Page) {
+	perPage := q.Limit - 1
+	hasPrev, hasNext := q.After != nil, q.Before != nil
+	from, to = 0, n
+	if q.Before != nil {
+		if n > perPage {
+			from, hasPrev = n-perPage, true
+		}
+	} else if n > perPage {
+		to, hasNext = perPage, true
+	}
+
+	if from == to {
+		// Nothing is left past the cursor; link back to where we came from.
+		if q.After != nil {
+			page.Prev = pageLink("before", *q.After)
+		}
+		if q.Before != nil {
+			page.Next = pageLink("after", *q.Before)
+		}
+		return
+	}
+	if hasPrev {
+		page.Prev = pageLink("before", cursorAt(from))
+	}
+	if hasNext {
+		page.Next = pageLink("after", cursorAt(to-1))
+	}
+	return
+}
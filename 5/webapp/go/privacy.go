@@ -0,0 +1,284 @@
+package main
+
+import "github.com/go-sql-driver/mysql"
+
+// Visibility says who may see something.
+type Visibility string
+
+const (
+	VisibleEveryone         Visibility = "everyone"
+	VisibleFriendsOfFriends Visibility = "friends_of_friends"
+	VisibleFriends          Visibility = "friends"
+	VisibleList             Visibility = "list"
+	VisibleOnlyMe           Visibility = "me"
+)
+
+type VisibilityChoice struct {
+	Visibility Visibility
+	Label      string
+}
+
+// visibilities lists the choices for profiles in the order the settings
+// show them.
+var visibilities = []VisibilityChoice{
+	{VisibleEveryone, "全員"},
+	{VisibleFriends, "友だちのみ"},
+	{VisibleOnlyMe, "自分のみ"},
+}
+
+// entryVisibilities lists the choices for entries, which can also be shown
+// to friends of friends or to the friends in one of the author's lists.
+var entryVisibilities = []VisibilityChoice{
+	{VisibleEveryone, "全員"},
+	{VisibleFriendsOfFriends, "友だちの友だち"},
+	{VisibleFriends, "友だちのみ"},
+	{VisibleList, "リストのメンバーのみ"},
+	{VisibleOnlyMe, "自分のみ"},
+}
+
+func (v Visibility) in(choices []VisibilityChoice) bool {
+	for _, c := range choices {
+		if c.Visibility == v {
+			return true
+		}
+	}
+	return false
+}
+
+func validVisibility(v Visibility) bool {
+	return v.in(visibilities)
+}
+
+func (v Visibility) Label() string {
+	for _, c := range entryVisibilities {
+		if c.Visibility == v {
+			return c.Label
+		}
+	}
+	return string(v)
+}
+
+// viewer is how the one looking at something is related to its owner.
+type viewer int
+
+const (
+	viewerStranger viewer = iota
+	viewerFriendOfFriend
+	viewerFriend
+	viewerSelf
+)
+
+// viewAs maps the view_as parameter of the profile preview to the viewer
+// it shows the profile to.
+var viewAs = map[string]viewer{
+	"stranger": viewerStranger,
+	"friend":   viewerFriend,
+}
+
+// viewerOf returns how userID is related to ownerID.
+func viewerOf(userID, ownerID int) (viewer, error) {
+	if userID == ownerID {
+		return viewerSelf, nil
+	}
+	ok, err := isFriend(userID, ownerID)
+	if err != nil {
+		return viewerStranger, err
+	}
+	if ok {
+		return viewerFriend, nil
+	}
+	if friendGraph.Mutual(userID, ownerID) > 0 {
+		return viewerFriendOfFriend, nil
+	}
+	return viewerStranger, nil
+}
+
+// visibleTo tells whether the viewer may see what has the visibility.
+// VisibleList needs the list too, so it is only visible to the owner here;
+// see Audience.readableBy.
+func (v Visibility) visibleTo(w viewer) bool {
+	switch v {
+	case VisibleEveryone:
+		return true
+	case VisibleFriendsOfFriends:
+		return w >= viewerFriendOfFriend
+	case VisibleFriends:
+		return w >= viewerFriend
+	}
+	return w == viewerSelf
+}
+
+// Audience is who may read an entry. ListID is the friend list of the
+// author the entry is shared with, and is only set for VisibleList.
+type Audience struct {
+	Visibility Visibility
+	ListID     int
+}
+
+// Private tells whether anyone but everyone may read the entry, as the
+// private flag did before visibility levels.
+func (a Audience) Private() bool {
+	return a.Visibility != VisibleEveryone
+}
+
+// readableBy tells whether the user, related to the author as w, may read
+// the entry. A list is only for those in it who are still friends of the
+// author. Blocks are checked separately. The repositories apply the same
+// rule when listing entries for a user.
+func (a Audience) readableBy(userID int, w viewer) (bool, error) {
+	if a.Visibility != VisibleList || w != viewerFriend {
+		return a.Visibility.visibleTo(w), nil
+	}
+	return repo.FriendLists.IsMember(a.ListID, userID)
+}
+
+// canRead tells whether the user may read the entry, leaving out blocks.
+func canRead(userID int, entry *Entry) (bool, error) {
+	w, err := viewerOf(userID, entry.UserID)
+	if err != nil {
+		return false, err
+	}
+	return entry.readableBy(userID, w)
+}
+
+// entryAudience checks the audience the author picked for an entry. Forms
+// and clients that predate visibility levels send the private flag instead.
+func entryAudience(user *User, visibility string, listID int, private bool) (Audience, error) {
+	v := Visibility(visibility)
+	if v == "" {
+		v = VisibleEveryone
+		if private {
+			v = VisibleFriends
+		}
+	}
+	if !v.in(entryVisibilities) {
+		return Audience{}, ErrInvalidParameter
+	}
+	if v != VisibleList {
+		return Audience{Visibility: v}, nil
+	}
+	list, err := repo.FriendLists.Get(listID)
+	if err == ErrContentNotFound || (err == nil && list.UserID != user.ID) {
+		return Audience{}, ErrInvalidParameter
+	}
+	if err != nil {
+		return Audience{}, err
+	}
+	return Audience{v, list.ID}, nil
+}
+
+// ProfileVisibility says who may see each column of a profile, and the
+// email address of the user.
+type ProfileVisibility struct {
+	FirstName Visibility
+	LastName  Visibility
+	Sex       Visibility
+	Birthday  Visibility
+	Pref      Visibility
+	Email     Visibility
+}
+
+// defaultProfileVisibility is what profiles showed before the settings
+// existed: names to everyone, and the rest to friends.
+var defaultProfileVisibility = ProfileVisibility{
+	FirstName: VisibleEveryone,
+	LastName:  VisibleEveryone,
+	Sex:       VisibleFriends,
+	Birthday:  VisibleFriends,
+	Pref:      VisibleFriends,
+	Email:     VisibleFriends,
+}
+
+func (p ProfileVisibility) valid() bool {
+	for _, v := range []Visibility{p.FirstName, p.LastName, p.Sex, p.Birthday, p.Pref, p.Email} {
+		if !validVisibility(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// VisibilityField is a row of the visibility settings form.
+type VisibilityField struct {
+	Label string
+	Name  string
+	Value Visibility
+}
+
+func (p ProfileVisibility) fields() []VisibilityField {
+	return []VisibilityField{
+		{"名字", "last_name", p.LastName},
+		{"名前", "first_name", p.FirstName},
+		{"性別", "sex", p.Sex},
+		{"誕生日", "birthday", p.Birthday},
+		{"住んでいる県", "pref", p.Pref},
+		{"メールアドレス", "email", p.Email},
+	}
+}
+
+// ProfileFields tells which fields of a profile are shown.
+type ProfileFields struct {
+	FirstName bool
+	LastName  bool
+	Sex       bool
+	Birthday  bool
+	Pref      bool
+	Email     bool
+}
+
+func (p ProfileVisibility) shownTo(w viewer) ProfileFields {
+	return ProfileFields{
+		FirstName: p.FirstName.visibleTo(w),
+		LastName:  p.LastName.visibleTo(w),
+		Sex:       p.Sex.visibleTo(w),
+		Birthday:  p.Birthday.visibleTo(w),
+		Pref:      p.Pref.visibleTo(w),
+		Email:     p.Email.visibleTo(w),
+	}
+}
+
+// hidden returns the names of the fields that are not shown, as in the
+// profiles table.
+func (f ProfileFields) hidden() []string {
+	hidden := []string{}
+	for _, c := range []struct {
+		shown bool
+		name  string
+	}{
+		{f.FirstName, "first_name"},
+		{f.LastName, "last_name"},
+		{f.Sex, "sex"},
+		{f.Birthday, "birthday"},
+		{f.Pref, "pref"},
+		{f.Email, "email"},
+	} {
+		if !c.shown {
+			hidden = append(hidden, c.name)
+		}
+	}
+	return hidden
+}
+
+// redact clears the fields that are not shown, so that they cannot leak
+// through a template or JSON view that forgets to check.
+func (f ProfileFields) redact(p Profile, u User) (Profile, User) {
+	if !f.FirstName {
+		p.FirstName = ""
+	}
+	if !f.LastName {
+		p.LastName = ""
+	}
+	if !f.Sex {
+		p.Sex = ""
+	}
+	if !f.Birthday {
+		p.Birthday = mysql.NullTime{}
+	}
+	if !f.Pref {
+		p.Pref = ""
+	}
+	if !f.Email {
+		u.Email = ""
+	}
+	return p, u
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// visibilityReaders are the users of visibilityFixture, each related to
+// alice, the author, in another way. Reader 0 is nobody in particular.
+var visibilityReaders = []struct {
+	name string
+	// readable are the titles of the entries of alice the reader may read.
+	readable []string
+	// friend tells whether the entries and comments of alice are delivered
+	// to the timeline and comment feed of the reader.
+	friend bool
+}{
+	{"alice", []string{"everyone", "friends_of_friends", "friends", "list", "list:carol", "me"}, false},
+	{"bob", []string{"everyone", "friends_of_friends", "friends", "list"}, true},
+	{"carol", []string{"everyone", "friends_of_friends", "friends", "list:carol"}, true},
+	{"dave", []string{"everyone", "friends_of_friends"}, false},
+	{"erin", []string{"everyone"}, false},
+	{"frank", []string{"everyone"}, false},
+	{"", []string{"everyone"}, false},
+}
+
+// visibilityFixture writes, through r, an entry of alice for every
+// visibility, commented on by alice herself. bob and carol are friends of
+// alice in one list each, dave is a friend of bob, erin is a stranger and
+// frank is in the list of bob but no longer a friend. It returns the IDs of
+// the users by name and the titles of the entries by ID.
+func visibilityFixture(t *testing.T, r *Repository) (map[string]int, map[int]string) {
+	t.Helper()
+
+	ids := make(map[string]int)
+	for _, name := range []string{"alice", "bob", "carol", "dave", "erin", "frank"} {
+		u := testUser(0, name)
+		if err := r.Users.Create(&u); err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = u.ID
+	}
+	alice := ids["alice"]
+	for _, f := range [][2]string{{"alice", "bob"}, {"alice", "carol"}, {"bob", "dave"}, {"alice", "frank"}} {
+		if err := r.Relations.Create(ids[f[0]], ids[f[1]]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lists := make(map[string]int)
+	for _, member := range []string{"bob", "carol"} {
+		id, err := r.FriendLists.Create(alice, member)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.FriendLists.AddMember(id, ids[member]); err != nil {
+			t.Fatal(err)
+		}
+		lists[member] = id
+	}
+	if err := r.FriendLists.AddMember(lists["bob"], ids["frank"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Relations.Delete(alice, ids["frank"]); err != nil {
+		t.Fatal(err)
+	}
+
+	titles := make(map[int]string)
+	for _, a := range []struct {
+		title string
+		Audience
+	}{
+		{"everyone", Audience{Visibility: VisibleEveryone}},
+		{"friends_of_friends", Audience{Visibility: VisibleFriendsOfFriends}},
+		{"friends", Audience{Visibility: VisibleFriends}},
+		{"list", Audience{VisibleList, lists["bob"]}},
+		{"list:carol", Audience{VisibleList, lists["carol"]}},
+		{"me", Audience{Visibility: VisibleOnlyMe}},
+	} {
+		id, err := r.Entries.Create(alice, a.Audience, a.title, "content")
+		if err != nil {
+			t.Fatal(err)
+		}
+		titles[id] = a.title
+		if err := r.Timelines.Push(id); err != nil {
+			t.Fatal(err)
+		}
+		cid, err := r.Comments.Create(Comment{EntryID: id, UserID: alice, Comment: "comment"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Feeds.Push(cid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ids, titles
+}
+
+// visibilityListings returns, for every reader and every method that leaves
+// out what the reader may not read, the sorted titles of the entries found.
+// Entries written in the same second have no order in MySQL, so only the
+// sets are compared.
+func visibilityListings(t *testing.T, r *Repository) map[string][]string {
+	t.Helper()
+
+	ids, titles := visibilityFixture(t, r)
+	listings := make(map[string][]string)
+	add := func(reader, method string, entryIDs []int) {
+		l := []string{}
+		for _, id := range entryIDs {
+			l = append(l, titles[id])
+		}
+		sort.Strings(l)
+		listings[reader+" "+method] = l
+	}
+	for _, reader := range visibilityReaders {
+		readerID := ids[reader.name]
+		name := reader.name
+		if readerID == 0 {
+			name = "nobody"
+		}
+		var entryIDs []int
+
+		l, err := r.Entries.ListByUser(ids["alice"], readerID, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range l {
+			entryIDs = append(entryIDs, e.ID)
+		}
+		add(name, "ListByUser", entryIDs)
+
+		l, err = r.Entries.ListRecent(ids["alice"], readerID, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entryIDs = nil
+		for _, e := range l {
+			entryIDs = append(entryIDs, e.ID)
+		}
+		add(name, "ListRecent", entryIDs)
+
+		counted, err := r.Entries.ListWithCommentCount(ids["alice"], readerID, PageQuery{Limit: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entryIDs = nil
+		for _, e := range counted {
+			entryIDs = append(entryIDs, e.ID)
+		}
+		add(name, "ListWithCommentCount", entryIDs)
+
+		if readerID == 0 {
+			continue
+		}
+		timeline, err := r.Timelines.List(readerID, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entryIDs = nil
+		for _, e := range timeline {
+			entryIDs = append(entryIDs, e.ID)
+		}
+		add(name, "Timelines.List", entryIDs)
+
+		feed, err := r.Feeds.List(readerID, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entryIDs = nil
+		for _, c := range feed {
+			entryIDs = append(entryIDs, c.EntryID)
+		}
+		add(name, "Feeds.List", entryIDs)
+	}
+	return listings
+}
+
+// TestEntryVisibility checks every visibility against every way a reader can
+// be related to the author, in the in-memory repository and, when
+// ISUCON5_TEST_DSN is set, in the MySQL one too, which must return the same
+// entries.
+func TestEntryVisibility(t *testing.T) {
+	memory := visibilityListings(t, NewMemoryRepository())
+	for _, reader := range visibilityReaders {
+		name := reader.name
+		if name == "" {
+			name = "nobody"
+		}
+		want := append([]string{}, reader.readable...)
+		sort.Strings(want)
+		delivered := []string{}
+		if reader.friend {
+			delivered = want
+		}
+		methods := map[string][]string{"ListByUser": want, "ListRecent": want, "ListWithCommentCount": want}
+		if reader.name != "" {
+			methods["Timelines.List"] = delivered
+			methods["Feeds.List"] = delivered
+		}
+		for method, want := range methods {
+			key := name + " " + method
+			if got := memory[key]; !reflect.DeepEqual(got, want) {
+				t.Errorf("memory: %s: got %q, want %q", key, got, want)
+			}
+		}
+	}
+
+	t.Run("mysql", func(t *testing.T) {
+		mysql := visibilityListings(t, NewMySQLRepository(testMySQL(t)))
+		keys := make([]string, 0, len(memory))
+		for key := range memory {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if got, want := mysql[key], memory[key]; !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: MySQL found %q, memory %q", key, got, want)
+			}
+		}
+	})
+}
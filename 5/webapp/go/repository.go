@@ -0,0 +1,287 @@
+package main
+
+import "time"
+
+// Repository bundles the stores the handlers read and write through.
+// NewMySQLRepository is used in production; NewMemoryRepository lets the
+// handlers run under httptest without a database.
+type Repository struct {
+	Users         UserRepository
+	Profiles      ProfileRepository
+	Entries       EntryRepository
+	Comments      CommentRepository
+	Relations     RelationRepository
+	Requests      FriendRequestRepository
+	Blocks        BlockRepository
+	Timelines     TimelineRepository
+	Feeds         CommentFeedRepository
+	Footprints    FootprintRepository
+	Notifications NotificationRepository
+	Tokens        TokenRepository
+	FeedTokens    FeedTokenRepository
+	Images        ImageRepository
+	Suggestions   SuggestionRepository
+	FriendLists   FriendListRepository
+}
+
+var repo *Repository
+
+type UserRepository interface {
+	All() ([]User, error)
+	// FindByID, FindByAccount and FindByEmail return ErrContentNotFound
+	// when there is no such user.
+	FindByID(id int) (*User, error)
+	FindByAccount(name string) (*User, error)
+	FindByEmail(email string) (*User, error)
+	FindByNickName(name string) (*User, error)
+	// Create inserts the user together with an empty profile and sets
+	// user.ID. It returns ErrUserExists when the account name or email is
+	// already taken.
+	Create(user *User) error
+}
+
+type ProfileRepository interface {
+	// Get returns an empty profile for users who have never set one.
+	Get(userID int) (Profile, error)
+	Update(userID int, firstName, lastName, sex, birthday, pref string) error
+	// Visibility returns defaultProfileVisibility for users who have never
+	// changed it.
+	Visibility(userID int) (ProfileVisibility, error)
+	SetVisibility(userID int, v ProfileVisibility) error
+	// ListPrefectures returns the prefecture of every user who has set one.
+	ListPrefectures() (map[int]string, error)
+	// Initialize resets the visibility settings; profiles are left alone.
+	Initialize() error
+}
+
+// Deleted entries and comments are kept with deleted_at set; every method
+// below except Initialize treats them as if they did not exist.
+//
+// Methods that take a readerID leave out the entries that user may not read,
+// by the same rule as Audience.readableBy; blocks are not checked. Reader 0
+// is nobody in particular, who can only read entries for everyone.
+
+type EntryRepository interface {
+	// Get returns ErrContentNotFound when the entry does not exist.
+	Get(id int) (*Entry, error)
+	// ListByUser returns the oldest entries of the user.
+	ListByUser(userID, readerID int, limit int) ([]Entry, error)
+	// ListRecent returns the newest entries of the user.
+	ListRecent(userID, readerID int, limit int) ([]Entry, error)
+	// ListByIDs returns the entries that still exist, in no particular order.
+	ListByIDs(ids []int) ([]Entry, error)
+	// ListAfter returns entries with IDs greater than afterID in ID order,
+	// for walking the whole table.
+	ListAfter(afterID int, limit int) ([]Entry, error)
+	// ListWithCommentCount returns entries of the user, newest first.
+	ListWithCommentCount(userID, readerID int, q PageQuery) ([]LEntry, error)
+	Create(userID int, audience Audience, title, content string) (int, error)
+	Update(id int, audience Audience, title, content string) error
+	Delete(id int) error
+	Initialize() error
+}
+
+type CommentRepository interface {
+	// Get returns ErrContentNotFound when the comment does not exist.
+	Get(id int) (*Comment, error)
+	// ListByEntry returns top-level comments on the entry, oldest first.
+	// Comments that are deleted, or by commenters the entry owner has
+	// blocked, are left out unless their thread has replies to show, and
+	// are marked Deleted.
+	ListByEntry(entryID int, q PageQuery) ([]EComment, error)
+	// ListReplies returns the replies in the threads, oldest first, marking
+	// those ListByEntry would leave out as Deleted.
+	ListReplies(threadIDs []int) ([]EComment, error)
+	// ListForOwner returns the newest comments on entries of the user,
+	// leaving out commenters the user has blocked.
+	ListForOwner(userID int, limit int) ([]IComment, error)
+	// ListByIDs and ListAfter are the same as for entries.
+	ListByIDs(ids []int) ([]Comment, error)
+	ListAfter(afterID int, limit int) ([]Comment, error)
+	Create(c Comment) (int, error)
+	Delete(id int) error
+	Initialize() error
+}
+
+type RelationRepository interface {
+	IsFriend(one, another int) (bool, error)
+	Count(userID int) (int, error)
+	// ListFriends returns friends of the user, newest friendship first.
+	ListFriends(userID int, q PageQuery) ([]FFriend, error)
+	// ListAll returns every friendship, once in each direction.
+	ListAll() ([]Friendship, error)
+	// Create makes the two users friends of each other.
+	Create(one, another int) error
+	// Delete removes the friendship in both directions.
+	Delete(one, another int) error
+	Initialize() error
+}
+
+type FriendRequestRepository interface {
+	// Create records a request from one user to another. Sending the same
+	// request twice is not an error.
+	Create(from, to int) error
+	Exists(from, to int) (bool, error)
+	// Delete removes the request and reports whether there was one.
+	Delete(from, to int) (bool, error)
+	// ListIncoming and ListOutgoing return pending requests, newest first.
+	ListIncoming(userID int) ([]FFriend, error)
+	ListOutgoing(userID int) ([]FFriend, error)
+	Initialize() error
+}
+
+type BlockRepository interface {
+	Create(userID, blockedID int) error
+	Delete(userID, blockedID int) error
+	// IsBlocked reports whether userID has blocked blockedID.
+	IsBlocked(userID, blockedID int) (bool, error)
+	// Between reports whether either of the users has blocked the other.
+	Between(one, another int) (bool, error)
+	// List returns the users blocked by userID, newest first.
+	List(userID int) ([]FFriend, error)
+	Initialize() error
+}
+
+// TimelineRepository keeps, for every user, the entries written by their
+// friends, so that the index page does not have to join relations against
+// entries. Entries are delivered whoever may read them, as that can change
+// after they are delivered.
+type TimelineRepository interface {
+	// Push delivers a new entry to the timelines of the author's friends.
+	Push(entryID int) error
+	// Connect adds the latest entries of each user to the other's timeline.
+	Connect(one, another int) error
+	// Disconnect removes entries of each user from the other's timeline.
+	Disconnect(one, another int) error
+	// List returns the newest entries on the timeline of the user, leaving
+	// out those the user may not read.
+	List(userID int, limit int) ([]IEntry, error)
+	// Rebuild recreates the timeline of the user from relations and entries.
+	Rebuild(userID int) error
+	// Initialize drops timeline rows of entries and friendships removed by
+	// the other Initialize methods, so it has to run after them.
+	Initialize() error
+}
+
+// CommentFeedRepository keeps, for every user, the comments written by their
+// friends. Whether a comment may be shown depends on the user being able to
+// read its entry, which can change after the comment is delivered, so List
+// checks that when reading.
+type CommentFeedRepository interface {
+	// Push delivers a new comment to the feeds of the commenter's friends.
+	Push(commentID int) error
+	// Connect adds the newest comments of each user to the other's feed.
+	Connect(one, another int) error
+	// Disconnect removes comments of each user from the other's feed.
+	Disconnect(one, another int) error
+	// List returns the newest comments on the feed of the user, leaving out
+	// comments on entries the user may not read, or whose author and the
+	// user have blocked one another.
+	List(userID int, limit int) ([]FriendComment, error)
+	// Rebuild recreates the feed of the user from relations and comments.
+	Rebuild(userID int) error
+	// Initialize has to run after the other Initialize methods, as with
+	// TimelineRepository.
+	Initialize() error
+}
+
+// FootprintRepository keeps one row per visited user, visitor and day.
+type FootprintRepository interface {
+	// Record adds the visits, keeping the latest one when the row for the
+	// day is already there.
+	Record(visits []DailyFootprint) error
+	// ListDaily returns the latest visit per visitor and day, newest first,
+	// leaving out visitors the user has blocked.
+	// The cursor is the time of that visit and the ID of the row.
+	ListDaily(userID int, q PageQuery) ([]FFootprint, error)
+	// ListSince returns every visit on or after the day of since.
+	ListSince(since time.Time) ([]DailyFootprint, error)
+	Initialize() error
+}
+
+// TokenRepository keeps API tokens by their SHA-256 hash, so that a leaked
+// table does not leak the tokens.
+type TokenRepository interface {
+	Create(hash string, userID int) error
+	// Find returns the ID of the user the token was issued to, or
+	// ErrInvalidToken when there is no such token.
+	Find(hash string) (int, error)
+	Delete(hash string) error
+	Initialize() error
+}
+
+// FeedTokenRepository keeps the secret in the URL of each user's friends
+// feed. Unlike API tokens it is kept as is, so that it can be shown again.
+type FeedTokenRepository interface {
+	// Get returns "" when the user has no token yet.
+	Get(userID int) (string, error)
+	// Set replaces the token of the user, invalidating the old URL.
+	Set(userID int, token string) error
+	// FindUser returns ErrContentNotFound when no user has the token.
+	FindUser(token string) (int, error)
+	Initialize() error
+}
+
+// ImageRepository keeps the images attached to entries; the files
+// themselves are in an ImageStorage.
+type ImageRepository interface {
+	// Get returns ErrContentNotFound when there is no such image.
+	Get(id int) (*Image, error)
+	// ListByEntry returns the images of the entry in the order they were
+	// attached.
+	ListByEntry(entryID int) ([]Image, error)
+	// Create inserts the image and sets image.ID.
+	Create(image *Image) error
+	// DeleteByEntry removes the images of the entry, for an entry that is
+	// deleted again because one of its images could not be saved.
+	DeleteByEntry(entryID int) error
+	Initialize() error
+}
+
+// SuggestionRepository keeps the friend suggestions users have dismissed.
+type SuggestionRepository interface {
+	// Dismiss keeps dismissedID out of the suggestions for userID.
+	// Dismissing twice is not an error.
+	Dismiss(userID, dismissedID int) error
+	ListDismissed(userID int) ([]int, error)
+	Initialize() error
+}
+
+// FriendListRepository keeps the lists users sort their friends into, to
+// share entries with some of them only.
+type FriendListRepository interface {
+	// Get returns ErrContentNotFound when there is no such list.
+	Get(id int) (*FriendList, error)
+	// ListByUser returns the lists of the user, oldest first.
+	ListByUser(userID int) ([]FriendList, error)
+	// Create makes an empty list and returns its ID.
+	Create(userID int, name string) (int, error)
+	// Delete removes the list and its members. Entries shared with it are
+	// then for their author only.
+	Delete(id int) error
+	// Members returns the members of the list, newest first.
+	Members(id int) ([]FFriend, error)
+	// AddMember adds the user to the list; adding twice is not an error.
+	AddMember(id, userID int) error
+	RemoveMember(id, userID int) error
+	IsMember(id, userID int) (bool, error)
+	Initialize() error
+}
+
+type NotificationRepository interface {
+	// Create stores the notification unless the recipient has opted out of
+	// its type or already has one with the same non-empty Key.
+	Create(n Notification) error
+	// List returns the notifications of the user, newest first, leaving out
+	// those from users the user has blocked.
+	List(userID int, q PageQuery) ([]Notification, error)
+	// CountUnread counts unread notifications as List does, up to limit.
+	CountUnread(userID int, limit int) (int, error)
+	// MarkRead marks a notification of the user as read; ID 0 marks all.
+	// Notifications that are not the user's are left alone.
+	MarkRead(userID, id int) error
+	// OptOuts returns the types the user has turned off.
+	OptOuts(userID int) (map[string]bool, error)
+	SetOptOuts(userID int, types []string) error
+	Initialize() error
+}
@@ -0,0 +1,1698 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// NewMemoryRepository returns a Repository backed by maps and slices, which
+// behaves like the MySQL one for the given users.
+func NewMemoryRepository(users ...User) *Repository {
+	s := &memoryStore{
+		users:           make(map[int]User),
+		profiles:        make(map[int]Profile),
+		visibilities:    make(map[int]ProfileVisibility),
+		dismissals:      make(map[int]map[int]bool),
+		deletedEntries:  make(map[int]time.Time),
+		deletedComments: make(map[int]time.Time),
+		optOuts:         make(map[int]map[string]bool),
+		tokens:          make(map[string]int),
+		feedTokens:      make(map[int]string),
+	}
+	for _, u := range users {
+		s.users[u.ID] = u
+		s.profiles[u.ID] = Profile{UserID: u.ID}
+	}
+
+	return &Repository{
+		Users:         &memoryUserRepository{s},
+		Profiles:      &memoryProfileRepository{s},
+		Entries:       &memoryEntryRepository{s},
+		Comments:      &memoryCommentRepository{s},
+		Relations:     &memoryRelationRepository{s},
+		Requests:      &memoryFriendRequestRepository{s},
+		Blocks:        &memoryBlockRepository{s},
+		Timelines:     &memoryTimelineRepository{s},
+		Feeds:         &memoryCommentFeedRepository{s},
+		Footprints:    &memoryFootprintRepository{s},
+		Notifications: &memoryNotificationRepository{s},
+		Tokens:        &memoryTokenRepository{s},
+		FeedTokens:    &memoryFeedTokenRepository{s},
+		Images:        &memoryImageRepository{s},
+		Suggestions:   &memorySuggestionRepository{s},
+		FriendLists:   &memoryFriendListRepository{s},
+	}
+}
+
+type memoryRelation struct {
+	ID        int
+	One       int
+	Another   int
+	CreatedAt time.Time
+}
+
+// memoryEdge is a row of friend_requests or blocks, from one user to another,
+// or of friend_list_members, from a list to a user.
+type memoryEdge struct {
+	ID        int
+	From      int
+	To        int
+	CreatedAt time.Time
+}
+
+type memoryTimeline struct {
+	UserID    int
+	EntryID   int
+	AuthorID  int
+	CreatedAt time.Time
+}
+
+type memoryCommentFeed struct {
+	UserID      int
+	CommentID   int
+	CommenterID int
+	CreatedAt   time.Time
+}
+
+// memoryFootprint is a row of daily_footprints.
+type memoryFootprint struct {
+	ID      int
+	UserID  int
+	OwnerID int
+	Date    time.Time
+	Updated time.Time
+}
+
+// memoryStore holds every table so that the repositories can join them.
+type memoryStore struct {
+	sync.RWMutex
+
+	users      map[int]User
+	profiles   map[int]Profile
+	entries    []Entry
+	comments   []Comment
+	relations  []memoryRelation
+	requests   []memoryEdge
+	blocks     []memoryEdge
+	timelines  []memoryTimeline
+	feeds      []memoryCommentFeed
+	footprints []memoryFootprint
+
+	// notifications are kept without the joined columns; optOuts maps a user
+	// to the types turned off.
+	notifications []Notification
+	optOuts       map[int]map[string]bool
+
+	// tokens maps the hash of an API token to its user; feedTokens maps a
+	// user to the token of their friends feed.
+	tokens     map[string]int
+	feedTokens map[int]string
+
+	// lastImageID is the AUTO_INCREMENT of entry_images, which does not
+	// reuse the IDs of deleted images.
+	images      []Image
+	lastImageID int
+
+	// visibilities holds the profile settings of users who have changed them.
+	visibilities map[int]ProfileVisibility
+	// dismissals maps a user to the suggestions they have dismissed.
+	dismissals map[int]map[int]bool
+
+	friendLists []FriendList
+	listMembers []memoryEdge
+
+	// deletedEntries and deletedComments hold deleted_at of soft deleted rows.
+	deletedEntries  map[int]time.Time
+	deletedComments map[int]time.Time
+}
+
+// entry returns the entry unless it does not exist or has been deleted.
+func (s *memoryStore) entry(id int) (Entry, bool) {
+	if _, ok := s.deletedEntries[id]; ok {
+		return Entry{}, false
+	}
+	for _, e := range s.entries {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+func (s *memoryStore) liveEntry(e Entry) bool {
+	_, deleted := s.deletedEntries[e.ID]
+	return !deleted
+}
+
+func (s *memoryStore) liveComment(c Comment) bool {
+	_, deleted := s.deletedComments[c.ID]
+	return !deleted
+}
+
+func (s *memoryStore) isBlocked(userID, blockedID int) bool {
+	for _, b := range s.blocks {
+		if b.From == userID && b.To == blockedID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryStore) isFriend(one, another int) bool {
+	for _, r := range s.relations {
+		if r.One == one && r.Another == another {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryStore) isMember(listID, userID int) bool {
+	for _, m := range s.listMembers {
+		if m.From == listID && m.To == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// readable is readableBy of the MySQL repository: whether the user may read
+// the entry.
+func (s *memoryStore) readable(e Entry, userID int) bool {
+	if e.UserID == userID {
+		return true
+	}
+	switch e.Visibility {
+	case VisibleEveryone:
+		return true
+	case VisibleFriends:
+		return s.isFriend(userID, e.UserID)
+	case VisibleFriendsOfFriends:
+		if s.isFriend(userID, e.UserID) {
+			return true
+		}
+		for _, r := range s.relations {
+			if r.One == userID && s.isFriend(r.Another, e.UserID) {
+				return true
+			}
+		}
+	case VisibleList:
+		return s.isFriend(userID, e.UserID) && s.isMember(e.ListID, userID)
+	}
+	return false
+}
+
+// newer orders by created_at DESC, breaking ties by insertion order.
+func newer(a, b time.Time, aID, bID int) bool {
+	if !a.Equal(b) {
+		return a.After(b)
+	}
+	return aID > bID
+}
+
+// pageRange returns the part of n items, sorted in list order, that q
+// selects. desc tells whether the list is ordered newest first.
+func pageRange(q PageQuery, n int, cursorAt func(i int) Cursor, desc bool) (from, to int) {
+	precedes := func(a, b Cursor) bool {
+		if desc {
+			return newer(a.CreatedAt, b.CreatedAt, a.ID, b.ID)
+		}
+		return newer(b.CreatedAt, a.CreatedAt, b.ID, a.ID)
+	}
+
+	from, to = 0, n
+	if q.After != nil {
+		for from < n && !precedes(*q.After, cursorAt(from)) {
+			from++
+		}
+	}
+	if q.Before != nil {
+		for to > from && !precedes(cursorAt(to-1), *q.Before) {
+			to--
+		}
+		if to-from > q.Limit {
+			from = to - q.Limit
+		}
+	} else if to-from > q.Limit {
+		to = from + q.Limit
+	}
+	return from, to
+}
+
+// truncateDate is DATE() in the local time zone, as with loc=Local in the DSN.
+func truncateDate(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+type memoryUserRepository struct {
+	s *memoryStore
+}
+
+func (r *memoryUserRepository) All() ([]User, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	users := make([]User, 0, len(r.s.users))
+	for _, u := range r.s.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (r *memoryUserRepository) find(match func(User) bool) (*User, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	for _, u := range r.s.users {
+		if match(u) {
+			return &u, nil
+		}
+	}
+	return nil, ErrContentNotFound
+}
+
+func (r *memoryUserRepository) FindByID(id int) (*User, error) {
+	return r.find(func(u User) bool { return u.ID == id })
+}
+
+func (r *memoryUserRepository) FindByAccount(name string) (*User, error) {
+	return r.find(func(u User) bool { return u.AccountName == name })
+}
+
+func (r *memoryUserRepository) FindByEmail(email string) (*User, error) {
+	return r.find(func(u User) bool { return u.Email == email })
+}
+
+func (r *memoryUserRepository) FindByNickName(name string) (*User, error) {
+	return r.find(func(u User) bool { return u.NickName == name })
+}
+
+func (r *memoryUserRepository) Create(user *User) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	id := 1
+	for _, u := range r.s.users {
+		if u.AccountName == user.AccountName || u.Email == user.Email {
+			return ErrUserExists
+		}
+		if u.ID >= id {
+			id = u.ID + 1
+		}
+	}
+	user.ID = id
+	r.s.users[id] = *user
+	r.s.profiles[id] = Profile{UserID: id}
+	return nil
+}
+
+type memoryProfileRepository struct {
+	s *memoryStore
+}
+
+func (r *memoryProfileRepository) Get(userID int) (Profile, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	return r.s.profiles[userID], nil
+}
+
+func (r *memoryProfileRepository) Update(userID int, firstName, lastName, sex, birthday, pref string) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	if _, ok := r.s.profiles[userID]; !ok {
+		return nil
+	}
+	prof := Profile{UserID: userID, FirstName: firstName, LastName: lastName, Sex: sex, Pref: pref, UpdatedAt: time.Now()}
+	if t, err := time.ParseInLocation("2006-01-02", birthday, time.Local); err == nil {
+		prof.Birthday.Time, prof.Birthday.Valid = t, true
+	}
+	r.s.profiles[userID] = prof
+	return nil
+}
+
+func (r *memoryProfileRepository) Visibility(userID int) (ProfileVisibility, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	if v, ok := r.s.visibilities[userID]; ok {
+		return v, nil
+	}
+	return defaultProfileVisibility, nil
+}
+
+func (r *memoryProfileRepository) SetVisibility(userID int, v ProfileVisibility) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	r.s.visibilities[userID] = v
+	return nil
+}
+
+func (r *memoryProfileRepository) ListPrefectures() (map[int]string, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	prefs := make(map[int]string)
+	for userID, p := range r.s.profiles {
+		if p.Pref != "" && p.Pref != "未入力" {
+			prefs[userID] = p.Pref
+		}
+	}
+	return prefs, nil
+}
+
+func (r *memoryProfileRepository) Initialize() error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	r.s.visibilities = make(map[int]ProfileVisibility)
+	return nil
+}
+
+type memoryEntryRepository struct {
+	s *memoryStore
+}
+
+func (r *memoryEntryRepository) Get(id int) (*Entry, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	e, ok := r.s.entry(id)
+	if !ok {
+		return nil, ErrContentNotFound
+	}
+	return &e, nil
+}
+
+func (r *memoryEntryRepository) ListByUser(userID, readerID int, limit int) ([]Entry, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	entries := make([]Entry, 0, limit)
+	for _, e := range r.s.entries {
+		if e.UserID == userID && r.s.liveEntry(e) && r.s.readable(e, readerID) {
+			entries = append(entries, e)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].CreatedAt.Before(entries[j].CreatedAt) })
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func (r *memoryEntryRepository) ListRecent(userID, readerID int, limit int) ([]Entry, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	entries := make([]Entry, 0, limit)
+	for _, e := range r.s.entries {
+		if e.UserID == userID && r.s.liveEntry(e) && r.s.readable(e, readerID) {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return newer(entries[i].CreatedAt, entries[j].CreatedAt, entries[i].ID, entries[j].ID)
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func (r *memoryEntryRepository) ListByIDs(ids []int) ([]Entry, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	entries := make([]Entry, 0, len(ids))
+	for _, id := range ids {
+		if e, ok := r.s.entry(id); ok {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (r *memoryEntryRepository) ListAfter(afterID int, limit int) ([]Entry, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	entries := make([]Entry, 0, limit)
+	for _, e := range r.s.entries {
+		if e.ID > afterID && r.s.liveEntry(e) && len(entries) < limit {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (r *memoryEntryRepository) ListWithCommentCount(userID, readerID int, q PageQuery) ([]LEntry, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	entries := make([]LEntry, 0, q.Limit)
+	for _, e := range r.s.entries {
+		if e.UserID != userID || !r.s.liveEntry(e) || !r.s.readable(e, readerID) {
+			continue
+		}
+		count := 0
+		for _, c := range r.s.comments {
+			if c.EntryID == e.ID && r.s.liveComment(c) {
+				count++
+			}
+		}
+		entries = append(entries, LEntry{ID: e.ID, Audience: e.Audience, Title: e.Title, Content: e.Content, Count: count, CreatedAt: e.CreatedAt})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return newer(entries[i].CreatedAt, entries[j].CreatedAt, entries[i].ID, entries[j].ID)
+	})
+	from, to := pageRange(q, len(entries), func(i int) Cursor { return Cursor{entries[i].CreatedAt, entries[i].ID} }, true)
+	return entries[from:to], nil
+}
+
+func (r *memoryEntryRepository) Create(userID int, audience Audience, title, content string) (int, error) {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	id := 1
+	if n := len(r.s.entries); n > 0 {
+		id = r.s.entries[n-1].ID + 1
+	}
+	now := time.Now()
+	r.s.entries = append(r.s.entries, Entry{ID: id, UserID: userID, Audience: audience, Title: title, Content: content, CreatedAt: now, UpdatedAt: now})
+	return id, nil
+}
+
+func (r *memoryEntryRepository) Update(id int, audience Audience, title, content string) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	for i, e := range r.s.entries {
+		if e.ID == id && r.s.liveEntry(e) {
+			r.s.entries[i].Audience, r.s.entries[i].Title, r.s.entries[i].Content = audience, title, content
+			r.s.entries[i].UpdatedAt = time.Now()
+		}
+	}
+	return nil
+}
+
+func (r *memoryEntryRepository) Delete(id int) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	if _, ok := r.s.entry(id); ok {
+		r.s.deletedEntries[id] = time.Now()
+	}
+	return nil
+}
+
+func (r *memoryEntryRepository) Initialize() error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	r.s.deletedEntries = make(map[int]time.Time)
+
+	entries := r.s.entries[:0]
+	for _, e := range r.s.entries {
+		if e.ID <= 500000 {
+			entries = append(entries, e)
+		}
+	}
+	r.s.entries = entries
+	return nil
+}
+
+type memoryCommentRepository struct {
+	s *memoryStore
+}
+
+func (r *memoryCommentRepository) Get(id int) (*Comment, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	for _, c := range r.s.comments {
+		if c.ID == id && r.s.liveComment(c) {
+			return &c, nil
+		}
+	}
+	return nil, ErrContentNotFound
+}
+
+func (r *memoryCommentRepository) ListByIDs(ids []int) ([]Comment, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	comments := make([]Comment, 0, len(ids))
+	for _, id := range ids {
+		if c, ok := r.s.comment(id); ok {
+			comments = append(comments, c)
+		}
+	}
+	return comments, nil
+}
+
+func (r *memoryCommentRepository) ListAfter(afterID int, limit int) ([]Comment, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	comments := make([]Comment, 0, limit)
+	for _, c := range r.s.comments {
+		if c.ID > afterID && r.s.liveComment(c) && len(comments) < limit {
+			comments = append(comments, c)
+		}
+	}
+	return comments, nil
+}
+
+// hiddenComment reports whether the comment is deleted or its author is
+// blocked by the owner of the entry.
+func (s *memoryStore) hiddenComment(c Comment) bool {
+	e, _ := s.entry(c.EntryID)
+	return !s.liveComment(c) || s.isBlocked(e.UserID, c.UserID)
+}
+
+func (s *memoryStore) threadComment(c Comment) EComment {
+	u := s.users[c.UserID]
+	return EComment{
+		ID: c.ID, ParentID: c.ParentID, Depth: c.Depth, Deleted: s.hiddenComment(c),
+		Comment: c.Comment, NickName: u.NickName, AccountName: u.AccountName, CreatedAt: c.CreatedAt,
+	}
+}
+
+func (r *memoryCommentRepository) ListByEntry(entryID int, q PageQuery) ([]EComment, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	replied := make(map[int]bool)
+	for _, c := range r.s.comments {
+		if c.EntryID == entryID && c.ThreadID != 0 && !r.s.hiddenComment(c) {
+			replied[c.ThreadID] = true
+		}
+	}
+
+	comments := make([]EComment, 0, q.Limit)
+	for _, c := range r.s.comments {
+		if c.EntryID != entryID || c.ParentID != 0 {
+			continue
+		}
+		if ec := r.s.threadComment(c); !ec.Deleted || replied[c.ID] {
+			comments = append(comments, ec)
+		}
+	}
+	sort.Slice(comments, func(i, j int) bool {
+		return newer(comments[j].CreatedAt, comments[i].CreatedAt, comments[j].ID, comments[i].ID)
+	})
+	from, to := pageRange(q, len(comments), func(i int) Cursor { return Cursor{comments[i].CreatedAt, comments[i].ID} }, false)
+	return comments[from:to], nil
+}
+
+func (r *memoryCommentRepository) ListReplies(threadIDs []int) ([]EComment, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	threads := make(map[int]bool, len(threadIDs))
+	for _, id := range threadIDs {
+		threads[id] = true
+	}
+	comments := make([]EComment, 0, 10)
+	for _, c := range r.s.comments {
+		if c.ThreadID != 0 && threads[c.ThreadID] {
+			comments = append(comments, r.s.threadComment(c))
+		}
+	}
+	sort.Slice(comments, func(i, j int) bool {
+		return newer(comments[j].CreatedAt, comments[i].CreatedAt, comments[j].ID, comments[i].ID)
+	})
+	return comments, nil
+}
+
+func (r *memoryCommentRepository) ListForOwner(userID int, limit int) ([]IComment, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	found := make([]Comment, 0, limit)
+	for _, c := range r.s.comments {
+		if !r.s.liveComment(c) {
+			continue
+		}
+		if e, ok := r.s.entry(c.EntryID); ok && e.UserID == userID && !r.s.isBlocked(userID, c.UserID) {
+			found = append(found, c)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return newer(found[i].CreatedAt, found[j].CreatedAt, found[i].ID, found[j].ID) })
+	if len(found) > limit {
+		found = found[:limit]
+	}
+
+	comments := make([]IComment, 0, len(found))
+	for _, c := range found {
+		u := r.s.users[userID]
+		comments = append(comments, IComment{AccountName: u.AccountName, NickName: u.NickName, Comment: c.Comment, CreatedAt: c.CreatedAt})
+	}
+	return comments, nil
+}
+
+func (r *memoryCommentRepository) Create(c Comment) (int, error) {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	c.ID = 1
+	if n := len(r.s.comments); n > 0 {
+		c.ID = r.s.comments[n-1].ID + 1
+	}
+	c.CreatedAt = time.Now()
+	r.s.comments = append(r.s.comments, c)
+	return c.ID, nil
+}
+
+func (r *memoryCommentRepository) Delete(id int) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	for _, c := range r.s.comments {
+		if c.ID == id && r.s.liveComment(c) {
+			r.s.deletedComments[id] = time.Now()
+		}
+	}
+	return nil
+}
+
+func (r *memoryCommentRepository) Initialize() error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	r.s.deletedComments = make(map[int]time.Time)
+
+	comments := r.s.comments[:0]
+	for _, c := range r.s.comments {
+		if c.ID <= 1500000 {
+			comments = append(comments, c)
+		}
+	}
+	r.s.comments = comments
+	return nil
+}
+
+type memoryRelationRepository struct {
+	s *memoryStore
+}
+
+func (r *memoryRelationRepository) IsFriend(one, another int) (bool, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	return r.s.isFriend(one, another), nil
+}
+
+func (r *memoryRelationRepository) Count(userID int) (int, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	cnt := 0
+	for _, rel := range r.s.relations {
+		if rel.One == userID {
+			cnt++
+		}
+	}
+	return cnt, nil
+}
+
+func (r *memoryRelationRepository) ListFriends(userID int, q PageQuery) ([]FFriend, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	rels := make([]memoryRelation, 0, 100)
+	for _, rel := range r.s.relations {
+		if rel.One == userID {
+			rels = append(rels, rel)
+		}
+	}
+	sort.Slice(rels, func(i, j int) bool { return newer(rels[i].CreatedAt, rels[j].CreatedAt, rels[i].ID, rels[j].ID) })
+	from, to := pageRange(q, len(rels), func(i int) Cursor { return Cursor{rels[i].CreatedAt, rels[i].ID} }, true)
+
+	friends := make([]FFriend, 0, to-from)
+	for _, rel := range rels[from:to] {
+		u := r.s.users[rel.Another]
+		friends = append(friends, FFriend{ID: rel.ID, AccountName: u.AccountName, NickName: u.NickName, CreatedAt: rel.CreatedAt})
+	}
+	return friends, nil
+}
+
+func (r *memoryRelationRepository) ListAll() ([]Friendship, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	friendships := make([]Friendship, 0, len(r.s.relations))
+	for _, rel := range r.s.relations {
+		friendships = append(friendships, Friendship{rel.One, rel.Another})
+	}
+	return friendships, nil
+}
+
+func (r *memoryRelationRepository) Create(one, another int) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	if r.s.isFriend(one, another) {
+		return nil
+	}
+	id := 1
+	if n := len(r.s.relations); n > 0 {
+		id = r.s.relations[n-1].ID + 1
+	}
+	now := time.Now()
+	r.s.relations = append(r.s.relations,
+		memoryRelation{ID: id, One: one, Another: another, CreatedAt: now},
+		memoryRelation{ID: id + 1, One: another, Another: one, CreatedAt: now})
+	return nil
+}
+
+func (r *memoryRelationRepository) Delete(one, another int) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	relations := r.s.relations[:0]
+	for _, rel := range r.s.relations {
+		if !(rel.One == one && rel.Another == another) && !(rel.One == another && rel.Another == one) {
+			relations = append(relations, rel)
+		}
+	}
+	r.s.relations = relations
+	return nil
+}
+
+func (r *memoryRelationRepository) Initialize() error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	relations := r.s.relations[:0]
+	for _, rel := range r.s.relations {
+		if rel.ID <= 500000 {
+			relations = append(relations, rel)
+		}
+	}
+	r.s.relations = relations
+	return nil
+}
+
+type memoryFootprintRepository struct {
+	s *memoryStore
+}
+
+func (r *memoryFootprintRepository) Record(visits []DailyFootprint) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+next:
+	for _, v := range visits {
+		for i, f := range r.s.footprints {
+			if f.UserID == v.UserID && f.OwnerID == v.OwnerID && f.Date.Equal(v.Date) {
+				if v.Updated.After(f.Updated) {
+					r.s.footprints[i].Updated = v.Updated
+				}
+				continue next
+			}
+		}
+		id := 1
+		if n := len(r.s.footprints); n > 0 {
+			id = r.s.footprints[n-1].ID + 1
+		}
+		r.s.footprints = append(r.s.footprints, memoryFootprint{ID: id, UserID: v.UserID, OwnerID: v.OwnerID, Date: v.Date, Updated: v.Updated})
+	}
+	return nil
+}
+
+func (r *memoryFootprintRepository) ListDaily(userID int, q PageQuery) ([]FFootprint, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	found := make([]memoryFootprint, 0, 10)
+	for _, f := range r.s.footprints {
+		if f.UserID == userID && !r.s.isBlocked(userID, f.OwnerID) {
+			found = append(found, f)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return newer(found[i].Updated, found[j].Updated, found[i].ID, found[j].ID) })
+	from, to := pageRange(q, len(found), func(i int) Cursor { return Cursor{found[i].Updated, found[i].ID} }, true)
+
+	footprints := make([]FFootprint, 0, to-from)
+	for _, f := range found[from:to] {
+		u := r.s.users[f.OwnerID]
+		footprints = append(footprints, FFootprint{ID: f.ID, NickName: u.NickName, AccountName: u.AccountName, Date: f.Date, Updated: f.Updated})
+	}
+	return footprints, nil
+}
+
+func (r *memoryFootprintRepository) ListSince(since time.Time) ([]DailyFootprint, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	day := truncateDate(since)
+	visits := []DailyFootprint{}
+	for _, f := range r.s.footprints {
+		if !f.Date.Before(day) {
+			visits = append(visits, DailyFootprint{UserID: f.UserID, OwnerID: f.OwnerID, Date: f.Date, Updated: f.Updated})
+		}
+	}
+	return visits, nil
+}
+
+func (r *memoryFootprintRepository) Initialize() error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	footprints := r.s.footprints[:0]
+	for _, f := range r.s.footprints {
+		if f.ID <= 500000 {
+			footprints = append(footprints, f)
+		}
+	}
+	r.s.footprints = footprints
+	return nil
+}
+
+// addEdge appends an edge unless it is already there.
+func addEdge(edges []memoryEdge, from, to int) []memoryEdge {
+	id := 1
+	for _, e := range edges {
+		if e.From == from && e.To == to {
+			return edges
+		}
+		if e.ID >= id {
+			id = e.ID + 1
+		}
+	}
+	return append(edges, memoryEdge{ID: id, From: from, To: to, CreatedAt: time.Now()})
+}
+
+// removeEdge deletes the edge and reports whether it was there.
+func removeEdge(edges []memoryEdge, from, to int) ([]memoryEdge, bool) {
+	for i, e := range edges {
+		if e.From == from && e.To == to {
+			return append(edges[:i], edges[i+1:]...), true
+		}
+	}
+	return edges, false
+}
+
+// listEdges returns the users at the other end of the edges matching, newest
+// first.
+func (s *memoryStore) listEdges(edges []memoryEdge, match func(memoryEdge) (int, bool)) []FFriend {
+	found := make([]memoryEdge, 0, 10)
+	for _, e := range edges {
+		if _, ok := match(e); ok {
+			found = append(found, e)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return newer(found[i].CreatedAt, found[j].CreatedAt, found[i].ID, found[j].ID) })
+
+	users := make([]FFriend, 0, len(found))
+	for _, e := range found {
+		id, _ := match(e)
+		u := s.users[id]
+		users = append(users, FFriend{ID: e.ID, AccountName: u.AccountName, NickName: u.NickName, CreatedAt: e.CreatedAt})
+	}
+	return users
+}
+
+type memoryFriendRequestRepository struct {
+	s *memoryStore
+}
+
+func (r *memoryFriendRequestRepository) Create(from, to int) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	r.s.requests = addEdge(r.s.requests, from, to)
+	return nil
+}
+
+func (r *memoryFriendRequestRepository) Exists(from, to int) (bool, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	for _, e := range r.s.requests {
+		if e.From == from && e.To == to {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *memoryFriendRequestRepository) Delete(from, to int) (bool, error) {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	var ok bool
+	r.s.requests, ok = removeEdge(r.s.requests, from, to)
+	return ok, nil
+}
+
+func (r *memoryFriendRequestRepository) ListIncoming(userID int) ([]FFriend, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	return r.s.listEdges(r.s.requests, func(e memoryEdge) (int, bool) { return e.From, e.To == userID }), nil
+}
+
+func (r *memoryFriendRequestRepository) ListOutgoing(userID int) ([]FFriend, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	return r.s.listEdges(r.s.requests, func(e memoryEdge) (int, bool) { return e.To, e.From == userID }), nil
+}
+
+func (r *memoryFriendRequestRepository) Initialize() error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	r.s.requests = nil
+	return nil
+}
+
+type memoryBlockRepository struct {
+	s *memoryStore
+}
+
+func (r *memoryBlockRepository) Create(userID, blockedID int) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	r.s.blocks = addEdge(r.s.blocks, userID, blockedID)
+	return nil
+}
+
+func (r *memoryBlockRepository) Delete(userID, blockedID int) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	r.s.blocks, _ = removeEdge(r.s.blocks, userID, blockedID)
+	return nil
+}
+
+func (r *memoryBlockRepository) IsBlocked(userID, blockedID int) (bool, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	return r.s.isBlocked(userID, blockedID), nil
+}
+
+func (r *memoryBlockRepository) Between(one, another int) (bool, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	return r.s.isBlocked(one, another) || r.s.isBlocked(another, one), nil
+}
+
+func (r *memoryBlockRepository) List(userID int) ([]FFriend, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	return r.s.listEdges(r.s.blocks, func(e memoryEdge) (int, bool) { return e.To, e.From == userID }), nil
+}
+
+func (r *memoryBlockRepository) Initialize() error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	r.s.blocks = nil
+	return nil
+}
+
+func (s *memoryStore) onTimeline(userID, entryID int) bool {
+	for _, t := range s.timelines {
+		if t.UserID == userID && t.EntryID == entryID {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver puts the entries on the timeline of the user, skipping those
+// already there.
+func (s *memoryStore) deliver(userID int, entries []Entry) {
+	for _, e := range entries {
+		if !s.onTimeline(userID, e.ID) {
+			s.timelines = append(s.timelines, memoryTimeline{UserID: userID, EntryID: e.ID, AuthorID: e.UserID, CreatedAt: e.CreatedAt})
+		}
+	}
+}
+
+// latestEntries returns the newest live entries written by users that match.
+func (s *memoryStore) latestEntries(match func(userID int) bool, limit int) []Entry {
+	entries := make([]Entry, 0, limit)
+	for _, e := range s.entries {
+		if match(e.UserID) && s.liveEntry(e) {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return newer(entries[i].CreatedAt, entries[j].CreatedAt, entries[i].ID, entries[j].ID)
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries
+}
+
+type memoryTimelineRepository struct {
+	s *memoryStore
+}
+
+func (r *memoryTimelineRepository) Push(entryID int) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	e, ok := r.s.entry(entryID)
+	if !ok {
+		return nil
+	}
+	for _, rel := range r.s.relations {
+		if rel.One == e.UserID {
+			r.s.deliver(rel.Another, []Entry{e})
+		}
+	}
+	return nil
+}
+
+func (r *memoryTimelineRepository) Connect(one, another int) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	r.s.deliver(one, r.s.latestEntries(func(id int) bool { return id == another }, timelineSize))
+	r.s.deliver(another, r.s.latestEntries(func(id int) bool { return id == one }, timelineSize))
+	return nil
+}
+
+func (r *memoryTimelineRepository) Disconnect(one, another int) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	timelines := r.s.timelines[:0]
+	for _, t := range r.s.timelines {
+		if !(t.UserID == one && t.AuthorID == another) && !(t.UserID == another && t.AuthorID == one) {
+			timelines = append(timelines, t)
+		}
+	}
+	r.s.timelines = timelines
+	return nil
+}
+
+func (r *memoryTimelineRepository) List(userID int, limit int) ([]IEntry, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	found := make([]memoryTimeline, 0, limit)
+	for _, t := range r.s.timelines {
+		if e, ok := r.s.entry(t.EntryID); ok && t.UserID == userID && r.s.readable(e, userID) {
+			found = append(found, t)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return newer(found[i].CreatedAt, found[j].CreatedAt, found[i].EntryID, found[j].EntryID)
+	})
+	if len(found) > limit {
+		found = found[:limit]
+	}
+
+	entries := make([]IEntry, 0, len(found))
+	for _, t := range found {
+		e, _ := r.s.entry(t.EntryID)
+		u := r.s.users[t.AuthorID]
+		entries = append(entries, IEntry{ID: e.ID, Title: e.Title, AccountName: u.AccountName, NickName: u.NickName, CreatedAt: e.CreatedAt})
+	}
+	return entries, nil
+}
+
+func (r *memoryTimelineRepository) Rebuild(userID int) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	timelines := r.s.timelines[:0]
+	for _, t := range r.s.timelines {
+		if t.UserID != userID {
+			timelines = append(timelines, t)
+		}
+	}
+	r.s.timelines = timelines
+	r.s.deliver(userID, r.s.latestEntries(func(id int) bool { return r.s.isFriend(id, userID) }, timelineSize))
+	return nil
+}
+
+func (r *memoryTimelineRepository) Initialize() error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	timelines := r.s.timelines[:0]
+	for _, t := range r.s.timelines {
+		if t.EntryID <= 500000 && r.s.isFriend(t.AuthorID, t.UserID) {
+			timelines = append(timelines, t)
+		}
+	}
+	r.s.timelines = timelines
+	return nil
+}
+
+func (s *memoryStore) comment(id int) (Comment, bool) {
+	for _, c := range s.comments {
+		if c.ID == id && s.liveComment(c) {
+			return c, true
+		}
+	}
+	return Comment{}, false
+}
+
+// deliverComments puts the comments on the feed of the user, skipping those
+// already there.
+func (s *memoryStore) deliverComments(userID int, comments []Comment) {
+	for _, c := range comments {
+		found := false
+		for _, f := range s.feeds {
+			if f.UserID == userID && f.CommentID == c.ID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			s.feeds = append(s.feeds, memoryCommentFeed{UserID: userID, CommentID: c.ID, CommenterID: c.UserID, CreatedAt: c.CreatedAt})
+		}
+	}
+}
+
+// latestComments is latestEntries for comments.
+func (s *memoryStore) latestComments(match func(userID int) bool, limit int) []Comment {
+	comments := make([]Comment, 0, limit)
+	for _, c := range s.comments {
+		if match(c.UserID) && s.liveComment(c) {
+			comments = append(comments, c)
+		}
+	}
+	sort.Slice(comments, func(i, j int) bool {
+		return newer(comments[i].CreatedAt, comments[j].CreatedAt, comments[i].ID, comments[j].ID)
+	})
+	if len(comments) > limit {
+		comments = comments[:limit]
+	}
+	return comments
+}
+
+type memoryCommentFeedRepository struct {
+	s *memoryStore
+}
+
+func (r *memoryCommentFeedRepository) Push(commentID int) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	c, ok := r.s.comment(commentID)
+	if !ok {
+		return nil
+	}
+	for _, rel := range r.s.relations {
+		if rel.One == c.UserID {
+			r.s.deliverComments(rel.Another, []Comment{c})
+		}
+	}
+	return nil
+}
+
+func (r *memoryCommentFeedRepository) Connect(one, another int) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	r.s.deliverComments(one, r.s.latestComments(func(id int) bool { return id == another }, commentFeedSize))
+	r.s.deliverComments(another, r.s.latestComments(func(id int) bool { return id == one }, commentFeedSize))
+	return nil
+}
+
+func (r *memoryCommentFeedRepository) Disconnect(one, another int) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	feeds := r.s.feeds[:0]
+	for _, f := range r.s.feeds {
+		if !(f.UserID == one && f.CommenterID == another) && !(f.UserID == another && f.CommenterID == one) {
+			feeds = append(feeds, f)
+		}
+	}
+	r.s.feeds = feeds
+	return nil
+}
+
+func (r *memoryCommentFeedRepository) List(userID int, limit int) ([]FriendComment, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	comments := make([]FriendComment, 0, limit)
+	for _, f := range r.s.feeds {
+		if f.UserID != userID {
+			continue
+		}
+		c, ok := r.s.comment(f.CommentID)
+		if !ok {
+			continue
+		}
+		e, ok := r.s.entry(c.EntryID)
+		if !ok || !r.s.readable(e, userID) || r.s.isBlocked(e.UserID, userID) || r.s.isBlocked(userID, e.UserID) {
+			continue
+		}
+		cu, eu := r.s.users[c.UserID], r.s.users[e.UserID]
+		comments = append(comments, FriendComment{
+			ID: c.ID, EntryID: c.EntryID, UserID: c.UserID, Comment: c.Comment, EntryUserID: e.UserID, CreatedAt: c.CreatedAt,
+			AccountName: cu.AccountName, NickName: cu.NickName, EntryAccountName: eu.AccountName, EntryNickName: eu.NickName,
+		})
+	}
+	sort.Slice(comments, func(i, j int) bool {
+		return newer(comments[i].CreatedAt, comments[j].CreatedAt, comments[i].ID, comments[j].ID)
+	})
+	if len(comments) > limit {
+		comments = comments[:limit]
+	}
+	return comments, nil
+}
+
+func (r *memoryCommentFeedRepository) Rebuild(userID int) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	feeds := r.s.feeds[:0]
+	for _, f := range r.s.feeds {
+		if f.UserID != userID {
+			feeds = append(feeds, f)
+		}
+	}
+	r.s.feeds = feeds
+	r.s.deliverComments(userID, r.s.latestComments(func(id int) bool { return r.s.isFriend(id, userID) }, commentFeedSize))
+	return nil
+}
+
+func (r *memoryCommentFeedRepository) Initialize() error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	feeds := r.s.feeds[:0]
+	for _, f := range r.s.feeds {
+		if f.CommentID <= 1500000 && r.s.isFriend(f.CommenterID, f.UserID) {
+			feeds = append(feeds, f)
+		}
+	}
+	r.s.feeds = feeds
+	return nil
+}
+
+type memoryNotificationRepository struct {
+	s *memoryStore
+}
+
+func (r *memoryNotificationRepository) Create(n Notification) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	if r.s.optOuts[n.UserID][n.Type] {
+		return nil
+	}
+	for _, o := range r.s.notifications {
+		if n.Key != "" && o.UserID == n.UserID && o.Key == n.Key {
+			return nil
+		}
+	}
+	n.ID = 1
+	if l := len(r.s.notifications); l > 0 {
+		n.ID = r.s.notifications[l-1].ID + 1
+	}
+	n.Read, n.CreatedAt = false, time.Now()
+	r.s.notifications = append(r.s.notifications, n)
+	return nil
+}
+
+// visibleNotifications returns the notifications of the user that List
+// shows, newest first.
+func (s *memoryStore) visibleNotifications(userID int) []Notification {
+	found := make([]Notification, 0, 10)
+	for _, n := range s.notifications {
+		if n.UserID == userID && !s.isBlocked(userID, n.ActorID) {
+			found = append(found, n)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return newer(found[i].CreatedAt, found[j].CreatedAt, found[i].ID, found[j].ID) })
+	return found
+}
+
+func (r *memoryNotificationRepository) List(userID int, q PageQuery) ([]Notification, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	found := r.s.visibleNotifications(userID)
+	from, to := pageRange(q, len(found), func(i int) Cursor { return Cursor{found[i].CreatedAt, found[i].ID} }, true)
+
+	notifications := make([]Notification, 0, to-from)
+	for _, n := range found[from:to] {
+		u := r.s.users[n.ActorID]
+		n.AccountName, n.NickName = u.AccountName, u.NickName
+		if e, ok := r.s.entry(n.EntryID); ok {
+			n.EntryTitle = e.Title
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, nil
+}
+
+func (r *memoryNotificationRepository) CountUnread(userID int, limit int) (int, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	count := 0
+	for _, n := range r.s.visibleNotifications(userID) {
+		if n.Read {
+			continue
+		}
+		if count++; count == limit {
+			break
+		}
+	}
+	return count, nil
+}
+
+func (r *memoryNotificationRepository) MarkRead(userID, id int) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	for i, n := range r.s.notifications {
+		if n.UserID == userID && (id == 0 || n.ID == id) {
+			r.s.notifications[i].Read = true
+		}
+	}
+	return nil
+}
+
+func (r *memoryNotificationRepository) OptOuts(userID int) (map[string]bool, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	optOuts := make(map[string]bool)
+	for typ := range r.s.optOuts[userID] {
+		optOuts[typ] = true
+	}
+	return optOuts, nil
+}
+
+func (r *memoryNotificationRepository) SetOptOuts(userID int, types []string) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	optOuts := make(map[string]bool)
+	for _, typ := range types {
+		optOuts[typ] = true
+	}
+	r.s.optOuts[userID] = optOuts
+	return nil
+}
+
+func (r *memoryNotificationRepository) Initialize() error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	r.s.notifications = nil
+	r.s.optOuts = make(map[int]map[string]bool)
+	return nil
+}
+
+type memoryTokenRepository struct {
+	s *memoryStore
+}
+
+func (r *memoryTokenRepository) Create(hash string, userID int) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	r.s.tokens[hash] = userID
+	return nil
+}
+
+func (r *memoryTokenRepository) Find(hash string) (int, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	userID, ok := r.s.tokens[hash]
+	if !ok {
+		return 0, ErrInvalidToken
+	}
+	return userID, nil
+}
+
+func (r *memoryTokenRepository) Delete(hash string) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	delete(r.s.tokens, hash)
+	return nil
+}
+
+func (r *memoryTokenRepository) Initialize() error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	r.s.tokens = make(map[string]int)
+	return nil
+}
+
+type memoryFeedTokenRepository struct {
+	s *memoryStore
+}
+
+func (r *memoryFeedTokenRepository) Get(userID int) (string, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	return r.s.feedTokens[userID], nil
+}
+
+func (r *memoryFeedTokenRepository) Set(userID int, token string) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	r.s.feedTokens[userID] = token
+	return nil
+}
+
+func (r *memoryFeedTokenRepository) FindUser(token string) (int, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	for userID, t := range r.s.feedTokens {
+		if t == token {
+			return userID, nil
+		}
+	}
+	return 0, ErrContentNotFound
+}
+
+func (r *memoryFeedTokenRepository) Initialize() error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	r.s.feedTokens = make(map[int]string)
+	return nil
+}
+
+type memoryImageRepository struct {
+	s *memoryStore
+}
+
+func (r *memoryImageRepository) Get(id int) (*Image, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	for _, img := range r.s.images {
+		if img.ID == id {
+			return &img, nil
+		}
+	}
+	return nil, ErrContentNotFound
+}
+
+func (r *memoryImageRepository) ListByEntry(entryID int) ([]Image, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	images := []Image{}
+	for _, img := range r.s.images {
+		if img.EntryID == entryID {
+			images = append(images, img)
+		}
+	}
+	return images, nil
+}
+
+func (r *memoryImageRepository) Create(image *Image) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	r.s.lastImageID++
+	image.ID = r.s.lastImageID
+	image.CreatedAt = time.Now()
+	r.s.images = append(r.s.images, *image)
+	return nil
+}
+
+func (r *memoryImageRepository) DeleteByEntry(entryID int) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	images := r.s.images[:0]
+	for _, img := range r.s.images {
+		if img.EntryID != entryID {
+			images = append(images, img)
+		}
+	}
+	r.s.images = images
+	return nil
+}
+
+func (r *memoryImageRepository) Initialize() error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	r.s.images = nil
+	r.s.lastImageID = 0
+	return nil
+}
+
+type memorySuggestionRepository struct {
+	s *memoryStore
+}
+
+func (r *memorySuggestionRepository) Dismiss(userID, dismissedID int) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	if r.s.dismissals[userID] == nil {
+		r.s.dismissals[userID] = make(map[int]bool)
+	}
+	r.s.dismissals[userID][dismissedID] = true
+	return nil
+}
+
+func (r *memorySuggestionRepository) ListDismissed(userID int) ([]int, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	ids := []int{}
+	for id := range r.s.dismissals[userID] {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (r *memorySuggestionRepository) Initialize() error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	r.s.dismissals = make(map[int]map[int]bool)
+	return nil
+}
+
+type memoryFriendListRepository struct {
+	s *memoryStore
+}
+
+func (r *memoryFriendListRepository) Get(id int) (*FriendList, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	for _, l := range r.s.friendLists {
+		if l.ID == id {
+			return &l, nil
+		}
+	}
+	return nil, ErrContentNotFound
+}
+
+func (r *memoryFriendListRepository) ListByUser(userID int) ([]FriendList, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	lists := []FriendList{}
+	for _, l := range r.s.friendLists {
+		if l.UserID == userID {
+			lists = append(lists, l)
+		}
+	}
+	return lists, nil
+}
+
+func (r *memoryFriendListRepository) Create(userID int, name string) (int, error) {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	id := 1
+	if n := len(r.s.friendLists); n > 0 {
+		id = r.s.friendLists[n-1].ID + 1
+	}
+	r.s.friendLists = append(r.s.friendLists, FriendList{ID: id, UserID: userID, Name: name, CreatedAt: time.Now()})
+	return id, nil
+}
+
+func (r *memoryFriendListRepository) Delete(id int) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	lists := r.s.friendLists[:0]
+	for _, l := range r.s.friendLists {
+		if l.ID != id {
+			lists = append(lists, l)
+		}
+	}
+	r.s.friendLists = lists
+	members := r.s.listMembers[:0]
+	for _, m := range r.s.listMembers {
+		if m.From != id {
+			members = append(members, m)
+		}
+	}
+	r.s.listMembers = members
+	return nil
+}
+
+func (r *memoryFriendListRepository) Members(id int) ([]FFriend, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	return r.s.listEdges(r.s.listMembers, func(e memoryEdge) (int, bool) { return e.To, e.From == id }), nil
+}
+
+func (r *memoryFriendListRepository) AddMember(id, userID int) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	r.s.listMembers = addEdge(r.s.listMembers, id, userID)
+	return nil
+}
+
+func (r *memoryFriendListRepository) RemoveMember(id, userID int) error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	r.s.listMembers, _ = removeEdge(r.s.listMembers, id, userID)
+	return nil
+}
+
+func (r *memoryFriendListRepository) IsMember(id, userID int) (bool, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+
+	return r.s.isMember(id, userID), nil
+}
+
+func (r *memoryFriendListRepository) Initialize() error {
+	r.s.Lock()
+	defer r.s.Unlock()
+
+	r.s.friendLists, r.s.listMembers = nil, nil
+	return nil
+}
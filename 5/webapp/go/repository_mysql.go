@@ -0,0 +1,1415 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func NewMySQLRepository(db *sql.DB) *Repository {
+	return &Repository{
+		Users:         &mysqlUserRepository{db},
+		Profiles:      &mysqlProfileRepository{db},
+		Entries:       &mysqlEntryRepository{db},
+		Comments:      &mysqlCommentRepository{db},
+		Relations:     &mysqlRelationRepository{db},
+		Requests:      &mysqlFriendRequestRepository{db},
+		Blocks:        &mysqlBlockRepository{db},
+		Timelines:     &mysqlTimelineRepository{db},
+		Feeds:         &mysqlCommentFeedRepository{db},
+		Footprints:    &mysqlFootprintRepository{db},
+		Notifications: &mysqlNotificationRepository{db},
+		Tokens:        &mysqlTokenRepository{db},
+		FeedTokens:    &mysqlFeedTokenRepository{db},
+		Images:        &mysqlImageRepository{db},
+		Suggestions:   &mysqlSuggestionRepository{db},
+		FriendLists:   &mysqlFriendListRepository{db},
+	}
+}
+
+// splitBody splits entries.body, which is stored as title + "\n" + content.
+func splitBody(body string) (title, content string) {
+	s := strings.SplitN(body, "\n", 2)
+	if len(s) < 2 {
+		return s[0], ""
+	}
+	return s[0], s[1]
+}
+
+// entryText holds the text columns of an entry. Rows written before
+// migrations/002_entry_title_content.sql have NULL title and content until
+// the backfill reaches them, so those fall back to splitting body.
+type entryText struct {
+	title, content, body sql.NullString
+}
+
+func (t *entryText) split() (title, content string) {
+	if t.title.Valid {
+		return t.title.String, t.content.String
+	}
+	return splitBody(t.body.String)
+}
+
+// isDuplicateEntry reports whether err is a violation of a unique key.
+func isDuplicateEntry(err error) bool {
+	e, ok := err.(*mysql.MySQLError)
+	return ok && e.Number == 1062
+}
+
+// pageClause returns the condition, its arguments and the ORDER BY that
+// select q from a list ordered by (col, idCol), descending when desc.
+// reversed reports that the rows come back in the opposite of list order.
+func pageClause(q PageQuery, col, idCol string, desc bool) (cond string, args []interface{}, order string, reversed bool) {
+	c, forward := q.After, true
+	if q.Before != nil {
+		c, forward = q.Before, false
+	}
+	op, dir := ">", "ASC"
+	if desc == forward {
+		op, dir = "<", "DESC"
+	}
+	order = col + " " + dir + ", " + idCol + " " + dir
+	if c == nil {
+		return "1", nil, order, false
+	}
+	// Spelled out rather than as (col, idCol) < (?, ?) so that MySQL can
+	// range scan the index.
+	cond = fmt.Sprintf("(%s %s ? OR (%s = ? AND %s %s ?))", col, op, col, idCol, op)
+	return cond, []interface{}{c.CreatedAt, c.CreatedAt, c.ID}, order, !forward
+}
+
+// reverse reverses the slice in place.
+func reverse(slice interface{}) {
+	swap := reflect.Swapper(slice)
+	for i, j := 0, reflect.ValueOf(slice).Len()-1; i < j; i, j = i+1, j-1 {
+		swap(i, j)
+	}
+}
+
+type mysqlUserRepository struct {
+	db *sql.DB
+}
+
+func (r *mysqlUserRepository) All() ([]User, error) {
+	rows, err := r.db.Query(`SELECT id, account_name, nick_name, email, passhash, salt FROM users`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]User, 0, 5000)
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.AccountName, &user.NickName, &user.Email, &user.PasswordHash, &user.Salt); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (r *mysqlUserRepository) find(cond string, arg interface{}) (*User, error) {
+	var user User
+	err := r.db.QueryRow(`SELECT id, account_name, nick_name, email, passhash, salt FROM users WHERE `+cond+` = ?`, arg).
+		Scan(&user.ID, &user.AccountName, &user.NickName, &user.Email, &user.PasswordHash, &user.Salt)
+	if err == sql.ErrNoRows {
+		return nil, ErrContentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *mysqlUserRepository) FindByID(id int) (*User, error) {
+	return r.find("id", id)
+}
+
+func (r *mysqlUserRepository) FindByAccount(name string) (*User, error) {
+	return r.find("account_name", name)
+}
+
+func (r *mysqlUserRepository) FindByEmail(email string) (*User, error) {
+	return r.find("email", email)
+}
+
+func (r *mysqlUserRepository) FindByNickName(name string) (*User, error) {
+	return r.find("nick_name", name)
+}
+
+func (r *mysqlUserRepository) Create(user *User) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO users (account_name, nick_name, email, passhash, salt) VALUES (?,?,?,?,?)`,
+		user.AccountName, user.NickName, user.Email, user.PasswordHash, user.Salt)
+	if isDuplicateEntry(err) {
+		return ErrUserExists
+	}
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO profiles (user_id, first_name, last_name, sex, birthday, pref) VALUES (?, '', '', '', NULL, '')`, id); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	user.ID = int(id)
+	return nil
+}
+
+type mysqlProfileRepository struct {
+	db *sql.DB
+}
+
+func (r *mysqlProfileRepository) Get(userID int) (Profile, error) {
+	prof := Profile{}
+	err := r.db.QueryRow(`
+SELECT user_id, first_name, last_name, sex, birthday, pref, updated_at FROM profiles
+WHERE user_id = ?`, userID).
+		Scan(&prof.UserID, &prof.FirstName, &prof.LastName, &prof.Sex, &prof.Birthday, &prof.Pref, &prof.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return prof, nil
+	}
+	return prof, err
+}
+
+func (r *mysqlProfileRepository) Update(userID int, firstName, lastName, sex, birthday, pref string) error {
+	// An empty birthday clears it; '' is not a valid DATE in strict mode.
+	birth := sql.NullString{String: birthday, Valid: birthday != ""}
+	_, err := r.db.Exec(`
+UPDATE profiles
+SET first_name=?, last_name=?, sex=?, birthday=?, pref=?, updated_at=CURRENT_TIMESTAMP()
+WHERE user_id = ?`, firstName, lastName, sex, birth, pref, userID)
+	return err
+}
+
+func (r *mysqlProfileRepository) Visibility(userID int) (ProfileVisibility, error) {
+	v := ProfileVisibility{}
+	err := r.db.QueryRow(`
+SELECT first_name, last_name, sex, birthday, pref, email FROM profile_visibilities
+WHERE user_id = ?`, userID).
+		Scan(&v.FirstName, &v.LastName, &v.Sex, &v.Birthday, &v.Pref, &v.Email)
+	if err == sql.ErrNoRows {
+		return defaultProfileVisibility, nil
+	}
+	return v, err
+}
+
+func (r *mysqlProfileRepository) SetVisibility(userID int, v ProfileVisibility) error {
+	_, err := r.db.Exec(`
+INSERT INTO profile_visibilities (user_id, first_name, last_name, sex, birthday, pref, email) VALUES (?,?,?,?,?,?,?)
+ON DUPLICATE KEY UPDATE first_name = VALUES(first_name), last_name = VALUES(last_name), sex = VALUES(sex),
+  birthday = VALUES(birthday), pref = VALUES(pref), email = VALUES(email)`,
+		userID, v.FirstName, v.LastName, v.Sex, v.Birthday, v.Pref, v.Email)
+	return err
+}
+
+func (r *mysqlProfileRepository) ListPrefectures() (map[int]string, error) {
+	rows, err := r.db.Query(`SELECT user_id, pref FROM profiles WHERE pref IS NOT NULL AND pref NOT IN ('', '未入力')`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prefs := make(map[int]string)
+	for rows.Next() {
+		var userID int
+		var pref string
+		if err := rows.Scan(&userID, &pref); err != nil {
+			return nil, err
+		}
+		prefs[userID] = pref
+	}
+	return prefs, rows.Err()
+}
+
+func (r *mysqlProfileRepository) Initialize() error {
+	_, err := r.db.Exec("TRUNCATE profile_visibilities")
+	return err
+}
+
+type mysqlEntryRepository struct {
+	db *sql.DB
+}
+
+// entryVisibility is the visibility of the entry aliased e. Rows that
+// predate the visibility column have it NULL until they are backfilled, and
+// keep what their private flag meant.
+const entryVisibility = `COALESCE(e.visibility, IF(e.private = 1, 'friends', 'everyone'))`
+
+// entryColumns are the columns scanEntry reads, from entries aliased e.
+const entryColumns = `e.id, e.user_id, ` + entryVisibility + `, e.list_id, e.title, e.content, e.body, e.created_at, COALESCE(e.updated_at, e.created_at)`
+
+// readableBy is the condition that the entry aliased e may be read by the
+// user bound to each of its placeholders by readableArgs: the same rule as
+// Audience.readableBy.
+const readableBy = `(e.user_id = ? OR CASE ` + entryVisibility + `
+	WHEN 'everyone' THEN TRUE
+	WHEN 'friends_of_friends' THEN
+		EXISTS (SELECT 1 FROM relations rf WHERE rf.one = ? AND rf.another = e.user_id) OR
+		EXISTS (SELECT 1 FROM relations r1 INNER JOIN relations r2 ON r2.one = r1.another WHERE r1.one = ? AND r2.another = e.user_id)
+	WHEN 'friends' THEN
+		EXISTS (SELECT 1 FROM relations rf WHERE rf.one = ? AND rf.another = e.user_id)
+	WHEN 'list' THEN
+		EXISTS (SELECT 1 FROM relations rf WHERE rf.one = ? AND rf.another = e.user_id) AND
+		EXISTS (SELECT 1 FROM friend_list_members m WHERE m.list_id = e.list_id AND m.user_id = ?)
+	ELSE FALSE END)`
+
+func readableArgs(userID int) []interface{} {
+	args := make([]interface{}, strings.Count(readableBy, "?"))
+	for i := range args {
+		args[i] = userID
+	}
+	return args
+}
+
+func scanEntry(row interface {
+	Scan(dest ...interface{}) error
+}) (Entry, error) {
+	var text entryText
+	entry := Entry{}
+	if err := row.Scan(&entry.ID, &entry.UserID, &entry.Visibility, &entry.ListID, &text.title, &text.content, &text.body, &entry.CreatedAt, &entry.UpdatedAt); err != nil {
+		return entry, err
+	}
+	entry.Title, entry.Content = text.split()
+	return entry, nil
+}
+
+func (r *mysqlEntryRepository) Get(id int) (*Entry, error) {
+	entry, err := scanEntry(r.db.QueryRow(`SELECT `+entryColumns+` FROM entries e WHERE id = ? AND deleted_at IS NULL`, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrContentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (r *mysqlEntryRepository) listEntries(query string, args ...interface{}) ([]Entry, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]Entry, 0, 10)
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (r *mysqlEntryRepository) ListByUser(userID, readerID int, limit int) ([]Entry, error) {
+	args := append(append([]interface{}{userID}, readableArgs(readerID)...), limit)
+	return r.listEntries(`SELECT `+entryColumns+` FROM entries e WHERE user_id = ? AND `+readableBy+` AND deleted_at IS NULL ORDER BY created_at LIMIT ?`, args...)
+}
+
+func (r *mysqlEntryRepository) ListRecent(userID, readerID int, limit int) ([]Entry, error) {
+	args := append(append([]interface{}{userID}, readableArgs(readerID)...), limit)
+	return r.listEntries(`SELECT `+entryColumns+` FROM entries e WHERE user_id = ? AND `+readableBy+` AND deleted_at IS NULL ORDER BY created_at DESC, id DESC LIMIT ?`, args...)
+}
+
+// inClause returns the placeholders and arguments for IN (...).
+func inClause(ids []int) (string, []interface{}) {
+	args := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	return strings.TrimSuffix(strings.Repeat("?,", len(ids)), ","), args
+}
+
+func (r *mysqlEntryRepository) ListByIDs(ids []int) ([]Entry, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	in, args := inClause(ids)
+	return r.listEntries(`SELECT `+entryColumns+` FROM entries e WHERE id IN (`+in+`) AND deleted_at IS NULL`, args...)
+}
+
+func (r *mysqlEntryRepository) ListAfter(afterID int, limit int) ([]Entry, error) {
+	return r.listEntries(`SELECT `+entryColumns+` FROM entries e WHERE id > ? AND deleted_at IS NULL ORDER BY id LIMIT ?`, afterID, limit)
+}
+
+func (r *mysqlEntryRepository) ListWithCommentCount(userID, readerID int, q PageQuery) ([]LEntry, error) {
+	cond, args, order, reversed := pageClause(q, "e.created_at", "e.id", true)
+	rows, err := r.db.Query(`
+SELECT e.id, `+entryVisibility+`, e.list_id, e.title, e.content, e.body, e.created_at,
+	   (SELECT COUNT(*) FROM comments c WHERE c.entry_id = e.id AND c.deleted_at IS NULL) as count
+FROM entries e
+WHERE e.user_id = ? AND `+readableBy+` AND e.deleted_at IS NULL AND `+cond+`
+ORDER BY `+order+`
+LIMIT ?`, append(append(append([]interface{}{userID}, readableArgs(readerID)...), args...), q.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]LEntry, 0, q.Limit)
+	for rows.Next() {
+		var text entryText
+		entry := LEntry{}
+		if err := rows.Scan(&entry.ID, &entry.Visibility, &entry.ListID, &text.title, &text.content, &text.body, &entry.CreatedAt, &entry.Count); err != nil {
+			return nil, err
+		}
+		entry.Title, entry.Content = text.split()
+		entries = append(entries, entry)
+	}
+	if reversed {
+		reverse(entries)
+	}
+	return entries, rows.Err()
+}
+
+func (r *mysqlEntryRepository) Create(userID int, audience Audience, title, content string) (int, error) {
+	// body and private are still written for readers that predate the
+	// title, content and visibility columns; they can be dropped once none
+	// are left.
+	res, err := r.db.Exec(`INSERT INTO entries (user_id, private, visibility, list_id, title, content, body) VALUES (?,?,?,?,?,?,?)`,
+		userID, audience.Private(), audience.Visibility, audience.ListID, title, content, title+"\n"+content)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+func (r *mysqlEntryRepository) Update(id int, audience Audience, title, content string) error {
+	_, err := r.db.Exec(`UPDATE entries SET private=?, visibility=?, list_id=?, title=?, content=?, body=?, updated_at=CURRENT_TIMESTAMP() WHERE id = ? AND deleted_at IS NULL`,
+		audience.Private(), audience.Visibility, audience.ListID, title, content, title+"\n"+content, id)
+	return err
+}
+
+func (r *mysqlEntryRepository) Delete(id int) error {
+	_, err := r.db.Exec(`UPDATE entries SET deleted_at=CURRENT_TIMESTAMP() WHERE id = ? AND deleted_at IS NULL`, id)
+	return err
+}
+
+func (r *mysqlEntryRepository) Initialize() error {
+	if _, err := r.db.Exec("DELETE FROM entries WHERE id > 500000"); err != nil {
+		return err
+	}
+	_, err := r.db.Exec("UPDATE entries SET deleted_at = NULL WHERE deleted_at IS NOT NULL")
+	return err
+}
+
+type mysqlCommentRepository struct {
+	db *sql.DB
+}
+
+// commentColumns are the columns the comment scans read.
+const commentColumns = `id, entry_id, user_id, parent_id, thread_id, depth, comment, created_at`
+
+func (r *mysqlCommentRepository) Get(id int) (*Comment, error) {
+	c := Comment{}
+	err := r.db.QueryRow(`SELECT `+commentColumns+` FROM comments WHERE id = ? AND deleted_at IS NULL`, id).
+		Scan(&c.ID, &c.EntryID, &c.UserID, &c.ParentID, &c.ThreadID, &c.Depth, &c.Comment, &c.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrContentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (r *mysqlCommentRepository) listComments(query string, args ...interface{}) ([]Comment, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := make([]Comment, 0, 10)
+	for rows.Next() {
+		c := Comment{}
+		if err := rows.Scan(&c.ID, &c.EntryID, &c.UserID, &c.ParentID, &c.ThreadID, &c.Depth, &c.Comment, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+func (r *mysqlCommentRepository) ListByIDs(ids []int) ([]Comment, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	in, args := inClause(ids)
+	return r.listComments(`SELECT `+commentColumns+` FROM comments WHERE id IN (`+in+`) AND deleted_at IS NULL`, args...)
+}
+
+func (r *mysqlCommentRepository) ListAfter(afterID int, limit int) ([]Comment, error) {
+	return r.listComments(`SELECT `+commentColumns+` FROM comments WHERE id > ? AND deleted_at IS NULL ORDER BY id LIMIT ?`, afterID, limit)
+}
+
+// hiddenComment is the condition that the comment aliased c is deleted or
+// by a commenter the entry owner has blocked.
+const hiddenComment = `(c.deleted_at IS NOT NULL OR EXISTS (
+		SELECT 1 FROM entries e INNER JOIN blocks b ON b.user_id = e.user_id
+		WHERE e.id = c.entry_id AND b.blocked_id = c.user_id))`
+
+func (r *mysqlCommentRepository) listThread(query string, limit int, args ...interface{}) ([]EComment, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := make([]EComment, 0, limit)
+	for rows.Next() {
+		c := EComment{}
+		if err := rows.Scan(&c.ID, &c.ParentID, &c.Depth, &c.Deleted, &c.Comment, &c.CreatedAt, &c.NickName, &c.AccountName); err != nil {
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+func (r *mysqlCommentRepository) ListByEntry(entryID int, q PageQuery) ([]EComment, error) {
+	cond, args, order, reversed := pageClause(q, "c.created_at", "c.id", false)
+	comments, err := r.listThread(`
+SELECT c.id, c.parent_id, c.depth, `+hiddenComment+`, c.comment, c.created_at, u.nick_name, u.account_name
+FROM comments c
+INNER JOIN users u ON u.id = c.user_id
+WHERE c.entry_id = ? AND c.parent_id = 0 AND `+cond+`
+	AND (NOT `+hiddenComment+` OR c.id IN (
+		SELECT c.thread_id FROM comments c WHERE c.entry_id = ? AND c.thread_id <> 0 AND NOT `+hiddenComment+`))
+ORDER BY `+order+`
+LIMIT ?`, q.Limit, append(append([]interface{}{entryID}, args...), entryID, q.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	if reversed {
+		reverse(comments)
+	}
+	return comments, nil
+}
+
+func (r *mysqlCommentRepository) ListReplies(threadIDs []int) ([]EComment, error) {
+	if len(threadIDs) == 0 {
+		return nil, nil
+	}
+	in, args := inClause(threadIDs)
+	return r.listThread(`
+SELECT c.id, c.parent_id, c.depth, `+hiddenComment+`, c.comment, c.created_at, u.nick_name, u.account_name
+FROM comments c
+INNER JOIN users u ON u.id = c.user_id
+WHERE c.thread_id IN (`+in+`)
+ORDER BY c.created_at, c.id`, 10, args...)
+}
+
+func (r *mysqlCommentRepository) ListForOwner(userID int, limit int) ([]IComment, error) {
+	rows, err := r.db.Query(`
+SELECT c.comment AS comment, c.created_at AS created_at, u.nick_name AS nick_name, u.account_name AS account_name
+FROM comments c
+JOIN entries e ON c.entry_id = e.id
+JOIN users u ON u.id = e.user_id
+WHERE e.user_id = ? AND e.deleted_at IS NULL AND c.deleted_at IS NULL
+	AND c.user_id NOT IN (SELECT blocked_id FROM blocks WHERE user_id = ?)
+ORDER BY c.created_at DESC
+LIMIT ?`, userID, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := make([]IComment, 0, limit)
+	for rows.Next() {
+		c := IComment{}
+		if err := rows.Scan(&c.Comment, &c.CreatedAt, &c.NickName, &c.AccountName); err != nil {
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+func (r *mysqlCommentRepository) Create(c Comment) (int, error) {
+	res, err := r.db.Exec(`INSERT INTO comments (entry_id, user_id, parent_id, thread_id, depth, comment) VALUES (?,?,?,?,?,?)`,
+		c.EntryID, c.UserID, c.ParentID, c.ThreadID, c.Depth, c.Comment)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+func (r *mysqlCommentRepository) Delete(id int) error {
+	_, err := r.db.Exec(`UPDATE comments SET deleted_at=CURRENT_TIMESTAMP() WHERE id = ? AND deleted_at IS NULL`, id)
+	return err
+}
+
+func (r *mysqlCommentRepository) Initialize() error {
+	if _, err := r.db.Exec("DELETE FROM comments WHERE id > 1500000"); err != nil {
+		return err
+	}
+	_, err := r.db.Exec("UPDATE comments SET deleted_at = NULL WHERE deleted_at IS NOT NULL")
+	return err
+}
+
+type mysqlRelationRepository struct {
+	db *sql.DB
+}
+
+func (r *mysqlRelationRepository) IsFriend(one, another int) (bool, error) {
+	var cnt int
+	err := r.db.QueryRow(`SELECT COUNT(1) AS cnt FROM relations WHERE (one = ? AND another = ?)`, one, another).Scan(&cnt)
+	return cnt > 0, err
+}
+
+func (r *mysqlRelationRepository) Count(userID int) (int, error) {
+	var cnt int
+	err := r.db.QueryRow(`
+SELECT COUNT(*) FROM relations
+WHERE one = ?`, userID).Scan(&cnt)
+	return cnt, err
+}
+
+func (r *mysqlRelationRepository) ListFriends(userID int, q PageQuery) ([]FFriend, error) {
+	cond, args, order, reversed := pageClause(q, "r.created_at", "r.id", true)
+	rows, err := r.db.Query(`
+SELECT r.id, r.created_at, u.account_name, u.nick_name
+FROM relations r
+INNER JOIN users u ON u.id = r.another
+WHERE r.one = ? AND `+cond+`
+ORDER BY `+order+`
+LIMIT ?`, append(append([]interface{}{userID}, args...), q.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	friends := make([]FFriend, 0, q.Limit)
+	for rows.Next() {
+		var friend FFriend
+		if err := rows.Scan(&friend.ID, &friend.CreatedAt, &friend.AccountName, &friend.NickName); err != nil {
+			return nil, err
+		}
+		friends = append(friends, friend)
+	}
+	if reversed {
+		reverse(friends)
+	}
+	return friends, rows.Err()
+}
+
+func (r *mysqlRelationRepository) ListAll() ([]Friendship, error) {
+	rows, err := r.db.Query(`SELECT one, another FROM relations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	friendships := []Friendship{}
+	for rows.Next() {
+		f := Friendship{}
+		if err := rows.Scan(&f.One, &f.Another); err != nil {
+			return nil, err
+		}
+		friendships = append(friendships, f)
+	}
+	return friendships, rows.Err()
+}
+
+func (r *mysqlRelationRepository) Create(one, another int) error {
+	_, err := r.db.Exec(`INSERT INTO relations (one, another) VALUES (?,?), (?,?)`, one, another, another, one)
+	return err
+}
+
+func (r *mysqlRelationRepository) Delete(one, another int) error {
+	_, err := r.db.Exec(`DELETE FROM relations WHERE (one = ? AND another = ?) OR (one = ? AND another = ?)`, one, another, another, one)
+	return err
+}
+
+func (r *mysqlRelationRepository) Initialize() error {
+	_, err := r.db.Exec("DELETE FROM relations WHERE id > 500000")
+	return err
+}
+
+// listUsers runs a query that returns id, created_at, account_name and
+// nick_name of users.
+func listUsers(db *sql.DB, query string, args ...interface{}) ([]FFriend, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]FFriend, 0, 10)
+	for rows.Next() {
+		var u FFriend
+		if err := rows.Scan(&u.ID, &u.CreatedAt, &u.AccountName, &u.NickName); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+type mysqlFriendRequestRepository struct {
+	db *sql.DB
+}
+
+func (r *mysqlFriendRequestRepository) Create(from, to int) error {
+	_, err := r.db.Exec(`INSERT IGNORE INTO friend_requests (from_id, to_id) VALUES (?,?)`, from, to)
+	return err
+}
+
+func (r *mysqlFriendRequestRepository) Exists(from, to int) (bool, error) {
+	var cnt int
+	err := r.db.QueryRow(`SELECT COUNT(1) FROM friend_requests WHERE from_id = ? AND to_id = ?`, from, to).Scan(&cnt)
+	return cnt > 0, err
+}
+
+func (r *mysqlFriendRequestRepository) Delete(from, to int) (bool, error) {
+	res, err := r.db.Exec(`DELETE FROM friend_requests WHERE from_id = ? AND to_id = ?`, from, to)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (r *mysqlFriendRequestRepository) ListIncoming(userID int) ([]FFriend, error) {
+	return listUsers(r.db, `
+SELECT f.id, f.created_at, u.account_name, u.nick_name
+FROM friend_requests f
+INNER JOIN users u ON u.id = f.from_id
+WHERE f.to_id = ?
+ORDER BY f.created_at DESC, f.id DESC`, userID)
+}
+
+func (r *mysqlFriendRequestRepository) ListOutgoing(userID int) ([]FFriend, error) {
+	return listUsers(r.db, `
+SELECT f.id, f.created_at, u.account_name, u.nick_name
+FROM friend_requests f
+INNER JOIN users u ON u.id = f.to_id
+WHERE f.from_id = ?
+ORDER BY f.created_at DESC, f.id DESC`, userID)
+}
+
+func (r *mysqlFriendRequestRepository) Initialize() error {
+	_, err := r.db.Exec("DELETE FROM friend_requests")
+	return err
+}
+
+type mysqlBlockRepository struct {
+	db *sql.DB
+}
+
+func (r *mysqlBlockRepository) Create(userID, blockedID int) error {
+	_, err := r.db.Exec(`INSERT IGNORE INTO blocks (user_id, blocked_id) VALUES (?,?)`, userID, blockedID)
+	return err
+}
+
+func (r *mysqlBlockRepository) Delete(userID, blockedID int) error {
+	_, err := r.db.Exec(`DELETE FROM blocks WHERE user_id = ? AND blocked_id = ?`, userID, blockedID)
+	return err
+}
+
+func (r *mysqlBlockRepository) IsBlocked(userID, blockedID int) (bool, error) {
+	var cnt int
+	err := r.db.QueryRow(`SELECT COUNT(1) FROM blocks WHERE user_id = ? AND blocked_id = ?`, userID, blockedID).Scan(&cnt)
+	return cnt > 0, err
+}
+
+func (r *mysqlBlockRepository) Between(one, another int) (bool, error) {
+	var cnt int
+	err := r.db.QueryRow(`
+SELECT COUNT(1) FROM blocks
+WHERE (user_id = ? AND blocked_id = ?) OR (user_id = ? AND blocked_id = ?)`, one, another, another, one).Scan(&cnt)
+	return cnt > 0, err
+}
+
+func (r *mysqlBlockRepository) List(userID int) ([]FFriend, error) {
+	return listUsers(r.db, `
+SELECT b.id, b.created_at, u.account_name, u.nick_name
+FROM blocks b
+INNER JOIN users u ON u.id = b.blocked_id
+WHERE b.user_id = ?
+ORDER BY b.created_at DESC, b.id DESC`, userID)
+}
+
+func (r *mysqlBlockRepository) Initialize() error {
+	_, err := r.db.Exec("DELETE FROM blocks")
+	return err
+}
+
+type mysqlFootprintRepository struct {
+	db *sql.DB
+}
+
+// footprintBatchSize keeps each INSERT well below max_allowed_packet.
+const footprintBatchSize = 1000
+
+func (r *mysqlFootprintRepository) Record(visits []DailyFootprint) error {
+	for len(visits) > 0 {
+		n := len(visits)
+		if n > footprintBatchSize {
+			n = footprintBatchSize
+		}
+		values := strings.TrimSuffix(strings.Repeat("(?,?,?,?),", n), ",")
+		args := make([]interface{}, 0, 4*n)
+		for _, v := range visits[:n] {
+			args = append(args, v.UserID, v.OwnerID, v.Date, v.Updated)
+		}
+		if _, err := r.db.Exec(`
+INSERT INTO daily_footprints (user_id, owner_id, date, updated) VALUES `+values+`
+ON DUPLICATE KEY UPDATE updated = GREATEST(updated, VALUES(updated))`, args...); err != nil {
+			return err
+		}
+		visits = visits[n:]
+	}
+	return nil
+}
+
+func (r *mysqlFootprintRepository) ListDaily(userID int, q PageQuery) ([]FFootprint, error) {
+	cond, args, order, reversed := pageClause(q, "f.updated", "f.id", true)
+	rows, err := r.db.Query(`
+SELECT f.id, f.date, f.updated, u.account_name, u.nick_name
+FROM daily_footprints f
+INNER JOIN users u ON u.id = f.owner_id
+WHERE f.user_id = ? AND `+cond+`
+	AND f.owner_id NOT IN (SELECT blocked_id FROM blocks WHERE user_id = ?)
+ORDER BY `+order+`
+LIMIT ?`, append(append(append([]interface{}{userID}, args...), userID), q.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	footprints := make([]FFootprint, 0, q.Limit)
+	for rows.Next() {
+		fp := FFootprint{}
+		if err := rows.Scan(&fp.ID, &fp.Date, &fp.Updated, &fp.AccountName, &fp.NickName); err != nil {
+			return nil, err
+		}
+		footprints = append(footprints, fp)
+	}
+	if reversed {
+		reverse(footprints)
+	}
+	return footprints, rows.Err()
+}
+
+func (r *mysqlFootprintRepository) ListSince(since time.Time) ([]DailyFootprint, error) {
+	rows, err := r.db.Query(`SELECT user_id, owner_id, date, updated FROM daily_footprints WHERE date >= ?`, truncateDate(since))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	visits := []DailyFootprint{}
+	for rows.Next() {
+		v := DailyFootprint{}
+		if err := rows.Scan(&v.UserID, &v.OwnerID, &v.Date, &v.Updated); err != nil {
+			return nil, err
+		}
+		visits = append(visits, v)
+	}
+	return visits, rows.Err()
+}
+
+func (r *mysqlFootprintRepository) Initialize() error {
+	if _, err := r.db.Exec("DELETE FROM footprints WHERE id > 500000"); err != nil {
+		return err
+	}
+	// daily_footprints was built from the footprints of the initial data,
+	// which is older than any visit recorded since.
+	_, err := r.db.Exec("DELETE FROM daily_footprints WHERE updated > (SELECT MAX(created_at) FROM footprints)")
+	return err
+}
+
+// timelineSize is how many entries Connect copies from a new friend, and
+// how many Rebuild copies in total.
+const timelineSize = 100
+
+type mysqlTimelineRepository struct {
+	db *sql.DB
+}
+
+func (r *mysqlTimelineRepository) Push(entryID int) error {
+	_, err := r.db.Exec(`
+INSERT IGNORE INTO timelines (user_id, entry_id, author_id, created_at)
+SELECT r.another, e.id, e.user_id, e.created_at
+FROM entries e
+INNER JOIN relations r ON r.one = e.user_id
+WHERE e.id = ?`, entryID)
+	return err
+}
+
+func (r *mysqlTimelineRepository) copyEntries(userID, authorID int) error {
+	_, err := r.db.Exec(`
+INSERT IGNORE INTO timelines (user_id, entry_id, author_id, created_at)
+SELECT ?, id, user_id, created_at
+FROM entries
+WHERE user_id = ? AND deleted_at IS NULL
+ORDER BY created_at DESC
+LIMIT ?`, userID, authorID, timelineSize)
+	return err
+}
+
+func (r *mysqlTimelineRepository) Connect(one, another int) error {
+	if err := r.copyEntries(one, another); err != nil {
+		return err
+	}
+	return r.copyEntries(another, one)
+}
+
+func (r *mysqlTimelineRepository) Disconnect(one, another int) error {
+	_, err := r.db.Exec(`DELETE FROM timelines WHERE (user_id = ? AND author_id = ?) OR (user_id = ? AND author_id = ?)`,
+		one, another, another, one)
+	return err
+}
+
+func (r *mysqlTimelineRepository) List(userID int, limit int) ([]IEntry, error) {
+	rows, err := r.db.Query(`
+SELECT e.id, e.title, e.content, e.body, e.created_at, u.account_name, u.nick_name
+FROM timelines t
+INNER JOIN entries e ON e.id = t.entry_id
+INNER JOIN users u ON u.id = t.author_id
+WHERE t.user_id = ? AND e.deleted_at IS NULL AND `+readableBy+`
+ORDER BY t.created_at DESC, t.entry_id DESC
+LIMIT ?`, append(append([]interface{}{userID}, readableArgs(userID)...), limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]IEntry, 0, limit)
+	for rows.Next() {
+		var text entryText
+		entry := IEntry{}
+		if err := rows.Scan(&entry.ID, &text.title, &text.content, &text.body, &entry.CreatedAt, &entry.AccountName, &entry.NickName); err != nil {
+			return nil, err
+		}
+		entry.Title, _ = text.split()
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (r *mysqlTimelineRepository) Rebuild(userID int) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM timelines WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+INSERT INTO timelines (user_id, entry_id, author_id, created_at)
+SELECT r.another, e.id, e.user_id, e.created_at
+FROM relations r
+INNER JOIN entries e ON e.user_id = r.one
+WHERE r.another = ? AND e.deleted_at IS NULL
+ORDER BY e.created_at DESC
+LIMIT ?`, userID, timelineSize); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *mysqlTimelineRepository) Initialize() error {
+	if _, err := r.db.Exec("DELETE FROM timelines WHERE entry_id > 500000"); err != nil {
+		return err
+	}
+	_, err := r.db.Exec(`
+DELETE t FROM timelines t
+LEFT JOIN relations r ON r.one = t.author_id AND r.another = t.user_id
+WHERE r.id IS NULL`)
+	return err
+}
+
+// commentFeedSize is how many comments Connect copies from a new friend,
+// and how many Rebuild copies in total, as timelineSize is for entries.
+const commentFeedSize = timelineSize
+
+type mysqlCommentFeedRepository struct {
+	db *sql.DB
+}
+
+func (r *mysqlCommentFeedRepository) Push(commentID int) error {
+	_, err := r.db.Exec(`
+INSERT IGNORE INTO comment_feeds (user_id, comment_id, commenter_id, created_at)
+SELECT r.another, c.id, c.user_id, c.created_at
+FROM comments c
+INNER JOIN relations r ON r.one = c.user_id
+WHERE c.id = ?`, commentID)
+	return err
+}
+
+func (r *mysqlCommentFeedRepository) copyComments(userID, commenterID int) error {
+	_, err := r.db.Exec(`
+INSERT IGNORE INTO comment_feeds (user_id, comment_id, commenter_id, created_at)
+SELECT ?, id, user_id, created_at
+FROM comments
+WHERE user_id = ? AND deleted_at IS NULL
+ORDER BY created_at DESC
+LIMIT ?`, userID, commenterID, commentFeedSize)
+	return err
+}
+
+func (r *mysqlCommentFeedRepository) Connect(one, another int) error {
+	if err := r.copyComments(one, another); err != nil {
+		return err
+	}
+	return r.copyComments(another, one)
+}
+
+func (r *mysqlCommentFeedRepository) Disconnect(one, another int) error {
+	_, err := r.db.Exec(`DELETE FROM comment_feeds WHERE (user_id = ? AND commenter_id = ?) OR (user_id = ? AND commenter_id = ?)`,
+		one, another, another, one)
+	return err
+}
+
+func (r *mysqlCommentFeedRepository) List(userID int, limit int) ([]FriendComment, error) {
+	rows, err := r.db.Query(`
+SELECT c.id, c.entry_id, c.user_id, c.comment, c.created_at, e.user_id,
+	cu.account_name, cu.nick_name, eu.account_name, eu.nick_name
+FROM comment_feeds f
+INNER JOIN comments c ON c.id = f.comment_id
+INNER JOIN entries e ON e.id = c.entry_id
+INNER JOIN users cu ON cu.id = c.user_id
+INNER JOIN users eu ON eu.id = e.user_id
+WHERE f.user_id = ? AND c.deleted_at IS NULL AND e.deleted_at IS NULL AND `+readableBy+`
+	AND NOT EXISTS (
+		SELECT 1 FROM blocks b
+		WHERE (b.user_id = e.user_id AND b.blocked_id = ?) OR (b.user_id = ? AND b.blocked_id = e.user_id))
+ORDER BY f.created_at DESC, f.comment_id DESC
+LIMIT ?`, append(append([]interface{}{userID}, readableArgs(userID)...), userID, userID, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := make([]FriendComment, 0, limit)
+	for rows.Next() {
+		c := FriendComment{}
+		if err := rows.Scan(&c.ID, &c.EntryID, &c.UserID, &c.Comment, &c.CreatedAt, &c.EntryUserID,
+			&c.AccountName, &c.NickName, &c.EntryAccountName, &c.EntryNickName); err != nil {
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+func (r *mysqlCommentFeedRepository) Rebuild(userID int) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM comment_feeds WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+INSERT INTO comment_feeds (user_id, comment_id, commenter_id, created_at)
+SELECT r.another, c.id, c.user_id, c.created_at
+FROM relations r
+INNER JOIN comments c ON c.user_id = r.one
+WHERE r.another = ? AND c.deleted_at IS NULL
+ORDER BY c.created_at DESC
+LIMIT ?`, userID, commentFeedSize); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *mysqlCommentFeedRepository) Initialize() error {
+	if _, err := r.db.Exec("DELETE FROM comment_feeds WHERE comment_id > 1500000"); err != nil {
+		return err
+	}
+	_, err := r.db.Exec(`
+DELETE f FROM comment_feeds f
+LEFT JOIN relations r ON r.one = f.commenter_id AND r.another = f.user_id
+WHERE r.id IS NULL`)
+	return err
+}
+
+type mysqlNotificationRepository struct {
+	db *sql.DB
+}
+
+func (r *mysqlNotificationRepository) Create(n Notification) error {
+	key := sql.NullString{String: n.Key, Valid: n.Key != ""}
+	_, err := r.db.Exec(`
+INSERT IGNORE INTO notifications (user_id, type, actor_id, entry_id, dedup_key)
+SELECT ?, ?, ?, ?, ? FROM DUAL
+WHERE NOT EXISTS (SELECT 1 FROM notification_optouts WHERE user_id = ? AND type = ?)`,
+		n.UserID, n.Type, n.ActorID, n.EntryID, key, n.UserID, n.Type)
+	return err
+}
+
+func (r *mysqlNotificationRepository) List(userID int, q PageQuery) ([]Notification, error) {
+	cond, args, order, reversed := pageClause(q, "n.created_at", "n.id", true)
+	rows, err := r.db.Query(`
+SELECT n.id, n.type, n.actor_id, n.entry_id, n.read_at IS NOT NULL, n.created_at,
+	u.account_name, u.nick_name, COALESCE(e.title, '')
+FROM notifications n
+INNER JOIN users u ON u.id = n.actor_id
+LEFT JOIN entries e ON e.id = n.entry_id AND e.deleted_at IS NULL
+WHERE n.user_id = ? AND `+cond+`
+	AND n.actor_id NOT IN (SELECT blocked_id FROM blocks WHERE user_id = ?)
+ORDER BY `+order+`
+LIMIT ?`, append(append(append([]interface{}{userID}, args...), userID), q.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := make([]Notification, 0, q.Limit)
+	for rows.Next() {
+		n := Notification{UserID: userID}
+		if err := rows.Scan(&n.ID, &n.Type, &n.ActorID, &n.EntryID, &n.Read, &n.CreatedAt,
+			&n.AccountName, &n.NickName, &n.EntryTitle); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	if reversed {
+		reverse(notifications)
+	}
+	return notifications, rows.Err()
+}
+
+func (r *mysqlNotificationRepository) CountUnread(userID int, limit int) (int, error) {
+	count := 0
+	err := r.db.QueryRow(`
+SELECT COUNT(*) FROM (
+	SELECT 1 FROM notifications
+	WHERE user_id = ? AND read_at IS NULL
+		AND actor_id NOT IN (SELECT blocked_id FROM blocks WHERE user_id = ?)
+	LIMIT ?
+) t`, userID, userID, limit).Scan(&count)
+	return count, err
+}
+
+func (r *mysqlNotificationRepository) MarkRead(userID, id int) error {
+	if id == 0 {
+		_, err := r.db.Exec(`UPDATE notifications SET read_at = NOW() WHERE user_id = ? AND read_at IS NULL`, userID)
+		return err
+	}
+	_, err := r.db.Exec(`UPDATE notifications SET read_at = NOW() WHERE id = ? AND user_id = ? AND read_at IS NULL`, id, userID)
+	return err
+}
+
+func (r *mysqlNotificationRepository) OptOuts(userID int) (map[string]bool, error) {
+	rows, err := r.db.Query(`SELECT type FROM notification_optouts WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	optOuts := make(map[string]bool)
+	for rows.Next() {
+		var typ string
+		if err := rows.Scan(&typ); err != nil {
+			return nil, err
+		}
+		optOuts[typ] = true
+	}
+	return optOuts, rows.Err()
+}
+
+func (r *mysqlNotificationRepository) SetOptOuts(userID int, types []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM notification_optouts WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	for _, typ := range types {
+		if _, err := tx.Exec(`INSERT INTO notification_optouts (user_id, type) VALUES (?,?)`, userID, typ); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *mysqlNotificationRepository) Initialize() error {
+	if _, err := r.db.Exec("TRUNCATE notifications"); err != nil {
+		return err
+	}
+	_, err := r.db.Exec("TRUNCATE notification_optouts")
+	return err
+}
+
+type mysqlTokenRepository struct {
+	db *sql.DB
+}
+
+func (r *mysqlTokenRepository) Create(hash string, userID int) error {
+	_, err := r.db.Exec(`INSERT INTO api_tokens (token_hash, user_id) VALUES (?,?)`, hash, userID)
+	return err
+}
+
+func (r *mysqlTokenRepository) Find(hash string) (int, error) {
+	userID := 0
+	err := r.db.QueryRow(`SELECT user_id FROM api_tokens WHERE token_hash = ?`, hash).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidToken
+	}
+	return userID, err
+}
+
+func (r *mysqlTokenRepository) Delete(hash string) error {
+	_, err := r.db.Exec(`DELETE FROM api_tokens WHERE token_hash = ?`, hash)
+	return err
+}
+
+func (r *mysqlTokenRepository) Initialize() error {
+	_, err := r.db.Exec("TRUNCATE api_tokens")
+	return err
+}
+
+type mysqlFeedTokenRepository struct {
+	db *sql.DB
+}
+
+func (r *mysqlFeedTokenRepository) Get(userID int) (string, error) {
+	token := ""
+	err := r.db.QueryRow(`SELECT token FROM feed_tokens WHERE user_id = ?`, userID).Scan(&token)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return token, err
+}
+
+func (r *mysqlFeedTokenRepository) Set(userID int, token string) error {
+	_, err := r.db.Exec(`INSERT INTO feed_tokens (user_id, token) VALUES (?,?) ON DUPLICATE KEY UPDATE token = VALUES(token)`, userID, token)
+	return err
+}
+
+func (r *mysqlFeedTokenRepository) FindUser(token string) (int, error) {
+	userID := 0
+	err := r.db.QueryRow(`SELECT user_id FROM feed_tokens WHERE token = ?`, token).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrContentNotFound
+	}
+	return userID, err
+}
+
+func (r *mysqlFeedTokenRepository) Initialize() error {
+	_, err := r.db.Exec("TRUNCATE feed_tokens")
+	return err
+}
+
+type mysqlImageRepository struct {
+	db *sql.DB
+}
+
+// imageColumns are the columns scanImage reads.
+const imageColumns = `id, entry_id, user_id, content_type, width, height, created_at`
+
+func scanImage(row interface {
+	Scan(dest ...interface{}) error
+}) (Image, error) {
+	var img Image
+	err := row.Scan(&img.ID, &img.EntryID, &img.UserID, &img.ContentType, &img.Width, &img.Height, &img.CreatedAt)
+	return img, err
+}
+
+func (r *mysqlImageRepository) Get(id int) (*Image, error) {
+	img, err := scanImage(r.db.QueryRow(`SELECT `+imageColumns+` FROM entry_images WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrContentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
+func (r *mysqlImageRepository) ListByEntry(entryID int) ([]Image, error) {
+	rows, err := r.db.Query(`SELECT `+imageColumns+` FROM entry_images WHERE entry_id = ? ORDER BY id`, entryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	images := []Image{}
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, rows.Err()
+}
+
+func (r *mysqlImageRepository) Create(image *Image) error {
+	res, err := r.db.Exec(`INSERT INTO entry_images (entry_id, user_id, content_type, width, height) VALUES (?,?,?,?,?)`,
+		image.EntryID, image.UserID, image.ContentType, image.Width, image.Height)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	image.ID = int(id)
+	return nil
+}
+
+func (r *mysqlImageRepository) DeleteByEntry(entryID int) error {
+	_, err := r.db.Exec(`DELETE FROM entry_images WHERE entry_id = ?`, entryID)
+	return err
+}
+
+func (r *mysqlImageRepository) Initialize() error {
+	_, err := r.db.Exec("TRUNCATE entry_images")
+	return err
+}
+
+type mysqlSuggestionRepository struct {
+	db *sql.DB
+}
+
+func (r *mysqlSuggestionRepository) Dismiss(userID, dismissedID int) error {
+	_, err := r.db.Exec(`INSERT IGNORE INTO suggestion_dismissals (user_id, dismissed_id) VALUES (?,?)`, userID, dismissedID)
+	return err
+}
+
+func (r *mysqlSuggestionRepository) ListDismissed(userID int) ([]int, error) {
+	rows, err := r.db.Query(`SELECT dismissed_id FROM suggestion_dismissals WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (r *mysqlSuggestionRepository) Initialize() error {
+	_, err := r.db.Exec("TRUNCATE suggestion_dismissals")
+	return err
+}
+
+type mysqlFriendListRepository struct {
+	db *sql.DB
+}
+
+func (r *mysqlFriendListRepository) Get(id int) (*FriendList, error) {
+	l := FriendList{}
+	err := r.db.QueryRow(`SELECT id, user_id, name, created_at FROM friend_lists WHERE id = ?`, id).
+		Scan(&l.ID, &l.UserID, &l.Name, &l.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrContentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (r *mysqlFriendListRepository) ListByUser(userID int) ([]FriendList, error) {
+	rows, err := r.db.Query(`SELECT id, user_id, name, created_at FROM friend_lists WHERE user_id = ? ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lists := []FriendList{}
+	for rows.Next() {
+		l := FriendList{}
+		if err := rows.Scan(&l.ID, &l.UserID, &l.Name, &l.CreatedAt); err != nil {
+			return nil, err
+		}
+		lists = append(lists, l)
+	}
+	return lists, rows.Err()
+}
+
+func (r *mysqlFriendListRepository) Create(userID int, name string) (int, error) {
+	res, err := r.db.Exec(`INSERT INTO friend_lists (user_id, name) VALUES (?,?)`, userID, name)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+func (r *mysqlFriendListRepository) Delete(id int) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM friend_list_members WHERE list_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM friend_lists WHERE id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *mysqlFriendListRepository) Members(id int) ([]FFriend, error) {
+	return listUsers(r.db, `
+SELECT m.user_id, m.created_at, u.account_name, u.nick_name
+FROM friend_list_members m
+INNER JOIN users u ON u.id = m.user_id
+WHERE m.list_id = ?
+ORDER BY m.created_at DESC, m.user_id DESC`, id)
+}
+
+func (r *mysqlFriendListRepository) AddMember(id, userID int) error {
+	_, err := r.db.Exec(`INSERT IGNORE INTO friend_list_members (list_id, user_id) VALUES (?,?)`, id, userID)
+	return err
+}
+
+func (r *mysqlFriendListRepository) RemoveMember(id, userID int) error {
+	_, err := r.db.Exec(`DELETE FROM friend_list_members WHERE list_id = ? AND user_id = ?`, id, userID)
+	return err
+}
+
+func (r *mysqlFriendListRepository) IsMember(id, userID int) (bool, error) {
+	var n int
+	err := r.db.QueryRow(`SELECT COUNT(1) FROM friend_list_members WHERE list_id = ? AND user_id = ?`, id, userID).Scan(&n)
+	return n > 0, err
+}
+
+func (r *mysqlFriendListRepository) Initialize() error {
+	if _, err := r.db.Exec("TRUNCATE friend_list_members"); err != nil {
+		return err
+	}
+	_, err := r.db.Exec("TRUNCATE friend_lists")
+	return err
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	// searchCandidates bounds how many of the newest matching entries and
+	// comments are loaded and ranked per search.
+	searchCandidates = 1000
+	searchResults    = 50
+	searchMaxTerms   = 5
+	// snippetWidth is the number of characters shown around the first match.
+	snippetWidth = 100
+)
+
+// SearchIndex is an in-memory inverted index from the characters and
+// character bigrams of entries and comments to their IDs. Japanese has no
+// spaces between words, so a term matches a text when all of its bigrams do;
+// single-character terms use the characters themselves.
+//
+// The index only ever grows: an edited entry gets the bigrams of its new
+// text added, and nothing is removed on delete. Search loads every candidate
+// from the repository and checks it still exists, is visible and contains
+// the terms, so stale postings cost time but never show up.
+type SearchIndex struct {
+	mu       sync.RWMutex
+	entries  ngramIndex
+	comments ngramIndex
+	ready    bool
+
+	// While Rebuild runs, writes also go to pending so that they can be
+	// replayed onto the new index before it replaces the old one.
+	rebuilding bool
+	pending    []searchDoc
+}
+
+type searchDoc struct {
+	comment bool
+	id      int
+	text    string
+}
+
+type SearchIndexStats struct {
+	Ready    bool
+	Grams    int
+	Postings int
+}
+
+var searchIndex *SearchIndex
+
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{entries: newNgramIndex(), comments: newNgramIndex()}
+}
+
+func (s *SearchIndex) AddEntry(id int, title, content string) {
+	s.add(searchDoc{false, id, title + "\n" + content})
+}
+
+func (s *SearchIndex) AddComment(id int, comment string) {
+	s.add(searchDoc{true, id, comment})
+}
+
+func (s *SearchIndex) add(d searchDoc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.index(s.entries, s.comments, d)
+	if s.rebuilding {
+		s.pending = append(s.pending, d)
+	}
+}
+
+func (s *SearchIndex) index(entries, comments ngramIndex, d searchDoc) {
+	if d.comment {
+		comments.add(int32(d.id), d.text)
+	} else {
+		entries.add(int32(d.id), d.text)
+	}
+}
+
+// Rebuild indexes every entry and comment in the repository from scratch,
+// without blocking searches or writes meanwhile.
+func (s *SearchIndex) Rebuild() error {
+	s.mu.Lock()
+	if s.rebuilding {
+		s.mu.Unlock()
+		return nil
+	}
+	s.rebuilding, s.pending = true, nil
+	s.mu.Unlock()
+
+	entries, comments := newNgramIndex(), newNgramIndex()
+	err := func() error {
+		for after := 0; ; {
+			l, err := repo.Entries.ListAfter(after, 10000)
+			if err != nil || len(l) == 0 {
+				return err
+			}
+			for _, e := range l {
+				entries.add(int32(e.ID), e.Title+"\n"+e.Content)
+			}
+			after = l[len(l)-1].ID
+		}
+	}()
+	if err == nil {
+		err = func() error {
+			for after := 0; ; {
+				l, err := repo.Comments.ListAfter(after, 10000)
+				if err != nil || len(l) == 0 {
+					return err
+				}
+				for _, c := range l {
+					comments.add(int32(c.ID), c.Comment)
+				}
+				after = l[len(l)-1].ID
+			}
+		}()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		for _, d := range s.pending {
+			s.index(entries, comments, d)
+		}
+		s.entries, s.comments, s.ready = entries, comments, true
+	}
+	s.rebuilding, s.pending = false, nil
+	return err
+}
+
+// Ready reports whether a Rebuild has finished, so that results are complete.
+func (s *SearchIndex) Ready() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ready
+}
+
+func (s *SearchIndex) Stats() SearchIndexStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := SearchIndexStats{Ready: s.ready}
+	for _, x := range []ngramIndex{s.entries, s.comments} {
+		stats.Grams += len(x.postings)
+		for _, p := range x.postings {
+			stats.Postings += len(p)
+		}
+	}
+	return stats
+}
+
+// lookup returns the IDs of the newest entries and comments that have every
+// gram of the terms, newest first.
+func (s *SearchIndex) lookup(terms [][]rune, limit int) (entryIDs, commentIDs []int) {
+	var keys []uint64
+	for _, t := range terms {
+		keys = append(keys, termKeys(t)...)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.entries.lookup(keys, limit), s.comments.lookup(keys, limit)
+}
+
+type ngramIndex struct {
+	// postings maps a gram to the IDs that have it, in ascending order.
+	postings map[uint64][]int32
+}
+
+func newNgramIndex() ngramIndex {
+	return ngramIndex{make(map[uint64][]int32)}
+}
+
+func (x ngramIndex) add(id int32, text string) {
+	for g := range textGrams(normalizeText(text)) {
+		p := x.postings[g]
+		n := len(p)
+		if n == 0 || p[n-1] < id {
+			x.postings[g] = append(p, id)
+			continue
+		}
+		// An edit of an older entry: insert in order unless already there.
+		i := sort.Search(n, func(i int) bool { return p[i] >= id })
+		if p[i] == id {
+			continue
+		}
+		p = append(p, 0)
+		copy(p[i+1:], p[i:])
+		p[i] = id
+		x.postings[g] = p
+	}
+}
+
+func (x ngramIndex) lookup(keys []uint64, limit int) []int {
+	if len(keys) == 0 {
+		return nil
+	}
+	lists := make([][]int32, 0, len(keys))
+	for _, k := range keys {
+		p := x.postings[k]
+		if len(p) == 0 {
+			return nil
+		}
+		lists = append(lists, p)
+	}
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+
+	// Walk the shortest list from the newest end and probe the others.
+	ids := make([]int, 0, limit)
+next:
+	for i := len(lists[0]) - 1; i >= 0 && len(ids) < limit; i-- {
+		id := lists[0][i]
+		for _, l := range lists[1:] {
+			j := sort.Search(len(l), func(j int) bool { return l[j] >= id })
+			if j == len(l) || l[j] != id {
+				continue next
+			}
+		}
+		ids = append(ids, int(id))
+	}
+	return ids
+}
+
+// normalizeRune folds case and full-width ASCII one rune at a time, so that
+// positions in the normalized text are positions in the original.
+func normalizeRune(r rune) rune {
+	if r >= '！' && r <= '～' {
+		r -= '！' - '!'
+	}
+	return unicode.ToLower(r)
+}
+
+func normalizeText(s string) []rune {
+	runes := []rune(s)
+	for i, r := range runes {
+		runes[i] = normalizeRune(r)
+	}
+	return runes
+}
+
+func unigramKey(r rune) uint64 {
+	return uint64(r) << 32
+}
+
+func bigramKey(a, b rune) uint64 {
+	return uint64(a)<<32 | uint64(b)
+}
+
+// textGrams returns the characters and bigrams of the text, leaving out
+// those with spaces, which no term has.
+func textGrams(runes []rune) map[uint64]struct{} {
+	grams := make(map[uint64]struct{}, 2*len(runes))
+	for i, r := range runes {
+		if r == 0 || unicode.IsSpace(r) {
+			continue
+		}
+		grams[unigramKey(r)] = struct{}{}
+		if i+1 < len(runes) && runes[i+1] != 0 && !unicode.IsSpace(runes[i+1]) {
+			grams[bigramKey(r, runes[i+1])] = struct{}{}
+		}
+	}
+	return grams
+}
+
+func termKeys(term []rune) []uint64 {
+	if len(term) == 1 {
+		return []uint64{unigramKey(term[0])}
+	}
+	keys := make([]uint64, 0, len(term)-1)
+	for i := 0; i+1 < len(term); i++ {
+		keys = append(keys, bigramKey(term[i], term[i+1]))
+	}
+	return keys
+}
+
+// parseQuery splits the query on spaces into normalized terms, all of which
+// must match.
+func parseQuery(q string) [][]rune {
+	var terms [][]rune
+	for _, f := range strings.Fields(q) {
+		if len(terms) == searchMaxTerms {
+			break
+		}
+		t := normalizeText(f)
+		if len(t) > 0 && t[0] != 0 {
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// matches marks the runes of text covered by a term, and counts the
+// matches. It returns nil when a term does not occur at all.
+func matches(text []rune, terms [][]rune) ([]bool, int) {
+	marked := make([]bool, len(text))
+	total := 0
+	for _, t := range terms {
+		n := 0
+		for i := 0; i+len(t) <= len(text); i++ {
+			if runesEqual(text[i:i+len(t)], t) {
+				for j := range t {
+					marked[i+j] = true
+				}
+				n++
+			}
+		}
+		if n == 0 {
+			return nil, 0
+		}
+		total += n
+	}
+	return marked, total
+}
+
+func runesEqual(a, b []rune) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// highlight escapes the text and wraps the matches in <mark>. With width
+// greater than zero only that many runes around the first match are kept.
+func highlight(s string, terms [][]rune, width int) template.HTML {
+	runes := []rune(s)
+	marked, _ := matches(normalizeText(s), terms)
+	if marked == nil {
+		marked = make([]bool, len(runes))
+	}
+	from, to := 0, len(runes)
+	if width > 0 && len(runes) > width {
+		first := 0
+		for first < len(runes) && !marked[first] {
+			first++
+		}
+		if first == len(runes) {
+			first = 0
+		}
+		from = first - width/4
+		if from < 0 {
+			from = 0
+		}
+		to = from + width
+		if to > len(runes) {
+			to, from = len(runes), len(runes)-width
+		}
+	}
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("…")
+	}
+	for i := from; i < to; {
+		j := i
+		for j < to && marked[j] == marked[i] {
+			j++
+		}
+		text := template.HTMLEscapeString(strings.Replace(string(runes[i:j]), "\n", " ", -1))
+		if marked[i] {
+			text = "<mark>" + text + "</mark>"
+		}
+		b.WriteString(text)
+		i = j
+	}
+	if to < len(runes) {
+		b.WriteString("…")
+	}
+	return template.HTML(b.String())
+}
+
+// SearchResult is an entry, or a comment on one when CommentID is set.
+type SearchResult struct {
+	EntryID     int
+	CommentID   int
+	Title       template.HTML
+	Snippet     template.HTML
+	AccountName string
+	NickName    string
+	CreatedAt   time.Time
+
+	score float64
+}
+
+// score ranks by the number of matches, damped so that many repeats do not
+// bury everything else, and halves every thirty days.
+func score(count int, createdAt time.Time) float64 {
+	age := time.Since(createdAt).Hours() / 24
+	if age < 0 {
+		age = 0
+	}
+	return math.Log1p(float64(count)) * math.Pow(0.5, age/30)
+}
+
+// search returns the entries and comments matching every term of q that
+// user may read, best first.
+func search(user *User, q string) ([]SearchResult, error) {
+	terms := parseQuery(q)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	entryIDs, commentIDs := searchIndex.lookup(terms, searchCandidates)
+
+	var g group
+
+	var entries []Entry
+	g.Go(func() (err error) {
+		entries, err = repo.Entries.ListByIDs(entryIDs)
+		return
+	})
+
+	var comments []Comment
+	commented := make(map[int]Entry)
+	g.Go(func() (err error) {
+		comments, err = repo.Comments.ListByIDs(commentIDs)
+		if err != nil {
+			return err
+		}
+		ids := make([]int, 0, len(comments))
+		for _, c := range comments {
+			ids = append(ids, c.EntryID)
+		}
+		l, err := repo.Entries.ListByIDs(ids)
+		for _, e := range l {
+			commented[e.ID] = e
+		}
+		return err
+	})
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	// The same checks as entryFromPath, with the block and how user is
+	// related to each author remembered.
+	type relation struct {
+		blocked bool
+		w       viewer
+	}
+	relations := make(map[int]relation)
+	canRead := func(e Entry) (bool, error) {
+		rel, seen := relations[e.UserID]
+		if !seen {
+			err := checkBlocked(user.ID, e.UserID)
+			if err == nil {
+				rel.w, err = viewerOf(user.ID, e.UserID)
+			} else if err == ErrBlocked {
+				rel.blocked, err = true, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			relations[e.UserID] = rel
+		}
+		if rel.blocked {
+			return false, nil
+		}
+		return e.readableBy(user.ID, rel.w)
+	}
+	blocked := make(map[int]bool)
+	isBlocked := func(userID int) (bool, error) {
+		b, seen := blocked[userID]
+		if !seen {
+			err := checkBlocked(user.ID, userID)
+			if err != nil && err != ErrBlocked {
+				return false, err
+			}
+			b = err == ErrBlocked
+			blocked[userID] = b
+		}
+		return b, nil
+	}
+
+	results := make([]SearchResult, 0, searchResults)
+	for _, e := range entries {
+		if ok, err := canRead(e); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		_, n := matches(normalizeText(e.Title+"\n"+e.Content), terms)
+		if n == 0 {
+			continue
+		}
+		u, err := getUser(e.UserID)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, SearchResult{
+			EntryID:     e.ID,
+			Title:       highlight(e.Title, terms, 0),
+			Snippet:     highlight(e.Content, terms, snippetWidth),
+			AccountName: u.AccountName,
+			NickName:    u.NickName,
+			CreatedAt:   e.CreatedAt,
+			score:       score(n, e.CreatedAt),
+		})
+	}
+	for _, c := range comments {
+		e, ok := commented[c.EntryID]
+		if !ok {
+			continue
+		}
+		if ok, err := canRead(e); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		if b, err := isBlocked(c.UserID); err != nil {
+			return nil, err
+		} else if b {
+			continue
+		}
+		_, n := matches(normalizeText(c.Comment), terms)
+		if n == 0 {
+			continue
+		}
+		u, err := getUser(c.UserID)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, SearchResult{
+			EntryID:     e.ID,
+			CommentID:   c.ID,
+			Title:       template.HTML(template.HTMLEscapeString(e.Title)),
+			Snippet:     highlight(c.Comment, terms, snippetWidth),
+			AccountName: u.AccountName,
+			NickName:    u.NickName,
+			CreatedAt:   c.CreatedAt,
+			score:       score(n, c.CreatedAt),
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].CreatedAt.After(results[j].CreatedAt)
+	})
+	if len(results) > searchResults {
+		results = results[:searchResults]
+	}
+	return results, nil
+}
+
+// rebuildSearchIndex builds the index in the background at startup; until
+// it is done, search covers only what has been written since.
+func rebuildSearchIndex() {
+	start := time.Now()
+	if err := searchIndex.Rebuild(); err != nil {
+		log.Printf("Failed to build the search index: %s.", err.Error())
+		return
+	}
+	log.Printf("built the search index in %s", time.Since(start))
+}
+
+func GetSearch(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
+
+	q := r.FormValue("q")
+	results, err := search(user, q)
+	if err != nil {
+		return err
+	}
+	return render(w, r, http.StatusOK, "search.html", struct {
+		Query   string
+		Ready   bool
+		Results []SearchResult
+	}{q, searchIndex.Ready(), results})
+}
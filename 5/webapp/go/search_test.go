@@ -0,0 +1,216 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSearchPage(t *testing.T) {
+	srv := newTestServer(t)
+	alice, bob, carol := loggedIn(t, srv, "alice"), loggedIn(t, srv, "bob"), loggedIn(t, srv, "carol")
+	befriend(alice, bob, "alice", "bob")
+	alice.post("/diary/entry", url.Values{"title": {"東京旅行"}, "content": {"今日は東京タワーに行きました。<b>楽しい</b>"}})
+	alice.post("/diary/entry", url.Values{"title": {"秘密"}, "content": {"東京の秘密の話"}, "visibility": {"friends"}})
+	bob.post("/diary/comment/1", url.Values{"comment": {"ＴＯＫＹＯいいですね"}})
+	search := func(c *testClient, q string) string {
+		_, body := c.get("/search?q=" + url.QueryEscape(q))
+		return body
+	}
+
+	body := search(carol, "東京")
+	wantBody(t, "search", body, "<mark>東京</mark>", "/diary/entry/1", "&lt;b&gt;")
+	wantNoBody(t, "search by a stranger", body, "秘密の話")
+	wantBody(t, "search by a friend", search(bob, "秘密"), "<mark>秘密</mark>の話")
+	wantBody(t, "comments", search(carol, "tokyo"), "へのコメント", "<mark>ＴＯＫＹＯ</mark>")
+
+	alice.post("/diary/entry/1", url.Values{"title": {"大阪旅行"}, "content": {"通天閣"}})
+	wantBody(t, "edited entry", search(carol, "通天閣"), "/diary/entry/1")
+	wantBody(t, "text before the edit", search(carol, "タワー"), "見つかりませんでした")
+	alice.post("/diary/entry/1/delete", nil)
+	wantNoBody(t, "deleted entry", search(carol, "通天閣"), `/diary/entry/1"`)
+
+	carol.post("/blocks/alice", nil)
+	wantBody(t, "entries of the blocked", search(carol, "東京"), "見つかりませんでした")
+}
+
+func TestNgramIndex(t *testing.T) {
+	type doc struct {
+		id   int32
+		text string
+	}
+	tests := []struct {
+		name  string
+		docs  []doc
+		query string
+		limit int
+		want  []int
+	}{
+		{"bigram", []doc{{1, "東京タワー"}, {2, "京都タワー"}}, "東京", 10, []int{1}},
+		{"newest first", []doc{{1, "東京タワー"}, {2, "京都タワー"}}, "タワー", 10, []int{2, 1}},
+		{"single character", []doc{{1, "東京タワー"}, {2, "京都タワー"}}, "京", 10, []int{2, 1}},
+		{"reversed", []doc{{1, "東京タワー"}}, "京東", 10, nil},
+		{"unknown gram", []doc{{1, "東京タワー"}}, "大阪", 10, nil},
+		// Every bigram of the term is in the text, but not next to each
+		// other; search drops these when it checks the text.
+		{"scattered bigrams", []doc{{1, "東京と京都"}}, "東京都", 10, []int{1}},
+		{"across a space", []doc{{1, "東京 タワー"}}, "京タ", 10, nil},
+		{"all terms", []doc{{1, "東京タワー"}, {2, "東京駅"}, {3, "京都駅"}}, "東京 駅", 10, []int{2}},
+		{"full width", []doc{{1, "ＴＯＫＹＯ Tower"}}, "tokyo TOWER", 10, []int{1}},
+		{"limit", []doc{{1, "東京"}, {2, "東京"}, {3, "東京"}}, "東京", 2, []int{3, 2}},
+		{"edit of an older entry", []doc{{1, "大阪"}, {3, "東京"}, {5, "東京"}, {1, "東京"}}, "東京", 10, []int{5, 3, 1}},
+		{"edit in the middle", []doc{{1, "東京"}, {5, "東京"}, {3, "東京"}, {3, "東京タワー"}}, "東京", 10, []int{5, 3, 1}},
+		{"old text stays", []doc{{1, "大阪"}, {2, "京都"}, {1, "東京"}}, "大阪", 10, []int{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x := newNgramIndex()
+			for _, d := range tt.docs {
+				x.add(d.id, d.text)
+			}
+			for g, p := range x.postings {
+				for i := 1; i < len(p); i++ {
+					if p[i-1] >= p[i] {
+						t.Fatalf("postings of %x are not strictly ascending: %v", g, p)
+					}
+				}
+			}
+
+			var keys []uint64
+			for _, term := range parseQuery(tt.query) {
+				keys = append(keys, termKeys(term)...)
+			}
+			if got := x.lookup(keys, tt.limit); !reflect.DeepEqual(got, tt.want) && (len(got) > 0 || len(tt.want) > 0) {
+				t.Errorf("lookup %q: got %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		q    string
+		want []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"東京", []string{"東京"}},
+		{"  東京  タワー ", []string{"東京", "タワー"}},
+		{"東京　タワー", []string{"東京", "タワー"}},
+		{"ＴＯＫＹＯ Tower", []string{"tokyo", "tower"}},
+		{"Ｔｏｋｙｏ１２３！", []string{"tokyo123!"}},
+		{"a b c d e f g", []string{"a", "b", "c", "d", "e"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, term := range parseQuery(tt.q) {
+			got = append(got, string(term))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseQuery(%q) = %q, want %q", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		name  string
+		s     string
+		q     string
+		width int
+		want  string
+	}{
+		{"match", "東京タワー", "東京", 0, "<mark>東京</mark>タワー"},
+		{"every match", "東京と東京", "東京", 0, "<mark>東京</mark>と<mark>東京</mark>"},
+		{"every term", "東京タワー", "タワー 東京", 0, "<mark>東京タワー</mark>"},
+		{"no match", "東京タワー", "大阪", 0, "東京タワー"},
+		{"escaped", `<b>東京</b>&"`, "東京", 0, "&lt;b&gt;<mark>東京</mark>&lt;/b&gt;&amp;&#34;"},
+		{"newlines", "東京\nタワー", "タワー", 0, "東京 <mark>タワー</mark>"},
+		{"full width text", "ＴＯＫＹＯ Tower", "tokyo", 0, "<mark>ＴＯＫＹＯ</mark> Tower"},
+		{"full width query", "Tokyo Tower", "ＴＯＷＥＲ", 0, "Tokyo <mark>Tower</mark>"},
+		{"shorter than the window", "東京タワー", "東京", 20, "<mark>東京</mark>タワー"},
+		{"window around the match", strings.Repeat("あ", 50) + "東京" + strings.Repeat("い", 50), "東京", 20,
+			"…" + strings.Repeat("あ", 5) + "<mark>東京</mark>" + strings.Repeat("い", 13) + "…"},
+		{"window at the start", "東京" + strings.Repeat("い", 50), "東京", 20,
+			"<mark>東京</mark>" + strings.Repeat("い", 18) + "…"},
+		{"window at the end", strings.Repeat("あ", 50) + "東京", "東京", 20,
+			"…" + strings.Repeat("あ", 18) + "<mark>東京</mark>"},
+		{"window without a match", strings.Repeat("あ", 50), "東京", 20, strings.Repeat("あ", 20) + "…"},
+	}
+	for _, tt := range tests {
+		if got := highlight(tt.s, parseQuery(tt.q), tt.width); string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestSearchPrivacy searches the same words as the author, a friend in a
+// list, a friend of a friend and a stranger: only the entries each of them
+// may read, and the comments on those, are found.
+func TestSearchPrivacy(t *testing.T) {
+	srv := newTestServer(t)
+	alice, bob, carol := loggedIn(t, srv, "alice"), loggedIn(t, srv, "bob"), loggedIn(t, srv, "carol")
+	befriend(alice, bob, "alice", "bob")
+	befriend(bob, carol, "bob", "carol")
+	alice.post("/friends/lists", url.Values{"name": {"close"}})
+	alice.post("/friends/lists/1/members", url.Values{"account_name": {"bob"}})
+
+	for _, form := range []url.Values{
+		{"visibility": {"everyone"}},
+		{"visibility": {"friends_of_friends"}},
+		{"visibility": {"friends"}},
+		{"visibility": {"list"}, "list_id": {"1"}},
+		{"visibility": {"me"}},
+		{"private": {"1"}},
+	} {
+		form.Set("title", "日記")
+		form.Set("content", "東京タワーに行きました")
+		if code, _ := alice.post("/diary/entry", form); code != http.StatusSeeOther {
+			t.Fatalf("post %v: status %d", form, code)
+		}
+	}
+	bob.post("/diary/comment/3", url.Values{"comment": {"東京いいですね"}})
+
+	tests := []struct {
+		account  string
+		entries  []int
+		comments []int
+	}{
+		{"alice", []int{1, 2, 3, 4, 5, 6}, []int{1}},
+		{"bob", []int{1, 2, 3, 4, 6}, []int{1}},
+		{"carol", []int{1, 2}, nil},
+		{"dave", []int{1}, nil},
+	}
+	for _, tt := range tests {
+		user, err := userCache.FromAccount(tt.account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, q := range []string{"東京", "京タ", "東"} {
+			results, err := search(user, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var entries, comments []int
+			for _, r := range results {
+				if r.CommentID != 0 {
+					comments = append(comments, r.CommentID)
+				} else {
+					entries = append(entries, r.EntryID)
+				}
+			}
+			sort.Ints(entries)
+			sort.Ints(comments)
+			wantComments := tt.comments
+			if q == "京タ" {
+				wantComments = nil
+			}
+			if !reflect.DeepEqual(entries, tt.entries) || !reflect.DeepEqual(comments, wantComments) {
+				t.Errorf("%s searching %q: entries %v, comments %v; want %v, %v", tt.account, q, entries, comments, tt.entries, wantComments)
+			}
+		}
+	}
+}
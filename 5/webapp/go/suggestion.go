@@ -0,0 +1,238 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// suggestionCandidates is how many suggestions are kept per user, enough
+	// to fill the page after those who became friends, were blocked or were
+	// dismissed since the last rebuild are left out.
+	suggestionCandidates = 100
+	// suggestionVisitDays is how far back footprints count.
+	suggestionVisitDays = 30
+
+	// A shared prefecture and a recent visit each count as much as this many
+	// mutual friends.
+	suggestionPrefWeight  = 2
+	suggestionVisitWeight = 3
+)
+
+// Suggestion is a friend of a friend the user may know.
+type Suggestion struct {
+	UserID   int
+	Mutual   int
+	SamePref bool
+	// Visited is set when either has left a footprint on the other's pages
+	// recently.
+	Visited bool
+
+	AccountName string
+	NickName    string
+
+	score int
+}
+
+// SuggestionEngine ranks the friends of friends of every user by the number
+// of mutual friends, a shared prefecture and recent footprints. Rankings are
+// rebuilt from the repository in the background; List checks friendships,
+// blocks and dismissals as they are now, so that changes since the last
+// rebuild show at once.
+type SuggestionEngine struct {
+	interval time.Duration
+
+	mu          sync.RWMutex
+	suggestions map[int][]Suggestion
+	builtAt     time.Time
+	took        time.Duration
+}
+
+type SuggestionEngineStats struct {
+	Users   int
+	BuiltAt time.Time
+	Took    string
+}
+
+var suggestionEngine *SuggestionEngine
+
+func NewSuggestionEngine(interval time.Duration) *SuggestionEngine {
+	return &SuggestionEngine{interval: interval, suggestions: make(map[int][]Suggestion)}
+}
+
+// Run rebuilds the suggestions now and then every interval. It never returns.
+func (e *SuggestionEngine) Run() {
+	for {
+		if err := e.Rebuild(); err != nil {
+			log.Printf("Failed to build friend suggestions: %s.", err.Error())
+		}
+		time.Sleep(e.interval)
+	}
+}
+
+// Rebuild ranks the suggestions for every user who has a friend.
+func (e *SuggestionEngine) Rebuild() error {
+	start := time.Now()
+	friends := friendGraph.Adjacency()
+
+	var g group
+
+	var prefs map[int]string
+	g.Go(func() (err error) {
+		prefs, err = repo.Profiles.ListPrefectures()
+		return
+	})
+
+	var visits []DailyFootprint
+	g.Go(func() (err error) {
+		visits, err = repo.Footprints.ListSince(start.AddDate(0, 0, -suggestionVisitDays))
+		return
+	})
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	visited := make(map[Friendship]bool, len(visits))
+	for _, v := range visits {
+		visited[Friendship{v.UserID, v.OwnerID}] = true
+		visited[Friendship{v.OwnerID, v.UserID}] = true
+	}
+
+	suggestions := make(map[int][]Suggestion, len(friends))
+	mutual := make(map[int]int)
+	for userID, fs := range friends {
+		for _, f := range fs {
+			for _, ff := range friends[f] {
+				mutual[ff]++
+			}
+		}
+		delete(mutual, userID)
+		for _, f := range fs {
+			delete(mutual, f)
+		}
+
+		ranked := make([]Suggestion, 0, len(mutual))
+		for id, n := range mutual {
+			s := Suggestion{UserID: id, Mutual: n, score: n}
+			if pref, ok := prefs[userID]; ok && prefs[id] == pref {
+				s.SamePref = true
+				s.score += suggestionPrefWeight
+			}
+			if visited[Friendship{userID, id}] {
+				s.Visited = true
+				s.score += suggestionVisitWeight
+			}
+			ranked = append(ranked, s)
+			delete(mutual, id)
+		}
+		sort.Slice(ranked, func(i, j int) bool {
+			if ranked[i].score != ranked[j].score {
+				return ranked[i].score > ranked[j].score
+			}
+			return ranked[i].UserID < ranked[j].UserID
+		})
+		if len(ranked) > suggestionCandidates {
+			ranked = ranked[:suggestionCandidates]
+		}
+		// Copy, so that the rest of the ranking can be collected.
+		suggestions[userID] = append([]Suggestion(nil), ranked...)
+	}
+
+	e.mu.Lock()
+	e.suggestions, e.builtAt, e.took = suggestions, start, time.Since(start)
+	e.mu.Unlock()
+	return nil
+}
+
+// List returns up to limit suggestions for the user, best first.
+func (e *SuggestionEngine) List(userID int, limit int) ([]Suggestion, error) {
+	e.mu.RLock()
+	candidates := e.suggestions[userID]
+	e.mu.RUnlock()
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	ids, err := repo.Suggestions.ListDismissed(userID)
+	if err != nil {
+		return nil, err
+	}
+	dismissed := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		dismissed[id] = true
+	}
+
+	suggestions := make([]Suggestion, 0, limit)
+	for _, s := range candidates {
+		if len(suggestions) == limit {
+			break
+		}
+		if dismissed[s.UserID] {
+			continue
+		}
+		if friend, err := isFriend(userID, s.UserID); err != nil {
+			return nil, err
+		} else if friend {
+			continue
+		}
+		if blocked, err := repo.Blocks.Between(userID, s.UserID); err != nil {
+			return nil, err
+		} else if blocked {
+			continue
+		}
+		u, err := getUser(s.UserID)
+		if err == ErrContentNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		s.AccountName, s.NickName = u.AccountName, u.NickName
+		suggestions = append(suggestions, s)
+	}
+	return suggestions, nil
+}
+
+func (e *SuggestionEngine) Stats() SuggestionEngineStats {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return SuggestionEngineStats{len(e.suggestions), e.builtAt, e.took.String()}
+}
+
+func GetSuggestions(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
+
+	suggestions, err := suggestionEngine.List(user.ID, 50)
+	if err != nil {
+		return err
+	}
+	return render(w, r, http.StatusOK, "suggestions.html", struct {
+		Suggestions []Suggestion
+	}{suggestions})
+}
+
+// PostSuggestionDismiss hides the user from the suggestions for good.
+func PostSuggestionDismiss(w http.ResponseWriter, r *http.Request) error {
+	user := authenticated(w, r)
+	if user == nil {
+		return nil
+	}
+
+	other, err := getUserFromAccount(mux.Vars(r)["account_name"])
+	if err != nil {
+		return err
+	}
+	if err := repo.Suggestions.Dismiss(user.ID, other.ID); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/friends/suggestions", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSuggestions(t *testing.T) {
+	srv := newTestServer(t)
+	names := []string{"alice", "bob", "carol", "dave", "erin", "frank"}
+	users := make([]User, len(names))
+	for i, name := range names {
+		users[i] = testUser(i+1, name)
+	}
+	setupGlobals(t, users)
+
+	// dave has two friends in common with alice, erin one, and frank one
+	// and also lives in the same prefecture and visited her.
+	for _, f := range [][2]int{{1, 2}, {1, 3}, {2, 4}, {3, 4}, {2, 5}, {3, 6}} {
+		if err := friendGraph.Create(f[0], f[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []int{1, 6} {
+		if err := repo.Profiles.Update(id, "", "", "", "", "東京都"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	footprintRecorder.Mark(6, 1)
+	if err := footprintRecorder.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := suggestionEngine.Rebuild(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := suggestionEngine.List(1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range l {
+		got = append(got, s.AccountName)
+	}
+	if strings.Join(got, ",") != "frank,dave,erin" {
+		t.Fatalf("suggestions %v, want frank, dave, erin", got)
+	}
+
+	alice := loggedIn(t, srv, "alice")
+	_, body := alice.get("/")
+	wantBody(t, "index", body, "DAVEさん</a> 共通の友だち2人")
+	_, body = alice.get("/friends/suggestions")
+	wantBody(t, "suggestions", body, "同じ県", "ERIN")
+
+	code, _ := alice.post("/friends/suggestions/erin/dismiss", nil)
+	wantStatus(t, "dismiss", code, http.StatusSeeOther)
+	alice.post("/blocks/frank", nil)
+	if err := friendGraph.Create(1, 4); err != nil {
+		t.Fatal(err)
+	}
+	_, body = alice.get("/friends/suggestions")
+	wantNoBody(t, "suggestions", body, "ERIN", "FRANK", "DAVE")
+	code, _ = alice.post("/friends/suggestions/nobody/dismiss", nil)
+	wantStatus(t, "dismiss an unknown user", code, http.StatusNotFound)
+}
@@ -0,0 +1,71 @@
+package main
+
+// maxCommentDepth is how deep replies nest: top-level comments are at depth
+// 0. A reply to a comment this deep is put next to it instead, under the
+// same parent, so that threads never run off the side of the page.
+const maxCommentDepth = 3
+
+// place makes the comment a reply to parent.
+func (c *Comment) place(parent *Comment) {
+	c.ThreadID = parent.ThreadID
+	if c.ThreadID == 0 {
+		c.ThreadID = parent.ID
+	}
+	c.ParentID, c.Depth = parent.ID, parent.Depth+1
+	if parent.Depth >= maxCommentDepth {
+		c.ParentID, c.Depth = parent.ParentID, parent.Depth
+	}
+}
+
+// loadThreads returns a page of the comment threads on the entry, oldest
+// thread first, in reading order: every comment is followed by its replies,
+// oldest first. Pages are counted in threads, so a thread is never split.
+func loadThreads(entryID int, q PageQuery) ([]EComment, Page, error) {
+	threads, err := repo.Comments.ListByEntry(entryID, q)
+	if err != nil {
+		return nil, Page{}, err
+	}
+	from, to, page := paginate(q, len(threads), func(i int) Cursor { return Cursor{threads[i].CreatedAt, threads[i].ID} })
+	threads = threads[from:to]
+
+	ids := make([]int, 0, len(threads))
+	for _, c := range threads {
+		ids = append(ids, c.ID)
+	}
+	replies, err := repo.Comments.ListReplies(ids)
+	if err != nil {
+		return nil, Page{}, err
+	}
+	return flattenThreads(threads, replies), page, nil
+}
+
+// flattenThreads puts the replies under their top-level comments. Deleted
+// comments are kept, without their text and author, only while some reply
+// under them is not deleted.
+func flattenThreads(threads, replies []EComment) []EComment {
+	children := make(map[int][]EComment)
+	for _, c := range replies {
+		children[c.ParentID] = append(children[c.ParentID], c)
+	}
+
+	var walk func(c EComment) []EComment
+	walk = func(c EComment) []EComment {
+		var below []EComment
+		for _, r := range children[c.ID] {
+			below = append(below, walk(r)...)
+		}
+		if c.Deleted {
+			if len(below) == 0 {
+				return nil
+			}
+			c.Comment, c.NickName, c.AccountName = "", "", ""
+		}
+		return append([]EComment{c}, below...)
+	}
+
+	comments := make([]EComment, 0, len(threads)+len(replies))
+	for _, c := range threads {
+		comments = append(comments, walk(c)...)
+	}
+	return comments
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCommentPlace(t *testing.T) {
+	// Each comment replies to the one before it.
+	chain := []Comment{{ID: 1}}
+	for id := 2; id <= 7; id++ {
+		c := Comment{ID: id}
+		c.place(&chain[len(chain)-1])
+		chain = append(chain, c)
+	}
+	want := []struct{ thread, parent, depth int }{
+		{0, 0, 0},
+		{1, 1, 1},
+		{1, 2, 2},
+		{1, 3, 3},
+		// Past maxCommentDepth, replies go next to the comment they answer.
+		{1, 3, 3},
+		{1, 3, 3},
+		{1, 3, 3},
+	}
+	for i, c := range chain {
+		if w := want[i]; c.ThreadID != w.thread || c.ParentID != w.parent || c.Depth != w.depth {
+			t.Errorf("comment %d: thread %d, parent %d, depth %d; want %d, %d, %d", c.ID, c.ThreadID, c.ParentID, c.Depth, w.thread, w.parent, w.depth)
+		}
+	}
+}
+
+func TestFlattenThreads(t *testing.T) {
+	// c is a comment by its ID; the author and text say which one it is.
+	c := func(id, parentID, depth int, deleted bool) EComment {
+		return EComment{ID: id, ParentID: parentID, Depth: depth, Deleted: deleted,
+			Comment: fmt.Sprint("comment ", id), NickName: fmt.Sprint("nick ", id), AccountName: fmt.Sprint("account", id)}
+	}
+	tests := []struct {
+		name    string
+		threads []EComment
+		replies []EComment
+		// want lists the comments shown in order, with "-" after the ID of
+		// those shown as deleted.
+		want string
+	}{
+		{"no replies", []EComment{c(1, 0, 0, false), c(5, 0, 0, false)}, nil, "1 5"},
+		{"replies under their parents",
+			[]EComment{c(1, 0, 0, false), c(5, 0, 0, false)},
+			[]EComment{c(2, 1, 1, false), c(3, 2, 2, false), c(4, 1, 1, false), c(6, 5, 1, false)},
+			"1 2 3 4 5 6"},
+		// 5 and 6 replied to comments at maxCommentDepth and were put next to
+		// them, under 3.
+		{"past the depth limit",
+			[]EComment{c(1, 0, 0, false)},
+			[]EComment{c(2, 1, 1, false), c(3, 2, 2, false), c(4, 3, 3, false), c(5, 3, 3, false), c(6, 3, 3, false), c(7, 2, 2, false)},
+			"1 2 3 4 5 6 7"},
+		{"deleted leaf",
+			[]EComment{c(1, 0, 0, false)},
+			[]EComment{c(2, 1, 1, false), c(3, 2, 2, true)},
+			"1 2"},
+		{"deleted top-level comment without replies", []EComment{c(1, 0, 0, true), c(2, 0, 0, false)}, nil, "2"},
+		{"deleted parent with a live reply",
+			[]EComment{c(1, 0, 0, false)},
+			[]EComment{c(2, 1, 1, true), c(3, 2, 2, false)},
+			"1 2- 3"},
+		{"deleted top-level comment with a live reply",
+			[]EComment{c(1, 0, 0, true)},
+			[]EComment{c(2, 1, 1, false)},
+			"1- 2"},
+		{"deleted comments with only deleted replies",
+			[]EComment{c(1, 0, 0, true), c(4, 0, 0, false)},
+			[]EComment{c(2, 1, 1, true), c(3, 2, 2, true), c(5, 4, 1, true), c(6, 5, 2, true)},
+			"4"},
+		{"live reply deep under deleted ones",
+			[]EComment{c(1, 0, 0, true)},
+			[]EComment{c(2, 1, 1, true), c(3, 2, 2, true), c(4, 3, 3, true), c(5, 3, 3, false)},
+			"1- 2- 3- 5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, e := range flattenThreads(tt.threads, tt.replies) {
+				id := fmt.Sprint(e.ID)
+				if e.Deleted {
+					id += "-"
+					if blank := (EComment{ID: e.ID, ParentID: e.ParentID, Depth: e.Depth, Deleted: true}); !reflect.DeepEqual(e, blank) {
+						t.Errorf("deleted comment %d is shown as %+v", e.ID, e)
+					}
+				} else if want := c(e.ID, e.ParentID, e.Depth, false); !reflect.DeepEqual(e, want) {
+					t.Errorf("comment %d is shown as %+v", e.ID, e)
+				}
+				got = append(got, id)
+			}
+			if s := strings.Join(got, " "); s != tt.want {
+				t.Errorf("got %q, want %q", s, tt.want)
+			}
+		})
+	}
+}
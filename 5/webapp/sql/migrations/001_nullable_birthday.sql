@@ -0,0 +1,2 @@
+-- Profiles created by /signup have no birthday yet.
+ALTER TABLE profiles MODIFY `birthday` date NULL;
@@ -0,0 +1,21 @@
+-- Split entries.body (title + "\n" + content) into its own columns.
+--
+-- The app reads title and content when they are set and falls back to
+-- splitting body while they are NULL, and it writes all three columns, so
+-- this can run while the app is serving.
+
+ALTER TABLE entries
+  ADD COLUMN `title` text AFTER `private`,
+  ADD COLUMN `content` text AFTER `title`;
+
+-- Backfill in chunks to keep the locks short. Repeat until no rows are
+-- affected.
+UPDATE entries
+SET
+  title = SUBSTRING_INDEX(body, '\n', 1),
+  content = IF(LOCATE('\n', body) > 0, SUBSTRING(body, LOCATE('\n', body) + 1), '')
+WHERE title IS NULL AND body IS NOT NULL
+LIMIT 10000;
+
+-- Once every app server writes title and content, body can go:
+-- ALTER TABLE entries DROP COLUMN `body`;
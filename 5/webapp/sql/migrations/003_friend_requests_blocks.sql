@@ -0,0 +1,19 @@
+-- Friendship now needs the other side to accept, and users can block each other.
+
+CREATE TABLE IF NOT EXISTS friend_requests (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `from_id` int NOT NULL,
+  `to_id` int NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY `request` (`from_id`, `to_id`),
+  KEY `idx_to_id_created_at` (`to_id`, `created_at`)
+) DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS blocks (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` int NOT NULL,
+  `blocked_id` int NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY `block` (`user_id`, `blocked_id`),
+  KEY `blocked_id` (`blocked_id`)
+) DEFAULT CHARSET=utf8;
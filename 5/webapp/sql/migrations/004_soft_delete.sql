@@ -0,0 +1,4 @@
+-- Deleted entries and comments are kept with deleted_at set.
+
+ALTER TABLE entries ADD COLUMN `deleted_at` timestamp NULL DEFAULT NULL;
+ALTER TABLE comments ADD COLUMN `deleted_at` timestamp NULL DEFAULT NULL;
@@ -0,0 +1,12 @@
+-- Entries of friends for every user, filled in when entries are posted and
+-- friendships form. Run `app -backfill-timelines` once after creating it.
+
+CREATE TABLE IF NOT EXISTS timelines (
+  `user_id` int NOT NULL,
+  `entry_id` int NOT NULL,
+  `author_id` int NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`user_id`, `entry_id`),
+  KEY `idx_user_id_created_at` (`user_id`, `created_at`),
+  KEY `idx_user_id_author_id` (`user_id`, `author_id`)
+) DEFAULT CHARSET=utf8;
@@ -0,0 +1,15 @@
+-- Comments by friends for every user, filled in when comments are posted and
+-- friendships form. Run `app -backfill-comment-feeds` once after creating it.
+
+CREATE TABLE IF NOT EXISTS comment_feeds (
+  `user_id` int NOT NULL,
+  `comment_id` int NOT NULL,
+  `commenter_id` int NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`user_id`, `comment_id`),
+  KEY `idx_user_id_created_at` (`user_id`, `created_at`),
+  KEY `idx_user_id_commenter_id` (`user_id`, `commenter_id`)
+) DEFAULT CHARSET=utf8;
+
+-- Connect and the backfill copy the comments of one user at a time.
+ALTER TABLE comments ADD KEY `idx_user_id_created_at` (`user_id`, `created_at`);
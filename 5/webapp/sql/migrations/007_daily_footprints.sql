@@ -0,0 +1,19 @@
+-- One row per visited user, visitor and day, written in batches by the app.
+-- footprints is no longer written to; it only keeps the initial data that
+-- /initialize resets daily_footprints to.
+
+CREATE TABLE IF NOT EXISTS daily_footprints (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` int NOT NULL,
+  `owner_id` int NOT NULL,
+  `date` date NOT NULL,
+  `updated` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY `user_id_owner_id_date` (`user_id`, `owner_id`, `date`),
+  KEY `idx_user_id_updated` (`user_id`, `updated`, `id`)
+) DEFAULT CHARSET=utf8;
+
+INSERT INTO daily_footprints (user_id, owner_id, date, updated)
+SELECT user_id, owner_id, DATE(created_at), MAX(created_at)
+FROM footprints
+GROUP BY user_id, owner_id, DATE(created_at)
+ORDER BY MAX(created_at), MAX(id);
@@ -0,0 +1,21 @@
+-- Notifications per recipient, and the types each user has turned off.
+
+CREATE TABLE IF NOT EXISTS notifications (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` int NOT NULL,
+  `type` varchar(32) NOT NULL,
+  `actor_id` int NOT NULL,
+  `entry_id` int NOT NULL DEFAULT 0,
+  `dedup_key` varchar(64) DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `read_at` timestamp NULL DEFAULT NULL,
+  UNIQUE KEY `user_id_dedup_key` (`user_id`, `dedup_key`),
+  KEY `idx_user_id_created_at` (`user_id`, `created_at`),
+  KEY `idx_user_id_read_at` (`user_id`, `read_at`)
+) DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS notification_optouts (
+  `user_id` int NOT NULL,
+  `type` varchar(32) NOT NULL,
+  PRIMARY KEY (`user_id`, `type`)
+) DEFAULT CHARSET=utf8;
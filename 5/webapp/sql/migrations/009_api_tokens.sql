@@ -0,0 +1,8 @@
+-- Tokens of the JSON API, stored as the SHA-256 hash of the token.
+
+CREATE TABLE IF NOT EXISTS api_tokens (
+  `token_hash` char(64) NOT NULL PRIMARY KEY,
+  `user_id` int NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  KEY `user_id` (`user_id`)
+) DEFAULT CHARSET=utf8;
@@ -0,0 +1,10 @@
+-- updated_at stays NULL until an entry is edited; readers fall back to
+-- created_at. feed_tokens holds the secret in each user's friends feed URL.
+
+ALTER TABLE entries ADD COLUMN `updated_at` timestamp NULL DEFAULT NULL;
+
+CREATE TABLE IF NOT EXISTS feed_tokens (
+  `user_id` int NOT NULL PRIMARY KEY,
+  `token` char(64) NOT NULL,
+  UNIQUE KEY `token` (`token`)
+) DEFAULT CHARSET=utf8;
@@ -0,0 +1,13 @@
+-- Images attached to entries. The files are kept outside the database, in
+-- the directory named by ISUCON5_IMAGE_DIR.
+
+CREATE TABLE IF NOT EXISTS entry_images (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `entry_id` int NOT NULL,
+  `user_id` int NOT NULL,
+  `content_type` varchar(32) NOT NULL,
+  `width` int NOT NULL,
+  `height` int NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  KEY `entry_id` (`entry_id`)
+) DEFAULT CHARSET=utf8;
@@ -0,0 +1,13 @@
+-- Who may see each field of a profile: 'everyone', 'friends' or 'me'.
+-- Users without a row get the defaults, which match what profiles showed
+-- before: names to everyone and the rest to friends.
+
+CREATE TABLE IF NOT EXISTS profile_visibilities (
+  `user_id` int NOT NULL PRIMARY KEY,
+  `first_name` varchar(8) NOT NULL DEFAULT 'everyone',
+  `last_name` varchar(8) NOT NULL DEFAULT 'everyone',
+  `sex` varchar(8) NOT NULL DEFAULT 'friends',
+  `birthday` varchar(8) NOT NULL DEFAULT 'friends',
+  `pref` varchar(8) NOT NULL DEFAULT 'friends',
+  `email` varchar(8) NOT NULL DEFAULT 'friends'
+) DEFAULT CHARSET=utf8;
@@ -0,0 +1,8 @@
+-- Friend suggestions the user has asked not to see again.
+
+CREATE TABLE IF NOT EXISTS suggestion_dismissals (
+  `user_id` int NOT NULL,
+  `dismissed_id` int NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`user_id`, `dismissed_id`)
+) DEFAULT CHARSET=utf8;
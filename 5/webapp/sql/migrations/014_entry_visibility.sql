@@ -0,0 +1,37 @@
+-- Replace entries.private with visibility levels: 'everyone',
+-- 'friends_of_friends', 'friends', 'list' or 'me'. list_id is the friend
+-- list an entry is shared with when visibility is 'list', and 0 otherwise.
+--
+-- While visibility is NULL the app reads private as before: 1 is 'friends'
+-- and 0 is 'everyone'. It keeps writing private, 1 for anything but
+-- 'everyone', for readers that predate visibility, so this can run while
+-- the app is serving.
+
+ALTER TABLE entries
+  ADD COLUMN `visibility` varchar(20) DEFAULT NULL AFTER `private`,
+  ADD COLUMN `list_id` int NOT NULL DEFAULT 0 AFTER `visibility`;
+
+CREATE TABLE IF NOT EXISTS friend_lists (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` int NOT NULL,
+  `name` varchar(64) NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  KEY `user_id` (`user_id`)
+) DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS friend_list_members (
+  `list_id` int NOT NULL,
+  `user_id` int NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`list_id`, `user_id`)
+) DEFAULT CHARSET=utf8;
+
+-- Backfill in chunks to keep the locks short. Repeat until no rows are
+-- affected.
+UPDATE entries
+SET visibility = IF(private = 1, 'friends', 'everyone')
+WHERE visibility IS NULL
+LIMIT 10000;
+
+-- Once every app server reads visibility, private can go:
+-- ALTER TABLE entries DROP COLUMN `private`;
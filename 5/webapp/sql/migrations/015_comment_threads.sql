@@ -0,0 +1,10 @@
+-- Replies to comments. parent_id is the comment replied to and thread_id the
+-- top-level comment the reply is under; both are 0 for top-level comments,
+-- which every existing row is, so no backfill is needed. depth counts from 0
+-- at the top level.
+
+ALTER TABLE comments
+  ADD COLUMN `parent_id` int NOT NULL DEFAULT 0 AFTER `user_id`,
+  ADD COLUMN `thread_id` int NOT NULL DEFAULT 0 AFTER `parent_id`,
+  ADD COLUMN `depth` tinyint NOT NULL DEFAULT 0 AFTER `thread_id`,
+  ADD KEY `thread_id` (`thread_id`);
@@ -24,13 +24,33 @@ CREATE TABLE IF NOT EXISTS relations (
   KEY `idx_one_another_created_at` (`one`, `another`, `created_at`)
 ) DEFAULT CHARSET=utf8;
 
+-- DROP TABLE IF EXISTS friend_requests;
+CREATE TABLE IF NOT EXISTS friend_requests (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `from_id` int NOT NULL,
+  `to_id` int NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY `request` (`from_id`, `to_id`),
+  KEY `idx_to_id_created_at` (`to_id`, `created_at`)
+) DEFAULT CHARSET=utf8;
+
+-- DROP TABLE IF EXISTS blocks;
+CREATE TABLE IF NOT EXISTS blocks (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` int NOT NULL,
+  `blocked_id` int NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY `block` (`user_id`, `blocked_id`),
+  KEY `blocked_id` (`blocked_id`)
+) DEFAULT CHARSET=utf8;
+
 -- DROP TABLE IF EXISTS profiles;
 CREATE TABLE IF NOT EXISTS profiles (
   `user_id` int NOT NULL PRIMARY KEY,
   `first_name` varchar(64) NOT NULL,
   `last_name` varchar(64) NOT NULL,
   `sex` varchar(4) NOT NULL,
-  `birthday` date NOT NULL, -- yyyy-mm-dd
+  `birthday` date, -- yyyy-mm-dd, NULL until the user sets it
   `pref` varchar(4) NOT NULL,
   `updated_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
 ) DEFAULT CHARSET=utf8mb4;
@@ -39,9 +59,15 @@ CREATE TABLE IF NOT EXISTS profiles (
 CREATE TABLE IF NOT EXISTS entries (
   `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `user_id` int NOT NULL,
-  `private` tinyint NOT NULL,
-  `body` text,
+  `private` tinyint NOT NULL, -- visibility <> 'everyone', kept until every reader uses visibility
+  `visibility` varchar(20) DEFAULT NULL, -- NULL until backfilled from private
+  `list_id` int NOT NULL DEFAULT 0,
+  `title` text,
+  `content` text,
+  `body` text, -- title + "\n" + content, kept until every reader uses title and content
   `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `deleted_at` timestamp NULL DEFAULT NULL,
+  `updated_at` timestamp NULL DEFAULT NULL,
   KEY `user_id` (`user_id`,`created_at`),
   KEY `created_at` (`created_at`)
   KEY `idx_user_id_private_created_at` (`user_id`,`private`,`created_at`)
@@ -52,12 +78,40 @@ CREATE TABLE IF NOT EXISTS comments (
   `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `entry_id` int NOT NULL,
   `user_id` int NOT NULL,
+  `parent_id` int NOT NULL DEFAULT 0,
+  `thread_id` int NOT NULL DEFAULT 0,
+  `depth` tinyint NOT NULL DEFAULT 0,
   `comment` text,
   `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `deleted_at` timestamp NULL DEFAULT NULL,
   KEY `entry_id` (`entry_id`),
-  KEY `created_at` (`created_at`)
+  KEY `created_at` (`created_at`),
+  KEY `idx_user_id_created_at` (`user_id`, `created_at`),
+  KEY `thread_id` (`thread_id`)
 ) DEFAULT CHARSET=utf8mb4;
 
+-- DROP TABLE IF EXISTS timelines;
+CREATE TABLE IF NOT EXISTS timelines (
+  `user_id` int NOT NULL,
+  `entry_id` int NOT NULL,
+  `author_id` int NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`user_id`, `entry_id`),
+  KEY `idx_user_id_created_at` (`user_id`, `created_at`),
+  KEY `idx_user_id_author_id` (`user_id`, `author_id`)
+) DEFAULT CHARSET=utf8;
+
+-- DROP TABLE IF EXISTS comment_feeds;
+CREATE TABLE IF NOT EXISTS comment_feeds (
+  `user_id` int NOT NULL,
+  `comment_id` int NOT NULL,
+  `commenter_id` int NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`user_id`, `comment_id`),
+  KEY `idx_user_id_created_at` (`user_id`, `created_at`),
+  KEY `idx_user_id_commenter_id` (`user_id`, `commenter_id`)
+) DEFAULT CHARSET=utf8;
+
 -- DROP TABLE IF EXISTS footprints;
 CREATE TABLE IF NOT EXISTS footprints (
   `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
@@ -66,3 +120,99 @@ CREATE TABLE IF NOT EXISTS footprints (
   `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
   KEY `idx_user_id_owner_id_created_at` (`user_id`,`owner_id`,`created_at`)
 ) DEFAULT CHARSET=utf8;
+
+-- DROP TABLE IF EXISTS daily_footprints;
+CREATE TABLE IF NOT EXISTS daily_footprints (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` int NOT NULL,
+  `owner_id` int NOT NULL,
+  `date` date NOT NULL,
+  `updated` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY `user_id_owner_id_date` (`user_id`, `owner_id`, `date`),
+  KEY `idx_user_id_updated` (`user_id`, `updated`, `id`)
+) DEFAULT CHARSET=utf8;
+
+-- DROP TABLE IF EXISTS notifications;
+CREATE TABLE IF NOT EXISTS notifications (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` int NOT NULL,
+  `type` varchar(32) NOT NULL,
+  `actor_id` int NOT NULL,
+  `entry_id` int NOT NULL DEFAULT 0,
+  `dedup_key` varchar(64) DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `read_at` timestamp NULL DEFAULT NULL,
+  UNIQUE KEY `user_id_dedup_key` (`user_id`, `dedup_key`),
+  KEY `idx_user_id_created_at` (`user_id`, `created_at`),
+  KEY `idx_user_id_read_at` (`user_id`, `read_at`)
+) DEFAULT CHARSET=utf8;
+
+-- DROP TABLE IF EXISTS notification_optouts;
+CREATE TABLE IF NOT EXISTS notification_optouts (
+  `user_id` int NOT NULL,
+  `type` varchar(32) NOT NULL,
+  PRIMARY KEY (`user_id`, `type`)
+) DEFAULT CHARSET=utf8;
+
+-- DROP TABLE IF EXISTS api_tokens;
+CREATE TABLE IF NOT EXISTS api_tokens (
+  `token_hash` char(64) NOT NULL PRIMARY KEY,
+  `user_id` int NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  KEY `user_id` (`user_id`)
+) DEFAULT CHARSET=utf8;
+
+-- DROP TABLE IF EXISTS feed_tokens;
+CREATE TABLE IF NOT EXISTS feed_tokens (
+  `user_id` int NOT NULL PRIMARY KEY,
+  `token` char(64) NOT NULL,
+  UNIQUE KEY `token` (`token`)
+) DEFAULT CHARSET=utf8;
+
+-- DROP TABLE IF EXISTS entry_images;
+CREATE TABLE IF NOT EXISTS entry_images (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `entry_id` int NOT NULL,
+  `user_id` int NOT NULL,
+  `content_type` varchar(32) NOT NULL,
+  `width` int NOT NULL,
+  `height` int NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  KEY `entry_id` (`entry_id`)
+) DEFAULT CHARSET=utf8;
+
+-- DROP TABLE IF EXISTS profile_visibilities;
+CREATE TABLE IF NOT EXISTS profile_visibilities (
+  `user_id` int NOT NULL PRIMARY KEY,
+  `first_name` varchar(8) NOT NULL DEFAULT 'everyone',
+  `last_name` varchar(8) NOT NULL DEFAULT 'everyone',
+  `sex` varchar(8) NOT NULL DEFAULT 'friends',
+  `birthday` varchar(8) NOT NULL DEFAULT 'friends',
+  `pref` varchar(8) NOT NULL DEFAULT 'friends',
+  `email` varchar(8) NOT NULL DEFAULT 'friends'
+) DEFAULT CHARSET=utf8;
+
+-- DROP TABLE IF EXISTS suggestion_dismissals;
+CREATE TABLE IF NOT EXISTS suggestion_dismissals (
+  `user_id` int NOT NULL,
+  `dismissed_id` int NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`user_id`, `dismissed_id`)
+) DEFAULT CHARSET=utf8;
+
+-- DROP TABLE IF EXISTS friend_lists;
+CREATE TABLE IF NOT EXISTS friend_lists (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` int NOT NULL,
+  `name` varchar(64) NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  KEY `user_id` (`user_id`)
+) DEFAULT CHARSET=utf8mb4;
+
+-- DROP TABLE IF EXISTS friend_list_members;
+CREATE TABLE IF NOT EXISTS friend_list_members (
+  `list_id` int NOT NULL,
+  `user_id` int NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`list_id`, `user_id`)
+) DEFAULT CHARSET=utf8;